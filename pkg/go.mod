@@ -0,0 +1,10 @@
+module github.com/dvonthenen/enterprise-conversation-plugins/pkg
+
+go 1.18
+
+require (
+	github.com/neo4j/neo4j-go-driver/v5 v5.3.0
+	k8s.io/klog/v2 v2.90.0
+)
+
+require github.com/go-logr/logr v1.2.0 // indirect
@@ -0,0 +1,243 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+// Package insight provides the normalized form of question, action item and follow up text
+// shared by the realtime plugins. Stored Insight nodes are given the normalized text as a
+// property which is indexed, so previous mentions are found with an index lookup instead of
+// comparing the content of every Insight.
+package insight
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	klog "k8s.io/klog/v2"
+)
+
+const (
+	// NormalizedProperty name of the Insight property holding the normalized text
+	NormalizedProperty string = "normalizedContent"
+
+	// DefaultBatchSize number of Insight nodes updated per transaction by Backfill
+	DefaultBatchSize int = 1000
+)
+
+// Normalize questions and action items are free form text, so two mentions are considered the
+// same when they only differ by case, whitespace or trailing punctuation
+func Normalize(text string) string {
+	text = strings.ToLower(strings.TrimSpace(text))
+	text = strings.TrimRight(text, "?.!, ")
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// Correlation the correlation of an insight is its type and normalized text
+func Correlation(insightType, normalizedText string) string {
+	return fmt.Sprintf("%s/%s", strings.ToLower(insightType), normalizedText)
+}
+
+// EntityCorrelation the correlation of an entity is its category, type, sub type and the
+// detected value
+func EntityCorrelation(category, entityType, subType, value string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", strings.ToLower(category), strings.ToLower(entityType), strings.ToLower(subType), strings.ToLower(value))
+}
+
+// EnsureIndex creates the index on the normalized text when it does not exist
+func EnsureIndex(ctx context.Context, session neo4j.SessionWithContext) error {
+	_, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		result, err := tx.Run(ctx, `
+			CREATE INDEX insight_normalized_content IF NOT EXISTS
+			FOR (i:Insight) ON (i.`+NormalizedProperty+`)`, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, err = result.Consume(ctx)
+		return nil, err
+	})
+	return err
+}
+
+// Store sets the normalized text on the Insight nodes with the given IDs which do not have it
+// yet. insights maps the insight ID to its content.
+func Store(ctx context.Context, session neo4j.SessionWithContext, insights map[string]string) error {
+	if len(insights) == 0 {
+		return nil
+	}
+
+	rows := make([]map[string]any, 0, len(insights))
+	for id, content := range insights {
+		rows = append(rows, map[string]any{
+			"id":         id,
+			"normalized": Normalize(content),
+		})
+	}
+
+	_, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		result, err := tx.Run(ctx, `
+			UNWIND $rows AS row
+			MATCH (i:Insight {insightId: row.id})
+			WHERE i.`+NormalizedProperty+` IS NULL
+			SET i.`+NormalizedProperty+` = row.normalized`,
+			map[string]any{
+				"rows": rows,
+			})
+		if err != nil {
+			return nil, err
+		}
+		_, err = result.Consume(ctx)
+		return nil, err
+	})
+	return err
+}
+
+// Backfill sets the normalized text on every Insight node which does not have it yet, batchSize
+// nodes per transaction. It returns the number of nodes updated.
+func Backfill(ctx context.Context, session neo4j.SessionWithContext, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	total := 0
+	for {
+		updated, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+			result, err := tx.Run(ctx, `
+				MATCH (i:Insight)
+				WHERE i.`+NormalizedProperty+` IS NULL
+				RETURN elementId(i), i.content
+				LIMIT $batch_size`,
+				map[string]any{
+					"batch_size": batchSize,
+				})
+			if err != nil {
+				return 0, err
+			}
+
+			rows := make([]map[string]any, 0, batchSize)
+			for result.Next(ctx) {
+				id, _ := result.Record().Values[0].(string)
+				content, _ := result.Record().Values[1].(string)
+				rows = append(rows, map[string]any{
+					"id":         id,
+					"normalized": Normalize(content),
+				})
+			}
+			if err := result.Err(); err != nil {
+				return 0, err
+			}
+			if len(rows) == 0 {
+				return 0, nil
+			}
+
+			result, err = tx.Run(ctx, `
+				UNWIND $rows AS row
+				MATCH (i:Insight) WHERE elementId(i) = row.id
+				SET i.`+NormalizedProperty+` = row.normalized`,
+				map[string]any{
+					"rows": rows,
+				})
+			if err != nil {
+				return 0, err
+			}
+			_, err = result.Consume(ctx)
+			return len(rows), err
+		})
+		if err != nil {
+			return total, err
+		}
+
+		count, _ := updated.(int)
+		total += count
+		if count < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// Prepare creates the index on the normalized text and backfills it on insights stored before
+// the index existed. It returns the number of insights updated.
+func Prepare(ctx context.Context, session neo4j.SessionWithContext) (int, error) {
+	err := EnsureIndex(ctx, session)
+	if err != nil {
+		return 0, err
+	}
+
+	return Backfill(ctx, session, DefaultBatchSize)
+}
+
+// SessionFactory opens a Neo4j session, the plugin handlers' newSession
+type SessionFactory func(ctx context.Context, accessMode neo4j.AccessMode) neo4j.SessionWithContext
+
+/*
+	Insights seen per conversation which still need the normalized text stored. The insights
+	are stored by the dataminer as they arrive, so the normalized text is added once the
+	conversation ends. Without a session factory the insights are remembered but never stored.
+*/
+type Pending struct {
+	mu         sync.Mutex
+	insights   map[string]map[string]string
+	newSession SessionFactory
+}
+
+func NewPending(newSession SessionFactory) *Pending {
+	return &Pending{
+		insights:   make(map[string]map[string]string),
+		newSession: newSession,
+	}
+}
+
+// Add remembers the insight content for the conversation
+func (p *Pending) Add(conversationId, insightId, content string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	insights := p.insights[conversationId]
+	if insights == nil {
+		insights = make(map[string]string)
+		p.insights[conversationId] = insights
+	}
+	insights[insightId] = content
+}
+
+// Take returns and forgets the insights remembered for the conversation, keyed by insight ID
+func (p *Pending) Take(conversationId string) map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	insights := p.insights[conversationId]
+	delete(p.insights, conversationId)
+	return insights
+}
+
+// Prepare creates the index on the normalized text and backfills it on insights stored before
+// the index existed. It is meant to run in the background when a handler is created.
+func (p *Pending) Prepare(ctx context.Context) {
+	if p.newSession == nil {
+		return
+	}
+
+	session := p.newSession(ctx, neo4j.AccessModeWrite)
+	defer session.Close(ctx)
+
+	count, err := Prepare(ctx, session)
+	if err != nil {
+		klog.V(1).Infof("insight.Prepare failed. Err: %v\n", err)
+		return
+	}
+	klog.V(3).Infof("Normalized text stored on %d insights\n", count)
+}
+
+// Flush stores the normalized text on the insights remembered for the conversation, by the
+// time the conversation ends they have been persisted
+func (p *Pending) Flush(ctx context.Context, conversationId string) error {
+	insights := p.Take(conversationId)
+	if len(insights) == 0 || p.newSession == nil {
+		return nil
+	}
+
+	session := p.newSession(ctx, neo4j.AccessModeWrite)
+	defer session.Close(ctx)
+
+	return Store(ctx, session, insights)
+}
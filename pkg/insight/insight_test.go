@@ -0,0 +1,129 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package insight
+
+import (
+	"context"
+	"testing"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Can you send the report?", "can you send the report"},
+		{"  can YOU   send\tthe report ?!  ", "can you send the report"},
+		{"Send the report.", "send the report"},
+		{"Follow up, with legal, ", "follow up, with legal"},
+		{"?!.", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := Normalize(test.text); got != test.want {
+			t.Errorf("Normalize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	p := NewPending(nil)
+	p.Add("conversation-1", "insight-1", "Can you send the report?")
+	p.Add("conversation-1", "insight-2", "Follow up with legal")
+	p.Add("conversation-2", "insight-3", "Review the contract")
+
+	got := p.Take("conversation-1")
+	if len(got) != 2 || got["insight-1"] != "Can you send the report?" || got["insight-2"] != "Follow up with legal" {
+		t.Fatalf("Take(conversation-1) = %v", got)
+	}
+	if got := p.Take("conversation-1"); len(got) != 0 {
+		t.Fatalf("second Take(conversation-1) = %v, want empty", got)
+	}
+	if got := p.Take("conversation-2"); len(got) != 1 {
+		t.Fatalf("Take(conversation-2) = %v", got)
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	if got, want := Correlation("Question", Normalize("When is the renewal?")), "question/when is the renewal"; got != want {
+		t.Errorf("Correlation = %q, want %q", got, want)
+	}
+	if got, want := EntityCorrelation("Person", "Name", "First", "Jane"), "person/name/first/jane"; got != want {
+		t.Errorf("EntityCorrelation = %q, want %q", got, want)
+	}
+}
+
+// fakeSession records the parameters of the queries run in write transactions. The embedded
+// interfaces are never called, they only satisfy the unexported methods of the driver interfaces.
+type fakeSession struct {
+	neo4j.SessionWithContext
+	params []map[string]any
+}
+
+type fakeTransaction struct {
+	neo4j.ManagedTransaction
+	session *fakeSession
+}
+
+type fakeResult struct {
+	neo4j.ResultWithContext
+}
+
+func (fs *fakeSession) ExecuteWrite(ctx context.Context, work neo4j.ManagedTransactionWork, configurers ...func(*neo4j.TransactionConfig)) (any, error) {
+	return work(&fakeTransaction{session: fs})
+}
+
+func (fs *fakeSession) Close(ctx context.Context) error {
+	return nil
+}
+
+func (ft *fakeTransaction) Run(ctx context.Context, cypher string, params map[string]any) (neo4j.ResultWithContext, error) {
+	ft.session.params = append(ft.session.params, params)
+	return &fakeResult{}, nil
+}
+
+func (fr *fakeResult) Consume(ctx context.Context) (neo4j.ResultSummary, error) {
+	return nil, nil
+}
+
+func TestFlush(t *testing.T) {
+	session := &fakeSession{}
+	p := NewPending(func(ctx context.Context, accessMode neo4j.AccessMode) neo4j.SessionWithContext {
+		return session
+	})
+	p.Add("conversation-1", "insight-1", "Can you send the report?")
+
+	if err := p.Flush(context.Background(), "conversation-2"); err != nil || len(session.params) != 0 {
+		t.Fatalf("Flush(conversation-2) = %v with %d queries, want nothing stored", err, len(session.params))
+	}
+	if err := p.Flush(context.Background(), "conversation-1"); err != nil {
+		t.Fatalf("Flush(conversation-1) failed. Err: %v", err)
+	}
+
+	if len(session.params) != 1 {
+		t.Fatalf("queries = %d, want 1", len(session.params))
+	}
+	rows, _ := session.params[0]["rows"].([]map[string]any)
+	if len(rows) != 1 || rows[0]["id"] != "insight-1" || rows[0]["normalized"] != "can you send the report" {
+		t.Errorf("rows = %v", rows)
+	}
+	if got := p.Take("conversation-1"); len(got) != 0 {
+		t.Errorf("Take after Flush = %v, want empty", got)
+	}
+}
+
+func TestFlushWithoutSessions(t *testing.T) {
+	p := NewPending(nil)
+	p.Add("conversation-1", "insight-1", "Review the contract")
+
+	if err := p.Flush(context.Background(), "conversation-1"); err != nil {
+		t.Fatalf("Flush failed. Err: %v", err)
+	}
+	if got := p.Take("conversation-1"); len(got) != 0 {
+		t.Errorf("Take after Flush = %v, want empty", got)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+// Package workerpool provides a bounded pool of workers shared by the realtime plugins. Work is
+// assigned to a worker by hashing a key (the conversation ID) which preserves the order of work
+// within a key while different keys are processed in parallel.
+package workerpool
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	// DefaultWorkers number of workers processing work
+	DefaultWorkers int = 8
+
+	// DefaultQueueDepth number of items queued per worker before callers block
+	DefaultQueueDepth int = 100
+)
+
+var (
+	// ErrStopped the pool has been stopped and no longer accepts work
+	ErrStopped = errors.New("the worker pool has been stopped")
+)
+
+/*
+	Pool of workers. Submitting blocks once the worker's queue is full.
+*/
+type Pool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// New creates a pool with the given number of workers and queue depth per worker. Values less
+// than or equal to zero use the defaults.
+func New(workers, queueDepth int) *Pool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueDepth <= 0 {
+		queueDepth = DefaultQueueDepth
+	}
+
+	p := &Pool{
+		queues: make([]chan func(), workers),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), queueDepth)
+
+		p.wg.Add(1)
+		go p.run(p.queues[i])
+	}
+
+	return p
+}
+
+func (p *Pool) run(queue chan func()) {
+	defer p.wg.Done()
+
+	for work := range queue {
+		work()
+	}
+}
+
+// Submit queues work on the worker which owns the key and returns without waiting for it to run
+func (p *Pool) Submit(key string, work func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return ErrStopped
+	}
+
+	p.queues[p.owner(key)] <- work
+
+	return nil
+}
+
+// owner index of the worker which processes the key
+func (p *Pool) owner(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32() % uint32(len(p.queues))
+}
+
+// Do queues work on the worker which owns the key and waits for it to finish, returning the
+// error from the work
+func (p *Pool) Do(key string, work func() error) error {
+	done := make(chan error, 1)
+
+	err := p.Submit(key, func() {
+		done <- work()
+	})
+	if err != nil {
+		return err
+	}
+
+	return <-done
+}
+
+// Stop rejects new work and waits for all queued work to finish
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package workerpool
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOrderWithinKey(t *testing.T) {
+	p := New(4, 10)
+
+	var mu sync.Mutex
+	seen := make(map[string][]int)
+
+	for i := 0; i < 200; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			key, i := key, i
+			err := p.Submit(key, func() {
+				mu.Lock()
+				seen[key] = append(seen[key], i)
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Fatalf("Submit failed. Err: %v", err)
+			}
+		}
+	}
+	p.Stop()
+
+	for key, order := range seen {
+		if len(order) != 200 {
+			t.Fatalf("key %s ran %d items, want 200", key, len(order))
+		}
+		for i, v := range order {
+			if v != i {
+				t.Fatalf("key %s ran item %d at position %d", key, v, i)
+			}
+		}
+	}
+}
+
+func TestParallelAcrossKeys(t *testing.T) {
+	p := New(8, 10)
+	defer p.Stop()
+
+	// find two keys owned by different workers
+	keys := make([]string, 0, 2)
+	owners := make(map[uint32]bool)
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("conversation-%d", i)
+		owner := p.owner(key)
+		if owners[owner] {
+			continue
+		}
+		owners[owner] = true
+		keys = append(keys, key)
+	}
+
+	// the first key blocks until the second key has run, which only completes if the workers
+	// run in parallel
+	release := make(chan struct{})
+	done := make(chan struct{})
+	err := p.Submit(keys[0], func() {
+		<-release
+		close(done)
+	})
+	if err != nil {
+		t.Fatalf("Submit failed. Err: %v", err)
+	}
+	err = p.Submit(keys[1], func() {
+		close(release)
+	})
+	if err != nil {
+		t.Fatalf("Submit failed. Err: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("keys on different workers did not run in parallel")
+	}
+}
+
+func TestDoReturnsError(t *testing.T) {
+	p := New(2, 2)
+	defer p.Stop()
+
+	errWork := errors.New("work failed")
+	err := p.Do("a", func() error {
+		return errWork
+	})
+	if !errors.Is(err, errWork) {
+		t.Fatalf("Do returned %v, want %v", err, errWork)
+	}
+
+	err = p.Do("a", func() error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do returned %v, want nil", err)
+	}
+}
+
+func TestStopDrainsQueue(t *testing.T) {
+	p := New(2, 100)
+
+	var ran int32
+	for i := 0; i < 100; i++ {
+		err := p.Submit(fmt.Sprintf("key-%d", i%5), func() {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&ran, 1)
+		})
+		if err != nil {
+			t.Fatalf("Submit failed. Err: %v", err)
+		}
+	}
+	p.Stop()
+
+	if got := atomic.LoadInt32(&ran); got != 100 {
+		t.Fatalf("Stop returned after %d items, want 100", got)
+	}
+
+	err := p.Submit("key-0", func() {})
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("Submit after Stop returned %v, want %v", err, ErrStopped)
+	}
+	err = p.Do("key-0", func() error { return nil })
+	if !errors.Is(err, ErrStopped) {
+		t.Fatalf("Do after Stop returned %v, want %v", err, ErrStopped)
+	}
+
+	// stopping twice is a no-op
+	p.Stop()
+}
+
+func TestConcurrentSubmitAndStop(t *testing.T) {
+	p := New(4, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := p.Do(fmt.Sprintf("key-%d", i), func() error { return nil })
+				if err != nil && !errors.Is(err, ErrStopped) {
+					t.Errorf("Do returned %v", err)
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(time.Millisecond)
+	p.Stop()
+	wg.Wait()
+}
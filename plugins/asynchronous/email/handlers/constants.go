@@ -5,6 +5,52 @@ package handlers
 
 import "errors"
 
+const (
+	// trigger categories
+	TriggerQuestion   string = "Question"
+	TriggerFollowUp   string = "FollowUp"
+	TriggerActionItem string = "ActionItem"
+	TriggerTopic      string = "Topic"
+	TriggerTracker    string = "Tracker"
+	TriggerEntity     string = "Entity"
+
+	// DefaultRoute name of the route for the emailTo recipients
+	DefaultRoute string = "default"
+
+	// outbox defaults
+	DefaultOutboxDirectory      string = "outbox"
+	DefaultOutboxMaxAttempts    int    = 10
+	DefaultOutboxInitialBackoff string = "30s"
+	DefaultOutboxMaxBackoff     string = "1h"
+	DefaultOutboxInterval       string = "10s"
+
+	// digest defaults
+	DigestHourly          string = "hourly"
+	DigestDaily           string = "daily"
+	DefaultDigestSchedule string = DigestDaily
+	DefaultDigestAt       string = "08:00"
+	DefaultDigestTimeZone string = "UTC"
+	DefaultDigestSubject  string = "Conversation digest"
+
+	// recipient kinds, a digest is addressed the way the recipient was on the route
+	RecipientTo  string = "to"
+	RecipientCc  string = "cc"
+	RecipientBcc string = "bcc"
+
+	// outbox subdirectories
+	outboxPending string = "pending"
+	outboxDead    string = "dead"
+	outboxDigest  string = "digest"
+
+	// DefaultTimeFormat layout used by the formatTime template helper
+	DefaultTimeFormat string = "Jan 2, 2006 3:04:05 PM MST"
+)
+
+var (
+	// triggerCategories every trigger category
+	triggerCategories = []string{TriggerQuestion, TriggerFollowUp, TriggerActionItem, TriggerTopic, TriggerTracker, TriggerEntity}
+)
+
 var (
 	// ErrInvalidInput required input was not found
 	ErrInvalidInput = errors.New("required input was not found")
@@ -14,4 +60,16 @@ var (
 
 	// ErrConversationNotFound conversation not found
 	ErrConversationNotFound = errors.New("conversation not found")
+
+	// ErrInvalidRoute a routing rule in the config is not valid
+	ErrInvalidRoute = errors.New("routing rule is not valid")
+
+	// ErrInvalidOutbox the outbox config or an outbox entry is not valid
+	ErrInvalidOutbox = errors.New("outbox config or entry is not valid")
+
+	// ErrInvalidDigest the digest config is not valid
+	ErrInvalidDigest = errors.New("digest config is not valid")
+
+	// ErrInvalidPattern a match pattern in the config is not a valid regular expression
+	ErrInvalidPattern = errors.New("match pattern is not a valid regular expression")
 )
@@ -0,0 +1,365 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+func (h *Handler) parseDigest() error {
+	dc := &h.config.Digest
+
+	if dc.Schedule == "" {
+		dc.Schedule = DefaultDigestSchedule
+	}
+	if dc.At == "" {
+		dc.At = DefaultDigestAt
+	}
+	if dc.TimeZone == "" {
+		dc.TimeZone = DefaultDigestTimeZone
+	}
+	if dc.Subject == "" {
+		dc.Subject = DefaultDigestSubject
+	}
+
+	dc.Schedule = strings.ToLower(dc.Schedule)
+	if dc.Schedule != DigestHourly && dc.Schedule != DigestDaily {
+		klog.V(1).Infof("digest schedule %s is invalid\n", dc.Schedule)
+		return ErrInvalidDigest
+	}
+
+	at, err := time.Parse("15:04", dc.At)
+	if err != nil {
+		klog.V(1).Infof("digest at %s is invalid. Err: %v\n", dc.At, err)
+		return err
+	}
+	dc.hour, dc.minute = at.Hour(), at.Minute()
+
+	dc.location, err = time.LoadLocation(dc.TimeZone)
+	if err != nil {
+		klog.V(1).Infof("digest timeZone %s is invalid. Err: %v\n", dc.TimeZone, err)
+		return err
+	}
+
+	if dc.Template == "" {
+		klog.V(1).Infof("digest template not found\n")
+		return ErrInvalidDigest
+	}
+	dc.templates, err = h.parseTemplates(dc.Subject, dc.Template, dc.HtmlTemplate, reportTemplates{})
+	if err != nil {
+		klog.V(1).Infof("parseTemplates for digest failed. Err: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// next the time of the next digest after now, hourly digests go out on the hour and daily
+// digests at the configured time of day in the configured time zone
+func (dc *DigestConfig) next(now time.Time) time.Time {
+	now = now.In(dc.location)
+	year, month, day := now.Date()
+
+	if dc.Schedule == DigestHourly {
+		return time.Date(year, month, day, now.Hour()+1, 0, 0, 0, dc.location)
+	}
+
+	next := time.Date(year, month, day, dc.hour, dc.minute, 0, 0, dc.location)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// addToDigest stores the routed triggers of a conversation until the next digest goes out
+func (h *Handler) addToDigest(conversationId string, triggers []Trigger) error {
+	now := time.Now()
+
+	for i, routed := range h.routeTriggers(triggers) {
+		route := routed.route
+
+		entry := &DigestEntry{
+			/* #nosec G404 */
+			ID:             fmt.Sprintf("%020d-%02d-%08x", now.UnixNano(), i, rand.Uint32()),
+			ConversationID: conversationId,
+			Route:          route.Name,
+			To:             route.To,
+			Cc:             route.Cc,
+			Bcc:            route.Bcc,
+			Triggers:       routed.triggers,
+			Created:        now,
+		}
+
+		err := writeJSON(h.entryPath(outboxDigest, entry.ID), entry)
+		if err != nil {
+			klog.V(1).Infof("writeJSON failed. Err: %v\n", err)
+			return err
+		}
+		klog.V(3).Infof("Added conversation %s to digest for route %s\n", conversationId, route.Name)
+	}
+
+	return nil
+}
+
+// runDigest sends the digest on schedule
+func (h *Handler) runDigest() {
+	defer h.workersWg.Done()
+
+	for {
+		next := h.config.Digest.next(time.Now())
+		klog.V(4).Infof("Next digest at %s\n", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-h.stopWorkers:
+			timer.Stop()
+			return
+		case <-timer.C:
+			h.sendDigest()
+		}
+	}
+}
+
+// sendDigest renders a digest for every recipient with pending entries and queues it in the
+// outbox. Each recipient is removed from the entries once their digest has been queued, entries
+// which cannot be read are moved to the dead letter directory.
+func (h *Handler) sendDigest() {
+	dir := filepath.Join(h.config.Outbox.Directory, outboxDigest)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		klog.V(1).Infof("os.ReadDir failed. Err: %v\n", err)
+		return
+	}
+
+	entries := make([]*DigestEntry, 0)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		entry, err := readDigestEntry(path)
+		if err != nil {
+			// unreadable entries would otherwise be retried with every digest
+			klog.Errorf("readDigestEntry(%s) failed, moving to dead letter. Err: %v\n", file.Name(), err)
+			if err := os.Rename(path, filepath.Join(h.config.Outbox.Directory, outboxDead, file.Name())); err != nil {
+				klog.V(1).Infof("os.Rename failed. Err: %v\n", err)
+			}
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		klog.V(3).Infof("No conversations for the digest\n")
+		return
+	}
+
+	digests := buildDigests(entries, time.Now(), h.config.Digest.location)
+	recipients := make([]string, 0, len(digests))
+	for recipient := range digests {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+
+	for _, recipient := range recipients {
+		digest := digests[recipient]
+
+		email := &Email{
+			Route: outboxDigest,
+		}
+		switch digest.Kind {
+		case RecipientCc:
+			email.Cc = []string{recipient}
+		case RecipientBcc:
+			email.Bcc = []string{recipient}
+		default:
+			email.To = []string{recipient}
+		}
+
+		err := h.config.Digest.templates.render(email, digest)
+		if err != nil {
+			klog.V(1).Infof("renderDigest for %s failed. Err: %v\n", recipient, err)
+			continue
+		}
+
+		err = h.enqueueEmail("", email)
+		if err != nil {
+			klog.V(1).Infof("enqueueEmail for %s failed. Err: %v\n", recipient, err)
+			continue
+		}
+
+		h.removeRecipient(entries, recipient)
+	}
+}
+
+// removeRecipient removes the recipient from the entries, entries without recipients left
+// are deleted
+func (h *Handler) removeRecipient(entries []*DigestEntry, recipient string) {
+	for _, entry := range entries {
+		if !entry.remove(recipient) {
+			continue
+		}
+
+		path := h.entryPath(outboxDigest, entry.ID)
+		if len(entry.To)+len(entry.Cc)+len(entry.Bcc) == 0 {
+			if err := os.Remove(path); err != nil {
+				klog.V(1).Infof("os.Remove failed. Err: %v\n", err)
+			}
+			continue
+		}
+		if err := writeJSON(path, entry); err != nil {
+			klog.V(1).Infof("writeJSON failed. Err: %v\n", err)
+		}
+	}
+}
+
+// remove removes the recipient from every recipient list and reports whether it was found
+func (de *DigestEntry) remove(recipient string) bool {
+	found := false
+	for _, list := range []*[]string{&de.To, &de.Cc, &de.Bcc} {
+		kept := make([]string, 0, len(*list))
+		for _, address := range *list {
+			if address == recipient {
+				found = true
+				continue
+			}
+			kept = append(kept, address)
+		}
+		*list = kept
+	}
+	return found
+}
+
+// readDigestEntry reads a digest entry, entries without recipients or whose ID does not match
+// the file name are invalid
+func readDigestEntry(path string) (*DigestEntry, error) {
+	/* #nosec G304 */
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry DigestEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.To)+len(entry.Cc)+len(entry.Bcc) == 0 || entry.ID != strings.TrimSuffix(filepath.Base(path), ".json") {
+		return nil, ErrInvalidOutbox
+	}
+
+	return &entry, nil
+}
+
+// buildDigests groups the entries by recipient, each digest has the hits grouped by trigger
+// category followed by a section per conversation. Times are shown in the digest time zone.
+func buildDigests(entries []*DigestEntry, now time.Time, location *time.Location) map[string]*Digest {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	digests := make(map[string]*Digest)
+	for _, entry := range entries {
+		for _, recipient := range entry.recipients() {
+			digest := digests[recipient.address]
+			if digest == nil {
+				digest = &Digest{
+					Recipient: recipient.address,
+					Kind:      recipient.kind,
+					Start:     entry.Created.In(location),
+					End:       now.In(location),
+				}
+				digests[recipient.address] = digest
+			}
+
+			// addressed the most visible way the recipient is on any of the routes
+			if kindRank(recipient.kind) < kindRank(digest.Kind) {
+				digest.Kind = recipient.kind
+			}
+
+			// the same conversation can reach a recipient through more than one route
+			var conversation *DigestConversation
+			for i := range digest.Conversations {
+				if digest.Conversations[i].ConversationID == entry.ConversationID {
+					conversation = &digest.Conversations[i]
+					break
+				}
+			}
+			if conversation == nil {
+				digest.Conversations = append(digest.Conversations, DigestConversation{
+					ConversationID: entry.ConversationID,
+					Created:        entry.Created.In(location),
+				})
+				conversation = &digest.Conversations[len(digest.Conversations)-1]
+			}
+			conversation.Routes = append(conversation.Routes, entry.Route)
+
+			for _, trigger := range entry.Triggers {
+				conversation.Categories = addToGroup(conversation.Categories, trigger)
+				digest.Categories = addToGroup(digest.Categories, trigger)
+			}
+		}
+	}
+
+	return digests
+}
+
+// recipients every recipient of the entry once with the most visible kind they were addressed as
+func (de *DigestEntry) recipients() []digestRecipient {
+	recipients := make([]digestRecipient, 0, len(de.To)+len(de.Cc)+len(de.Bcc))
+	seen := make(map[string]bool)
+	for _, list := range []struct {
+		kind      string
+		addresses []string
+	}{
+		{kind: RecipientTo, addresses: de.To},
+		{kind: RecipientCc, addresses: de.Cc},
+		{kind: RecipientBcc, addresses: de.Bcc},
+	} {
+		for _, address := range list.addresses {
+			if seen[address] {
+				continue
+			}
+			seen[address] = true
+			recipients = append(recipients, digestRecipient{address: address, kind: list.kind})
+		}
+	}
+	return recipients
+}
+
+// kindRank orders the recipient kinds from the most to the least visible
+func kindRank(kind string) int {
+	switch kind {
+	case RecipientTo:
+		return 0
+	case RecipientCc:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// addToGroup appends the trigger to the group for its category
+func addToGroup(groups []TriggerGroup, trigger Trigger) []TriggerGroup {
+	for i := range groups {
+		if groups[i].Category == trigger.Category {
+			groups[i].Triggers = append(groups[i].Triggers, trigger)
+			return groups
+		}
+	}
+	return append(groups, TriggerGroup{
+		Category: trigger.Category,
+		Triggers: []Trigger{trigger},
+	})
+}
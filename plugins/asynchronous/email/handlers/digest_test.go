@@ -0,0 +1,169 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newDigestHandler(t *testing.T, subject string) *Handler {
+	h := newOutboxHandler(t, &fakeSender{})
+	h.config.Digest.location = time.UTC
+
+	var err error
+	h.config.Digest.templates, err = h.parseTemplates(subject, "../digest.txt", "", reportTemplates{})
+	if err != nil {
+		t.Fatalf("parseTemplates failed. Err: %v", err)
+	}
+	return h
+}
+
+func writeDigestEntry(t *testing.T, h *Handler, entry *DigestEntry) {
+	if err := writeJSON(h.entryPath(outboxDigest, entry.ID), entry); err != nil {
+		t.Fatalf("writeJSON failed. Err: %v", err)
+	}
+}
+
+// queuedDigests the recipients of the queued digests by kind
+func queuedDigests(t *testing.T, h *Handler) map[string][]string {
+	queued := make(map[string][]string)
+	add := func(kind string, addresses []string) {
+		if len(addresses) > 0 {
+			queued[kind] = append(queued[kind], addresses...)
+		}
+	}
+	for _, path := range outboxFiles(t, h, outboxPending) {
+		entry, err := h.readEntry(path)
+		if err != nil {
+			t.Fatalf("readEntry failed. Err: %v", err)
+		}
+		add(RecipientTo, entry.Email.To)
+		add(RecipientCc, entry.Email.Cc)
+		add(RecipientBcc, entry.Email.Bcc)
+	}
+	return queued
+}
+
+func TestBuildDigestsKeepsRecipientKind(t *testing.T) {
+	now := time.Date(2023, 3, 15, 8, 0, 0, 0, time.UTC)
+	entries := []*DigestEntry{
+		{ID: "1", ConversationID: "conversation-1", Route: "sales", To: []string{"a@example.com"}, Cc: []string{"b@example.com"}, Bcc: []string{"c@example.com"}, Created: now},
+		{ID: "2", ConversationID: "conversation-2", Route: "legal", Bcc: []string{"a@example.com", "d@example.com"}, Cc: []string{"d@example.com"}, Created: now},
+	}
+
+	got := make(map[string]string)
+	for recipient, digest := range buildDigests(entries, now, time.UTC) {
+		got[recipient] = digest.Kind
+	}
+	want := map[string]string{
+		"a@example.com": RecipientTo,
+		"b@example.com": RecipientCc,
+		"c@example.com": RecipientBcc,
+		"d@example.com": RecipientCc,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("kinds = %v, want %v", got, want)
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	h := newDigestHandler(t, "Digest for {{.Recipient}}")
+	writeDigestEntry(t, h, &DigestEntry{
+		ID:             "00000000000000000001-00-00000001",
+		ConversationID: "conversation-1",
+		Route:          "sales",
+		To:             []string{"a@example.com"},
+		Cc:             []string{"b@example.com"},
+		Bcc:            []string{"c@example.com"},
+		Triggers:       []Trigger{{Category: TriggerQuestion, Value: "pricing"}},
+		Created:        time.Now(),
+	})
+
+	h.sendDigest()
+
+	want := map[string][]string{
+		RecipientTo:  {"a@example.com"},
+		RecipientCc:  {"b@example.com"},
+		RecipientBcc: {"c@example.com"},
+	}
+	if got := queuedDigests(t, h); !reflect.DeepEqual(got, want) {
+		t.Errorf("queued = %v, want %v", got, want)
+	}
+	if files := outboxFiles(t, h, outboxDigest); len(files) != 0 {
+		t.Errorf("digest entries = %v, want none left", files)
+	}
+}
+
+func TestSendDigestPartialFailure(t *testing.T) {
+	// rendering fails for b@example.com only
+	h := newDigestHandler(t, `{{if eq .Recipient "b@example.com"}}{{index .Categories 99}}{{end}}Digest`)
+	entry := &DigestEntry{
+		ID:             "00000000000000000001-00-00000001",
+		ConversationID: "conversation-1",
+		Route:          "sales",
+		To:             []string{"a@example.com", "b@example.com"},
+		Bcc:            []string{"c@example.com"},
+		Triggers:       []Trigger{{Category: TriggerQuestion, Value: "pricing"}},
+		Created:        time.Now(),
+	}
+	writeDigestEntry(t, h, entry)
+
+	h.sendDigest()
+
+	want := map[string][]string{
+		RecipientTo:  {"a@example.com"},
+		RecipientBcc: {"c@example.com"},
+	}
+	if got := queuedDigests(t, h); !reflect.DeepEqual(got, want) {
+		t.Errorf("queued = %v, want %v", got, want)
+	}
+
+	stored, err := readDigestEntry(h.entryPath(outboxDigest, entry.ID))
+	if err != nil {
+		t.Fatalf("readDigestEntry failed. Err: %v", err)
+	}
+	if !reflect.DeepEqual(stored.To, []string{"b@example.com"}) || len(stored.Cc)+len(stored.Bcc) != 0 {
+		t.Errorf("entry recipients = %v %v %v, want only b@example.com left", stored.To, stored.Cc, stored.Bcc)
+	}
+
+	// the next digest only goes to the recipient who missed out
+	h.config.Digest.templates, err = h.parseTemplates("Digest", "../digest.txt", "", reportTemplates{})
+	if err != nil {
+		t.Fatalf("parseTemplates failed. Err: %v", err)
+	}
+	h.sendDigest()
+
+	got := queuedDigests(t, h)
+	if len(got[RecipientTo]) != 2 || len(got[RecipientBcc]) != 1 {
+		t.Errorf("queued = %v, want one more digest for b@example.com only", got)
+	}
+	if files := outboxFiles(t, h, outboxDigest); len(files) != 0 {
+		t.Errorf("digest entries = %v, want none left", files)
+	}
+}
+
+func TestSendDigestMovesUnreadableEntries(t *testing.T) {
+	h := newDigestHandler(t, "Digest")
+
+	garbage := filepath.Join(h.config.Outbox.Directory, outboxDigest, "garbage.json")
+	if err := os.WriteFile(garbage, []byte("{not json"), 0600); err != nil {
+		t.Fatalf("os.WriteFile failed. Err: %v", err)
+	}
+	writeDigestEntry(t, h, &DigestEntry{ID: "no-recipients", ConversationID: "conversation-1"})
+
+	h.sendDigest()
+
+	if files := outboxFiles(t, h, outboxDigest); len(files) != 0 {
+		t.Errorf("digest entries = %v, want the unreadable ones moved", files)
+	}
+	for _, name := range []string{"garbage.json", "no-recipients.json"} {
+		if _, err := os.Stat(filepath.Join(h.config.Outbox.Directory, outboxDead, name)); err != nil {
+			t.Errorf("%s not in the dead letter directory. Err: %v", name, err)
+		}
+	}
+}
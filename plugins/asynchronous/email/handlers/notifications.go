@@ -4,16 +4,11 @@
 package handlers
 
 import (
-	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"os"
-	"regexp"
 	"strconv"
-	"text/template"
 
-	gomail "gopkg.in/mail.v2"
 	klog "k8s.io/klog/v2"
 
 	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
@@ -26,11 +21,42 @@ func NewHandler(options HandlerOptions) *Handler {
 		options:       options,
 		cache:         make(map[string]*utils.MessageCache),
 		conversations: make(map[string]*ConversationResult),
-		triggers:      make(map[string][]string),
+		triggers:      make(map[string][]Trigger),
+		wakeOutbox:    make(chan struct{}, 1),
+		stopWorkers:   make(chan struct{}),
 	}
 	return &handler
 }
 
+// Start creates the outbox directories and starts delivering the emails queued there,
+// including any left over from a previous run
+func (h *Handler) Start() error {
+	err := h.createOutbox()
+	if err != nil {
+		klog.V(1).Infof("createOutbox failed. Err: %v\n", err)
+		return err
+	}
+
+	h.workersWg.Add(1)
+	go h.runOutbox()
+
+	if h.config.Digest.Enabled {
+		h.workersWg.Add(1)
+		go h.runDigest()
+	}
+
+	return nil
+}
+
+// Stop waits for the background workers to exit, queued emails and pending digest entries
+// stay on disk for the next run. Calling Stop more than once is safe.
+func (h *Handler) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stopWorkers)
+	})
+	h.workersWg.Wait()
+}
+
 func (h *Handler) SetClientPublisher(mp *interfacessdk.MessagePublisher) {
 	klog.V(4).Infof("SetClientPublisher called...\n")
 	h.msgPublisher = mp
@@ -66,14 +92,64 @@ func (h *Handler) ParseConfig() error {
 	}
 	h.config.EmailSmtpPassword = stmpPassword
 
-	// template
-	h.template, err = template.ParseFiles(h.config.Template)
+	// convert string port to int
+	h.config.smtpPort, err = strconv.Atoi(h.config.EmailSmtpPort)
+	if err != nil {
+		klog.V(1).Infof("strconv.Atoi failed. Err: %v\n", err)
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return err
+	}
+
+	// outbox
+	err = h.config.Outbox.parse()
+	if err != nil {
+		klog.V(1).Infof("Outbox config is invalid. Err: %v\n", err)
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return err
+	}
+
+	// match patterns
+	err = h.compileMatchers()
+	if err != nil {
+		klog.V(1).Infof("compileMatchers failed. Err: %v\n", err)
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return err
+	}
+
+	// templates
+	if h.config.Template == "" {
+		klog.Errorf("template not found\n")
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return ErrInvalidInput
+	}
+	if h.config.TimeFormat == "" {
+		h.config.TimeFormat = DefaultTimeFormat
+	}
+	h.templates, err = h.parseTemplates(h.config.EmailSubject, h.config.Template, h.config.HtmlTemplate, reportTemplates{})
+	if err != nil {
+		klog.V(1).Infof("parseTemplates failed. Err: %v\n", err)
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return err
+	}
+
+	// routing rules
+	err = h.parseRoutes()
 	if err != nil {
-		klog.V(1).Infof("template.ParseFiles failed. Err: %v\n", err)
+		klog.V(1).Infof("parseRoutes failed. Err: %v\n", err)
 		klog.V(6).Infof("ParseConfig LEAVE\n")
 		return err
 	}
 
+	// digest mode
+	if h.config.Digest.Enabled {
+		err = h.parseDigest()
+		if err != nil {
+			klog.V(1).Infof("parseDigest failed. Err: %v\n", err)
+			klog.V(6).Infof("ParseConfig LEAVE\n")
+			return err
+		}
+	}
+
 	klog.V(4).Infof("ParseConfig Succeeded\n")
 	klog.V(6).Infof("ParseConfig LEAVE\n")
 	return nil
@@ -88,7 +164,7 @@ func (h *Handler) InitializedConversation(im *shared.InitializationResult) error
 	h.conversations[conversationId] = &ConversationResult{
 		ConversationID: conversationId,
 	}
-	h.triggers[conversationId] = make([]string, 0)
+	h.triggers[conversationId] = make([]Trigger, 0)
 
 	return nil
 }
@@ -120,19 +196,7 @@ func (h *Handler) QuestionResult(qr *shared.QuestionResult) error {
 	result.QuestionResult = qr.QuestionResult
 
 	for _, question := range qr.QuestionResult.Questions {
-		for _, regex := range h.config.FollowUpMatch {
-			match, err := regexp.MatchString(regex, question.Text)
-			if err != nil {
-				klog.V(6).Infof("MatchString failed. Err: %v\n", err)
-				continue
-			}
-			if !match {
-				klog.V(6).Infof("%s != %s\n", regex, question.Text)
-				continue
-			}
-			klog.V(2).Infof("Match %s = %s\n", regex, question.Text)
-			h.triggers[qr.ConversationID] = append(h.triggers[qr.ConversationID], fmt.Sprintf("Question - %s", question.Text))
-		}
+		h.matchTriggers(qr.ConversationID, TriggerQuestion, question.Text, question.Text)
 	}
 
 	return nil
@@ -146,19 +210,7 @@ func (h *Handler) FollowUpResult(fur *shared.FollowUpResult) error {
 	result.FollowUpResult = fur.FollowUpResult
 
 	for _, followUp := range fur.FollowUpResult.FollowUps {
-		for _, regex := range h.config.FollowUpMatch {
-			match, err := regexp.MatchString(regex, followUp.Text)
-			if err != nil {
-				klog.V(6).Infof("MatchString failed. Err: %v\n", err)
-				continue
-			}
-			if !match {
-				klog.V(6).Infof("%s != %s\n", regex, followUp.Text)
-				continue
-			}
-			klog.V(2).Infof("Match %s = %s\n", regex, followUp.Text)
-			h.triggers[fur.ConversationID] = append(h.triggers[fur.ConversationID], fmt.Sprintf("FollowUp - %s", followUp.Text))
-		}
+		h.matchTriggers(fur.ConversationID, TriggerFollowUp, followUp.Text, followUp.Text)
 	}
 
 	return nil
@@ -172,19 +224,7 @@ func (h *Handler) ActionItemResult(air *shared.ActionItemResult) error {
 	result.ActionItemResult = air.ActionItemResult
 
 	for _, actionItem := range air.ActionItemResult.ActionItems {
-		for _, regex := range h.config.FollowUpMatch {
-			match, err := regexp.MatchString(regex, actionItem.Text)
-			if err != nil {
-				klog.V(6).Infof("MatchString failed. Err: %v\n", err)
-				continue
-			}
-			if !match {
-				klog.V(6).Infof("%s != %s\n", regex, actionItem.Text)
-				continue
-			}
-			klog.V(2).Infof("Match %s = %s\n", regex, actionItem.Text)
-			h.triggers[air.ConversationID] = append(h.triggers[air.ConversationID], fmt.Sprintf("ActionItem - %s", actionItem.Text))
-		}
+		h.matchTriggers(air.ConversationID, TriggerActionItem, actionItem.Text, actionItem.Text)
 	}
 
 	return nil
@@ -198,19 +238,7 @@ func (h *Handler) TopicResult(tr *shared.TopicResult) error {
 	result.TopicResult = tr.TopicResult
 
 	for _, topic := range tr.TopicResult.Topics {
-		for _, regex := range h.config.FollowUpMatch {
-			match, err := regexp.MatchString(regex, topic.Text)
-			if err != nil {
-				klog.V(6).Infof("MatchString failed. Err: %v\n", err)
-				continue
-			}
-			if !match {
-				klog.V(6).Infof("%s != %s\n", regex, topic.Text)
-				continue
-			}
-			klog.V(2).Infof("Match %s = %s\n", regex, topic.Text)
-			h.triggers[tr.ConversationID] = append(h.triggers[tr.ConversationID], fmt.Sprintf("Topic - %s", topic.Text))
-		}
+		h.matchTriggers(tr.ConversationID, TriggerTopic, topic.Text, topic.Text)
 	}
 
 	return nil
@@ -224,19 +252,7 @@ func (h *Handler) TrackerResult(tr *shared.TrackerResult) error {
 	result.TrackerResult = tr.TrackerResult
 
 	for _, trackerMatch := range tr.TrackerResult.Matches {
-		for _, regex := range h.config.FollowUpMatch {
-			match, err := regexp.MatchString(regex, tr.TrackerResult.Name)
-			if err != nil {
-				klog.V(6).Infof("MatchString failed. Err: %v\n", err)
-				continue
-			}
-			if !match {
-				klog.V(6).Infof("%s != %s/%s\n", regex, tr.TrackerResult.Name, trackerMatch.Value)
-				continue
-			}
-			klog.V(2).Infof("Match %s = %s/%s\n", regex, tr.TrackerResult.Name, trackerMatch.Value)
-			h.triggers[tr.ConversationID] = append(h.triggers[tr.ConversationID], fmt.Sprintf("Tracker - %s/%s", tr.TrackerResult.Name, trackerMatch.Value))
-		}
+		h.matchTriggers(tr.ConversationID, TriggerTracker, tr.TrackerResult.Name, fmt.Sprintf("%s/%s", tr.TrackerResult.Name, trackerMatch.Value))
 	}
 
 	return nil
@@ -251,19 +267,7 @@ func (h *Handler) EntityResult(er *shared.EntityResult) error {
 
 	for _, entity := range er.EntityResult.Entities {
 		for _, entityMatch := range entity.Matches {
-			for _, regex := range h.config.FollowUpMatch {
-				match, err := regexp.MatchString(regex, entityMatch.DetectedValue)
-				if err != nil {
-					klog.V(6).Infof("MatchString failed. Err: %v\n", err)
-					continue
-				}
-				if !match {
-					klog.V(6).Infof("%s != %s\n", regex, entityMatch.DetectedValue)
-					continue
-				}
-				klog.V(2).Infof("Match %s = %s\n", regex, entityMatch.DetectedValue)
-				h.triggers[er.ConversationID] = append(h.triggers[er.ConversationID], fmt.Sprintf("Entity - %s", entityMatch.DetectedValue))
-			}
+			h.matchTriggers(er.ConversationID, TriggerEntity, entityMatch.DetectedValue, entityMatch.DetectedValue)
 		}
 	}
 
@@ -283,11 +287,13 @@ func (h *Handler) TeardownConversation(tm *shared.TeardownResult) error {
 		return ErrConversationNotFound
 	}
 	triggers := h.triggers[conversationId]
-	if conversation == nil {
-		klog.V(1).Infof("triggers[%s] not found\n", conversationId)
-		klog.V(6).Infof("TeardownConversation LEAVE\n")
-		return ErrConversationNotFound
-	}
+
+	// clean up regardless of whether an email goes out
+	defer func() {
+		delete(h.cache, conversationId)
+		delete(h.conversations, conversationId)
+		delete(h.triggers, conversationId)
+	}()
 
 	// conversation of interest?
 	klog.V(5).Infof("triggers matched:\n")
@@ -297,6 +303,21 @@ func (h *Handler) TeardownConversation(tm *shared.TeardownResult) error {
 
 	if len(triggers) == 0 {
 		klog.V(3).Infof("No triggers in conversationId: %s\n", conversationId)
+		klog.V(6).Infof("TeardownConversation LEAVE\n")
+		return nil
+	}
+
+	// digest mode sends the triggers on the schedule instead
+	if h.config.Digest.Enabled {
+		err := h.addToDigest(conversationId, triggers)
+		if err != nil {
+			klog.V(1).Infof("addToDigest failed. Err: %v\n", err)
+			klog.V(6).Infof("TeardownConversation LEAVE\n")
+			return err
+		}
+
+		klog.V(4).Infof("TeardownConversation Succeeded\n")
+		klog.V(6).Infof("TeardownConversation LEAVE\n")
 		return nil
 	}
 
@@ -308,60 +329,24 @@ func (h *Handler) TeardownConversation(tm *shared.TeardownResult) error {
 		return err
 	}
 
-	// convert string port to int
-	ismtpPort, err := strconv.Atoi(h.config.EmailSmtpPort)
+	// emails for each route
+	emails, err := h.routeEmails(conversation, triggers, string(data))
 	if err != nil {
-		klog.V(1).Infof("strconv.Atoi failed. Err: %v\n", err)
+		klog.V(1).Infof("routeEmails failed. Err: %v\n", err)
 		klog.V(6).Infof("TeardownConversation LEAVE\n")
 		return err
 	}
-	// body
-	var body bytes.Buffer
-	h.template.Execute(&body, struct {
-		Triggers []string
-		Dump     string
-	}{
-		Triggers: triggers,
-		Dump:     string(data),
-	})
-
-	// setup and send email
-	m := gomail.NewMessage()
-
-	// Set E-Mail sender
-	m.SetHeader("From", h.config.EmailFrom)
-
-	// Set E-Mail receivers
-	m.SetHeader("To", h.config.EmailTo)
-
-	// Set E-Mail subject
-	m.SetHeader("Subject", h.config.EmailSubject)
-
-	// Set E-Mail body. You can set plain text or html with text/html
-	m.SetBody("text/plain", body.String())
-
-	// Settings for SMTP server
-	d := gomail.NewDialer(h.config.EmailSmtpAddr, ismtpPort, h.config.EmailSmtpUsername, h.config.EmailSmtpPassword)
-
-	// skip server auth
-	if h.config.SkipServerAuth {
-		// TODO: add verification later, pick up from ENV or FILE
-		/* #nosec G402 */
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	}
 
-	// Now send E-Mail
-	if err := d.DialAndSend(m); err != nil {
-		klog.V(1).Infof("DialAndSend failed. Err: %v\n", err)
-		klog.V(6).Infof("TeardownConversation LEAVE\n")
-		return err
+	// hand off to the outbox which takes care of delivery and retries
+	for _, email := range emails {
+		err := h.enqueueEmail(conversationId, email)
+		if err != nil {
+			klog.V(1).Infof("enqueueEmail for route %s failed. Err: %v\n", email.Route, err)
+			klog.V(6).Infof("TeardownConversation LEAVE\n")
+			return err
+		}
 	}
 
-	// clean up
-	delete(h.cache, conversationId)
-	delete(h.conversations, conversationId)
-	delete(h.triggers, conversationId)
-
 	klog.V(4).Infof("TeardownConversation Succeeded\n")
 	klog.V(6).Infof("TeardownConversation LEAVE\n")
 	return nil
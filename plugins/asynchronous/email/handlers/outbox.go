@@ -0,0 +1,297 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gomail "gopkg.in/mail.v2"
+	klog "k8s.io/klog/v2"
+)
+
+func (oc *OutboxConfig) parse() error {
+	if oc.Directory == "" {
+		oc.Directory = DefaultOutboxDirectory
+	}
+	if oc.MaxAttempts == 0 {
+		oc.MaxAttempts = DefaultOutboxMaxAttempts
+	}
+	if oc.InitialBackoff == "" {
+		oc.InitialBackoff = DefaultOutboxInitialBackoff
+	}
+	if oc.MaxBackoff == "" {
+		oc.MaxBackoff = DefaultOutboxMaxBackoff
+	}
+	if oc.Interval == "" {
+		oc.Interval = DefaultOutboxInterval
+	}
+
+	var err error
+	oc.initialBackoff, err = time.ParseDuration(oc.InitialBackoff)
+	if err != nil {
+		klog.V(1).Infof("initialBackoff %s is invalid. Err: %v\n", oc.InitialBackoff, err)
+		return err
+	}
+	oc.maxBackoff, err = time.ParseDuration(oc.MaxBackoff)
+	if err != nil {
+		klog.V(1).Infof("maxBackoff %s is invalid. Err: %v\n", oc.MaxBackoff, err)
+		return err
+	}
+	oc.interval, err = time.ParseDuration(oc.Interval)
+	if err != nil {
+		klog.V(1).Infof("interval %s is invalid. Err: %v\n", oc.Interval, err)
+		return err
+	}
+
+	if oc.MaxAttempts < 1 || oc.initialBackoff <= 0 || oc.maxBackoff < oc.initialBackoff || oc.interval <= 0 {
+		return ErrInvalidOutbox
+	}
+
+	return nil
+}
+
+// backoff exponential delay before the next attempt, with jitter so a burst of failures
+// doesn't retry in lockstep
+func (oc *OutboxConfig) backoff(attempts int) time.Duration {
+	delay := oc.initialBackoff
+	for i := 1; i < attempts && delay < oc.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > oc.maxBackoff {
+		delay = oc.maxBackoff
+	}
+
+	// anywhere between half and the full delay
+	half := delay / 2
+	/* #nosec G404 */
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (h *Handler) createOutbox() error {
+	for _, dir := range []string{outboxPending, outboxDead, outboxDigest} {
+		err := os.MkdirAll(filepath.Join(h.config.Outbox.Directory, dir), 0750)
+		if err != nil {
+			klog.V(1).Infof("os.MkdirAll failed. Err: %v\n", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueEmail persists the rendered email so it survives a restart and wakes the worker
+func (h *Handler) enqueueEmail(conversationId string, email *Email) error {
+	now := time.Now()
+
+	entry := &OutboxEntry{
+		/* #nosec G404 */
+		ID:             fmt.Sprintf("%020d-%08x", now.UnixNano(), rand.Uint32()),
+		ConversationID: conversationId,
+		Email:          email,
+		Created:        now,
+		NextAttempt:    now,
+	}
+
+	err := h.writeEntry(outboxPending, entry)
+	if err != nil {
+		klog.V(1).Infof("writeEntry failed. Err: %v\n", err)
+		return err
+	}
+	klog.V(3).Infof("Queued email %s for route %s\n", entry.ID, email.Route)
+
+	select {
+	case h.wakeOutbox <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// runOutbox delivers due emails whenever something is queued and on every interval
+func (h *Handler) runOutbox() {
+	defer h.workersWg.Done()
+
+	h.processOutbox()
+
+	ticker := time.NewTicker(h.config.Outbox.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stopWorkers:
+			return
+		case <-h.wakeOutbox:
+			h.processOutbox()
+		case <-ticker.C:
+			h.processOutbox()
+		}
+	}
+}
+
+func (h *Handler) processOutbox() {
+	dir := filepath.Join(h.config.Outbox.Directory, outboxPending)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		klog.V(1).Infof("os.ReadDir failed. Err: %v\n", err)
+		return
+	}
+
+	// oldest first, IDs start with the creation time
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	now := time.Now()
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		select {
+		case <-h.stopWorkers:
+			return
+		default:
+		}
+
+		path := filepath.Join(dir, file.Name())
+		entry, err := h.readEntry(path)
+		if err != nil {
+			// unreadable entries would otherwise be retried forever
+			klog.Errorf("readEntry(%s) failed, moving to dead letter. Err: %v\n", file.Name(), err)
+			if err := os.Rename(path, filepath.Join(h.config.Outbox.Directory, outboxDead, file.Name())); err != nil {
+				klog.V(1).Infof("os.Rename failed. Err: %v\n", err)
+			}
+			continue
+		}
+		if entry.NextAttempt.After(now) {
+			continue
+		}
+
+		h.deliverEntry(entry)
+	}
+}
+
+// deliverEntry sends the email and either removes it, schedules a retry or moves it to the
+// dead letter directory
+func (h *Handler) deliverEntry(entry *OutboxEntry) {
+	pending := h.entryPath(outboxPending, entry.ID)
+
+	err := h.sendEmail(entry.Email)
+	if err == nil {
+		klog.V(3).Infof("Sent email %s for route %s\n", entry.ID, entry.Email.Route)
+		if err := os.Remove(pending); err != nil {
+			klog.V(1).Infof("os.Remove failed. Err: %v\n", err)
+		}
+		return
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	klog.V(1).Infof("Sending email %s failed (attempt %d). Err: %v\n", entry.ID, entry.Attempts, err)
+
+	if entry.Attempts >= h.config.Outbox.MaxAttempts || isPermanent(err) {
+		klog.Errorf("Email %s moved to dead letter. Err: %v\n", entry.ID, err)
+		if err := h.writeEntry(outboxDead, entry); err != nil {
+			klog.V(1).Infof("writeEntry failed. Err: %v\n", err)
+			return
+		}
+		if err := os.Remove(pending); err != nil {
+			klog.V(1).Infof("os.Remove failed. Err: %v\n", err)
+		}
+		return
+	}
+
+	entry.NextAttempt = time.Now().Add(h.config.Outbox.backoff(entry.Attempts))
+	if err := h.writeEntry(outboxPending, entry); err != nil {
+		klog.V(1).Infof("writeEntry failed. Err: %v\n", err)
+	}
+}
+
+func (h *Handler) sendEmail(email *Email) error {
+	sender := h.sender
+	if sender == nil {
+		// Settings for SMTP server
+		d := gomail.NewDialer(h.config.EmailSmtpAddr, h.config.smtpPort, h.config.EmailSmtpUsername, h.config.EmailSmtpPassword)
+
+		// skip server auth
+		if h.config.SkipServerAuth {
+			// TODO: add verification later, pick up from ENV or FILE
+			/* #nosec G402 */
+			d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		sender = d
+	}
+
+	// Now send E-Mail
+	return sender.DialAndSend(h.newMessage(email))
+}
+
+// isPermanent SMTP 5xx replies won't succeed on retry. gomail wraps the reply in a SendError
+// which has no Unwrap, so its Cause is checked as well.
+func isPermanent(err error) bool {
+	var sendErr *gomail.SendError
+	if errors.As(err, &sendErr) {
+		return isPermanent(sendErr.Cause)
+	}
+
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	return false
+}
+
+func (h *Handler) entryPath(dir, id string) string {
+	return filepath.Join(h.config.Outbox.Directory, dir, id+".json")
+}
+
+func (h *Handler) writeEntry(dir string, entry *OutboxEntry) error {
+	return writeJSON(h.entryPath(dir, entry.ID), entry)
+}
+
+// writeJSON writes to a temporary file first so a crash never leaves a partial entry behind
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		klog.V(1).Infof("json.MarshalIndent failed. Err: %v\n", err)
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		klog.V(1).Infof("os.WriteFile failed. Err: %v\n", err)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (h *Handler) readEntry(path string) (*OutboxEntry, error) {
+	/* #nosec G304 */
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry OutboxEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Email == nil || entry.ID != strings.TrimSuffix(filepath.Base(path), ".json") {
+		return nil, ErrInvalidOutbox
+	}
+
+	return &entry, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	gomail "gopkg.in/mail.v2"
+)
+
+/*
+	Records the messages sent and fails with err when set
+*/
+type fakeSender struct {
+	mu       sync.Mutex
+	err      error
+	messages int
+}
+
+func (fs *fakeSender) DialAndSend(m ...*gomail.Message) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.messages += len(m)
+	return fs.err
+}
+
+func newOutboxHandler(t *testing.T, sender *fakeSender) *Handler {
+	h := NewHandler(HandlerOptions{})
+	h.sender = sender
+	h.config.EmailFrom = "plugin@example.com"
+	h.config.Outbox.Directory = t.TempDir()
+	if err := h.config.Outbox.parse(); err != nil {
+		t.Fatalf("parse failed. Err: %v", err)
+	}
+	if err := h.createOutbox(); err != nil {
+		t.Fatalf("createOutbox failed. Err: %v", err)
+	}
+	return h
+}
+
+func outboxFiles(t *testing.T, h *Handler, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(h.config.Outbox.Directory, dir, "*.json"))
+	if err != nil {
+		t.Fatalf("filepath.Glob failed. Err: %v", err)
+	}
+	return files
+}
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"5xx reply", &textproto.Error{Code: 550, Msg: "mailbox unavailable"}, true},
+		{"4xx reply", &textproto.Error{Code: 451, Msg: "try again later"}, false},
+		{"5xx in a SendError", &gomail.SendError{Cause: &textproto.Error{Code: 554, Msg: "rejected"}}, true},
+		{"4xx in a SendError", &gomail.SendError{Cause: &textproto.Error{Code: 421, Msg: "busy"}}, false},
+		{"wrapped SendError", fmt.Errorf("send: %w", &gomail.SendError{Index: 1, Cause: &textproto.Error{Code: 553, Msg: "bad address"}}), true},
+		{"network error", errors.New("connection refused"), false},
+		{"SendError without reply", &gomail.SendError{Cause: errors.New("connection reset")}, false},
+	}
+
+	for _, test := range tests {
+		if got := isPermanent(test.err); got != test.want {
+			t.Errorf("%s: isPermanent = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOutboxPermanentFailure(t *testing.T) {
+	sender := &fakeSender{err: &gomail.SendError{Cause: &textproto.Error{Code: 550, Msg: "mailbox unavailable"}}}
+	h := newOutboxHandler(t, sender)
+
+	if err := h.enqueueEmail("conversation-1", &Email{To: []string{"sales@example.com"}, Text: "report"}); err != nil {
+		t.Fatalf("enqueueEmail failed. Err: %v", err)
+	}
+	h.processOutbox()
+
+	if sender.messages != 1 {
+		t.Errorf("messages sent = %d, want 1", sender.messages)
+	}
+	if files := outboxFiles(t, h, outboxPending); len(files) != 0 {
+		t.Errorf("pending = %v, want the email moved to dead letter", files)
+	}
+	dead := outboxFiles(t, h, outboxDead)
+	if len(dead) != 1 {
+		t.Fatalf("dead = %v, want 1 entry", dead)
+	}
+	entry, err := h.readEntry(dead[0])
+	if err != nil {
+		t.Fatalf("readEntry failed. Err: %v", err)
+	}
+	if entry.Attempts != 1 || entry.LastError == "" {
+		t.Errorf("entry = %+v, want 1 attempt and the last error", entry)
+	}
+}
+
+func TestOutboxTemporaryFailure(t *testing.T) {
+	sender := &fakeSender{err: &gomail.SendError{Cause: &textproto.Error{Code: 421, Msg: "busy"}}}
+	h := newOutboxHandler(t, sender)
+
+	if err := h.enqueueEmail("conversation-1", &Email{To: []string{"sales@example.com"}, Text: "report"}); err != nil {
+		t.Fatalf("enqueueEmail failed. Err: %v", err)
+	}
+	h.processOutbox()
+
+	// the retry is not due yet
+	h.processOutbox()
+	if sender.messages != 1 {
+		t.Errorf("messages sent = %d, want 1", sender.messages)
+	}
+
+	pending := outboxFiles(t, h, outboxPending)
+	if len(pending) != 1 {
+		t.Fatalf("pending = %v, want the email kept for a retry", pending)
+	}
+	entry, err := h.readEntry(pending[0])
+	if err != nil {
+		t.Fatalf("readEntry failed. Err: %v", err)
+	}
+	if entry.Attempts != 1 || !entry.NextAttempt.After(time.Now()) {
+		t.Errorf("entry = %+v, want 1 attempt and a retry in the future", entry)
+	}
+	if files := outboxFiles(t, h, outboxDead); len(files) != 0 {
+		t.Errorf("dead = %v, want none", files)
+	}
+}
+
+func TestOutboxDelivers(t *testing.T) {
+	sender := &fakeSender{}
+	h := newOutboxHandler(t, sender)
+
+	if err := h.enqueueEmail("conversation-1", &Email{To: []string{"sales@example.com"}, Text: "report"}); err != nil {
+		t.Fatalf("enqueueEmail failed. Err: %v", err)
+	}
+	h.processOutbox()
+
+	if sender.messages != 1 {
+		t.Errorf("messages sent = %d, want 1", sender.messages)
+	}
+	if files := outboxFiles(t, h, outboxPending); len(files) != 0 {
+		t.Errorf("pending = %v, want the sent email removed", files)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	h := newOutboxHandler(t, &fakeSender{})
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start failed. Err: %v", err)
+	}
+
+	h.Stop()
+	h.Stop()
+
+	if _, err := os.Stat(filepath.Join(h.config.Outbox.Directory, outboxPending)); err != nil {
+		t.Errorf("outbox directory missing after Stop. Err: %v", err)
+	}
+}
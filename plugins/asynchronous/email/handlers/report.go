@@ -0,0 +1,222 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// parseTemplates loads the subject, the plain text template and, when configured, the html
+// report template. Empty values fall back to the templates in defaults.
+func (h *Handler) parseTemplates(subject, textFile, htmlFile string, defaults reportTemplates) (reportTemplates, error) {
+	templates := defaults
+
+	var err error
+	if subject != "" {
+		templates.subject, err = template.New("subject").Funcs(h.templateFuncs(false)).Parse(subject)
+		if err != nil {
+			klog.V(1).Infof("template.Parse(%s) failed. Err: %v\n", subject, err)
+			return templates, err
+		}
+	}
+
+	if textFile != "" {
+		templates.text, err = template.New(filepath.Base(textFile)).Funcs(h.templateFuncs(false)).ParseFiles(textFile)
+		if err != nil {
+			klog.V(1).Infof("template.ParseFiles failed. Err: %v\n", err)
+			return templates, err
+		}
+	}
+
+	if htmlFile != "" {
+		templates.html, err = htmltemplate.New(filepath.Base(htmlFile)).Funcs(h.templateFuncs(true)).ParseFiles(htmlFile)
+		if err != nil {
+			klog.V(1).Infof("htmltemplate.ParseFiles failed. Err: %v\n", err)
+			return templates, err
+		}
+	}
+
+	return templates, nil
+}
+
+// templateFuncs helper functions available to both templates, highlight only emits markup
+// for the html report
+func (h *Handler) templateFuncs(markup bool) map[string]any {
+	return map[string]any{
+		"formatTime": func(value string) string {
+			return formatTime(value, h.config.TimeFormat)
+		},
+		"highlight": func(text string, triggers []Trigger) any {
+			if !markup {
+				return text
+			}
+			return htmltemplate.HTML(highlight(text, triggers)) // #nosec G203 segments are escaped in highlight
+		},
+		"matched": matched,
+		"category": func(category string, triggers []Trigger) []Trigger {
+			return byCategory(triggers, category)
+		},
+		"percent": func(score float64) string {
+			return fmt.Sprintf("%.0f%%", score*100)
+		},
+		"join":  strings.Join,
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+	}
+}
+
+// newReport flattens the conversation so templates don't need nil checks on each result
+func newReport(conversation *ConversationResult, triggers []Trigger, dump string) *Report {
+	report := &Report{
+		ConversationID: conversation.ConversationID,
+		Triggers:       triggers,
+		Tracker:        conversation.TrackerResult,
+		Dump:           dump,
+	}
+
+	if conversation.MessageResult != nil {
+		report.Messages = conversation.MessageResult.Messages
+	}
+	if conversation.QuestionResult != nil {
+		report.Questions = conversation.QuestionResult.Questions
+	}
+	if conversation.FollowUpResult != nil {
+		report.FollowUps = conversation.FollowUpResult.FollowUps
+	}
+	if conversation.ActionItemResult != nil {
+		report.ActionItems = conversation.ActionItemResult.ActionItems
+	}
+	if conversation.TopicResult != nil {
+		report.Topics = conversation.TopicResult.Topics
+	}
+	if conversation.EntityResult != nil {
+		report.Entities = conversation.EntityResult.Entities
+	}
+
+	return report
+}
+
+// render fills in the subject, the plain text body and the html body of the email from a
+// Report or a Digest. The html body is empty when no html template is configured.
+func (rt *reportTemplates) render(email *Email, report any) error {
+	if rt.subject != nil {
+		var subject bytes.Buffer
+		err := rt.subject.Execute(&subject, report)
+		if err != nil {
+			klog.V(1).Infof("subject.Execute failed. Err: %v\n", err)
+			return err
+		}
+		email.Subject = strings.TrimSpace(subject.String())
+	}
+
+	var textBody bytes.Buffer
+	err := rt.text.Execute(&textBody, report)
+	if err != nil {
+		klog.V(1).Infof("template.Execute failed. Err: %v\n", err)
+		return err
+	}
+	email.Text = textBody.String()
+
+	if rt.html == nil {
+		return nil
+	}
+
+	var htmlBody bytes.Buffer
+	err = rt.html.Execute(&htmlBody, report)
+	if err != nil {
+		klog.V(1).Infof("htmlTemplate.Execute failed. Err: %v\n", err)
+		return err
+	}
+	email.Html = htmlBody.String()
+
+	return nil
+}
+
+// formatTime reformats the RFC 3339 timestamps from the platform, anything else is returned as is
+func formatTime(value, layout string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	return t.Format(layout)
+}
+
+// highlight escapes the text and wraps every span matched by a trigger pattern in <mark>
+func highlight(text string, triggers []Trigger) string {
+	var spans [][]int
+	for _, trigger := range triggers {
+		regex := trigger.regex()
+		if regex == nil {
+			continue
+		}
+		for _, span := range regex.FindAllStringIndex(text, -1) {
+			if span[0] < span[1] {
+				spans = append(spans, span)
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return html.EscapeString(text)
+	}
+
+	// merge overlapping spans
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i][0] < spans[j][0]
+	})
+	merged := [][]int{spans[0]}
+	for _, span := range spans[1:] {
+		last := merged[len(merged)-1]
+		if span[0] <= last[1] {
+			if span[1] > last[1] {
+				last[1] = span[1]
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+
+	var out strings.Builder
+	pos := 0
+	for _, span := range merged {
+		out.WriteString(html.EscapeString(text[pos:span[0]]))
+		out.WriteString("<mark>")
+		out.WriteString(html.EscapeString(text[span[0]:span[1]]))
+		out.WriteString("</mark>")
+		pos = span[1]
+	}
+	out.WriteString(html.EscapeString(text[pos:]))
+
+	return out.String()
+}
+
+// matched reports whether a trigger of the category fired on the value
+func matched(category, value string, triggers []Trigger) bool {
+	for _, trigger := range triggers {
+		if trigger.Category == category && trigger.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// byCategory the triggers for a single category
+func byCategory(triggers []Trigger, category string) []Trigger {
+	filtered := make([]Trigger, 0)
+	for _, trigger := range triggers {
+		if trigger.Category == category {
+			filtered = append(filtered, trigger)
+		}
+	}
+	return filtered
+}
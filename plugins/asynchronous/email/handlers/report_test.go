@@ -0,0 +1,98 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/async/v1/interfaces"
+)
+
+func TestHighlight(t *testing.T) {
+	triggers := []Trigger{
+		{Category: TriggerQuestion, Value: "pricing", Pattern: "(?i)pricing"},
+		{Category: TriggerTopic, Value: "price", Pattern: "(?i)price"},
+		{Category: TriggerTracker, Value: "discount", Pattern: "discount"},
+		{Category: TriggerEntity, Value: "R&D", Pattern: "R&D"},
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"no match is escaped", `<b>"hello" & bye</b>`, `&lt;b&gt;&#34;hello&#34; &amp; bye&lt;/b&gt;`},
+		{"match is marked", "What is the Pricing?", "What is the <mark>Pricing</mark>?"},
+		{"overlapping matches are merged", "pricing", "<mark>pricing</mark>"},
+		{"every match is marked", "a discount on the price", "a <mark>discount</mark> on the <mark>price</mark>"},
+		{"markup around a match is escaped", "<script>pricing</script>", "&lt;script&gt;<mark>pricing</mark>&lt;/script&gt;"},
+		{"markup inside a match is escaped", "the R&D budget", "the <mark>R&amp;D</mark> budget"},
+	}
+
+	for _, test := range tests {
+		if got := highlight(test.text, triggers); got != test.want {
+			t.Errorf("%s: highlight(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+
+	if got := highlight("pricing", []Trigger{{Pattern: "("}}); got != "pricing" {
+		t.Errorf("highlight with an invalid pattern = %q, want the escaped text", got)
+	}
+}
+
+func TestHighlightAfterJSON(t *testing.T) {
+	entry := DigestEntry{
+		ConversationID: "conversation-1",
+		Triggers:       []Trigger{{Category: TriggerQuestion, Value: "pricing", Pattern: "(?i)pricing"}},
+	}
+
+	byData, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("json.Marshal failed. Err: %v", err)
+	}
+	var stored DigestEntry
+	if err := json.Unmarshal(byData, &stored); err != nil {
+		t.Fatalf("json.Unmarshal failed. Err: %v", err)
+	}
+
+	if got := highlight("Pricing", stored.Triggers); got != "<mark>Pricing</mark>" {
+		t.Errorf("highlight after a JSON round trip = %q, want the match marked", got)
+	}
+}
+
+func TestRenderReport(t *testing.T) {
+	h := &Handler{config: Config{TimeFormat: DefaultTimeFormat}}
+	templates, err := h.parseTemplates("Report for {{.ConversationID}}", "../template.html", "../report.html", reportTemplates{})
+	if err != nil {
+		t.Fatalf("parseTemplates failed. Err: %v", err)
+	}
+
+	report := &Report{
+		ConversationID: "conversation-1",
+		Triggers:       []Trigger{{Category: TriggerQuestion, Value: "pricing", Pattern: "(?i)pricing"}},
+		Messages: []sdkinterfaces.Message{
+			{Text: `<img src=x onerror="alert(1)"> what is the pricing?`},
+		},
+	}
+
+	var email Email
+	if err := templates.render(&email, report); err != nil {
+		t.Fatalf("render failed. Err: %v", err)
+	}
+
+	if email.Subject != "Report for conversation-1" {
+		t.Errorf("subject = %q", email.Subject)
+	}
+	if !strings.Contains(email.Text, `<img src=x onerror="alert(1)"> what is the pricing?`) || strings.Contains(email.Text, "<mark>") {
+		t.Errorf("text body should hold the message as is:\n%s", email.Text)
+	}
+	if strings.Contains(email.Html, "<img") {
+		t.Errorf("html body contains unescaped message markup:\n%s", email.Html)
+	}
+	if !strings.Contains(email.Html, "&lt;img src=x onerror=&#34;alert(1)&#34;&gt; what is the <mark>pricing</mark>?") {
+		t.Errorf("html body does not hold the escaped and highlighted message:\n%s", email.Html)
+	}
+}
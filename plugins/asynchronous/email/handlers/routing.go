@@ -0,0 +1,248 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	gomail "gopkg.in/mail.v2"
+	klog "k8s.io/klog/v2"
+)
+
+// parseRoutes validates the routing rules and compiles their patterns and templates. Route
+// templates which are not set fall back to the top level templates.
+func (h *Handler) parseRoutes() error {
+	for i := range h.config.Routes {
+		route := &h.config.Routes[i]
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route%d", i+1)
+		}
+
+		if len(route.To)+len(route.Cc)+len(route.Bcc) == 0 {
+			klog.V(1).Infof("route %s has no recipients\n", route.Name)
+			return fmt.Errorf("%w: route %s has no recipients", ErrInvalidRoute, route.Name)
+		}
+
+		for j, category := range route.Categories {
+			normalized, ok := triggerCategory(category)
+			if !ok {
+				klog.V(1).Infof("route %s category %s is invalid\n", route.Name, category)
+				return fmt.Errorf("%w: route %s category %q", ErrInvalidRoute, route.Name, category)
+			}
+			route.Categories[j] = normalized
+		}
+
+		route.patterns = make([]*regexp.Regexp, 0, len(route.Patterns))
+		for _, pattern := range route.Patterns {
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				klog.V(1).Infof("regexp.Compile(%s) for route %s failed. Err: %v\n", pattern, route.Name, err)
+				return fmt.Errorf("%w: route %s pattern %q: %v", ErrInvalidPattern, route.Name, pattern, err)
+			}
+			route.patterns = append(route.patterns, regex)
+		}
+
+		var err error
+		route.templates, err = h.parseTemplates(route.Subject, route.Template, route.HtmlTemplate, h.templates)
+		if err != nil {
+			klog.V(1).Infof("parseTemplates for route %s failed. Err: %v\n", route.Name, err)
+			return err
+		}
+	}
+
+	// emailTo recipients receive whatever no route claims
+	h.defaultRoute = Route{
+		Name:      DefaultRoute,
+		To:        splitAddresses(h.config.EmailTo),
+		templates: h.templates,
+	}
+
+	// without emailTo every category needs a route which claims all of its triggers, otherwise
+	// the triggers no route matches would be dropped
+	if len(h.defaultRoute.To) == 0 {
+		for _, category := range triggerCategories {
+			if !h.routesClaimAll(category) {
+				klog.V(1).Infof("emailTo is empty and %s triggers are not always routed\n", category)
+				return fmt.Errorf("%w: emailTo is empty and not every %s trigger is routed", ErrInvalidRoute, category)
+			}
+		}
+	}
+
+	return nil
+}
+
+// routesClaimAll reports whether a route without patterns claims every trigger of the category
+func (h *Handler) routesClaimAll(category string) bool {
+	for _, route := range h.config.Routes {
+		if len(route.patterns) > 0 {
+			continue
+		}
+		if len(route.Categories) == 0 {
+			return true
+		}
+		for _, routeCategory := range route.Categories {
+			if routeCategory == category {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routeTriggers groups the triggers by the routes they match. Triggers not claimed by any
+// route go to the emailTo recipients so nothing is lost when routes are added.
+func (h *Handler) routeTriggers(triggers []Trigger) []routedTriggers {
+	routes := make([]routedTriggers, 0)
+	routed := make([]bool, len(triggers))
+
+	for i := range h.config.Routes {
+		route := &h.config.Routes[i]
+
+		matches := make([]Trigger, 0)
+		for j, trigger := range triggers {
+			if route.matches(trigger) {
+				matches = append(matches, trigger)
+				routed[j] = true
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+		klog.V(3).Infof("route %s matched %d triggers\n", route.Name, len(matches))
+
+		routes = append(routes, routedTriggers{
+			route:    route,
+			triggers: matches,
+		})
+	}
+
+	// anything left over goes to the default recipients
+	unrouted := make([]Trigger, 0)
+	for j, trigger := range triggers {
+		if !routed[j] {
+			unrouted = append(unrouted, trigger)
+		}
+	}
+	if len(unrouted) == 0 {
+		return routes
+	}
+	if len(h.defaultRoute.To) == 0 {
+		for _, trigger := range unrouted {
+			klog.V(1).Infof("trigger %s dropped, no route or emailTo recipient\n", trigger)
+		}
+		return routes
+	}
+
+	return append(routes, routedTriggers{
+		route:    &h.defaultRoute,
+		triggers: unrouted,
+	})
+}
+
+// routeEmails renders one email per route with matching triggers
+func (h *Handler) routeEmails(conversation *ConversationResult, triggers []Trigger, dump string) ([]*Email, error) {
+	emails := make([]*Email, 0)
+
+	for _, routed := range h.routeTriggers(triggers) {
+		route := routed.route
+
+		report := newReport(conversation, routed.triggers, dump)
+		report.Route = route.Name
+
+		email := &Email{
+			Route: route.Name,
+			To:    route.To,
+			Cc:    route.Cc,
+			Bcc:   route.Bcc,
+		}
+		err := route.templates.render(email, report)
+		if err != nil {
+			klog.V(1).Infof("render for route %s failed. Err: %v\n", route.Name, err)
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	return emails, nil
+}
+
+// matches reports whether the trigger is in one of the route categories and its value
+// matches one of the route patterns. Empty lists match everything.
+func (r *Route) matches(trigger Trigger) bool {
+	if len(r.Categories) > 0 {
+		found := false
+		for _, category := range r.Categories {
+			if category == trigger.Category {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.patterns) == 0 {
+		return true
+	}
+	for _, regex := range r.patterns {
+		if regex.MatchString(trigger.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// newMessage builds the multipart message for a rendered email
+func (h *Handler) newMessage(email *Email) *gomail.Message {
+	m := gomail.NewMessage()
+
+	// Set E-Mail sender
+	m.SetHeader("From", h.config.EmailFrom)
+
+	// Set E-Mail receivers
+	if len(email.To) > 0 {
+		m.SetHeader("To", email.To...)
+	}
+	if len(email.Cc) > 0 {
+		m.SetHeader("Cc", email.Cc...)
+	}
+	if len(email.Bcc) > 0 {
+		m.SetHeader("Bcc", email.Bcc...)
+	}
+
+	// Set E-Mail subject
+	m.SetHeader("Subject", email.Subject)
+
+	// Set E-Mail body. The html report is added last so clients prefer it over the plain text
+	m.SetBody("text/plain", email.Text)
+	if email.Html != "" {
+		m.AddAlternative("text/html", email.Html)
+	}
+
+	return m
+}
+
+// triggerCategory maps a category from the config onto the trigger category constant
+func triggerCategory(category string) (string, bool) {
+	for _, known := range triggerCategories {
+		if strings.EqualFold(strings.ReplaceAll(category, "_", ""), known) {
+			return known, true
+		}
+	}
+	return "", false
+}
+
+// splitAddresses splits a comma separated list of addresses
+func splitAddresses(addresses string) []string {
+	list := make([]string, 0)
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			list = append(list, address)
+		}
+	}
+	return list
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func newRoutingHandler(t *testing.T, emailTo string, routes []Route) *Handler {
+	h := &Handler{
+		config: Config{
+			EmailTo:    emailTo,
+			TimeFormat: DefaultTimeFormat,
+			Routes:     routes,
+		},
+	}
+
+	var err error
+	h.templates, err = h.parseTemplates("{{.Route}}: {{len .Triggers}} triggers", "../template.html", "", reportTemplates{})
+	if err != nil {
+		t.Fatalf("parseTemplates failed. Err: %v", err)
+	}
+	return h
+}
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		emailTo string
+		routes  []Route
+		wantErr error
+	}{
+		{"emailTo only", "sales@example.com", nil, nil},
+		{"route without recipients", "sales@example.com", []Route{{Categories: []string{"question"}}}, ErrInvalidRoute},
+		{"unknown category", "sales@example.com", []Route{{Categories: []string{"sentiment"}, To: []string{"a@example.com"}}}, ErrInvalidRoute},
+		{"invalid pattern", "sales@example.com", []Route{{Patterns: []string{"("}, To: []string{"a@example.com"}}}, ErrInvalidPattern},
+		{"no emailTo and no routes", "", nil, ErrInvalidRoute},
+		{"no emailTo and a catch all route", "", []Route{{To: []string{"a@example.com"}}}, nil},
+		{"no emailTo and only pattern routes", "", []Route{{Patterns: []string{"(?i)pricing"}, To: []string{"a@example.com"}}}, ErrInvalidRoute},
+		{"no emailTo and a category left out", "", []Route{
+			{Categories: []string{"question", "follow_up", "actionItem"}, To: []string{"a@example.com"}},
+			{Categories: []string{"topic", "tracker"}, To: []string{"b@example.com"}},
+		}, ErrInvalidRoute},
+		{"no emailTo and every category routed", "", []Route{
+			{Categories: []string{"question", "follow_up", "actionItem"}, To: []string{"a@example.com"}},
+			{Categories: []string{"topic", "tracker", "entity"}, To: []string{"b@example.com"}},
+		}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newRoutingHandler(t, test.emailTo, test.routes)
+			err := h.parseRoutes()
+			if test.wantErr == nil && err != nil {
+				t.Fatalf("parseRoutes = %v, want nil", err)
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Fatalf("parseRoutes = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRouteTriggers(t *testing.T) {
+	pricing := Trigger{Category: TriggerQuestion, Value: "What is the pricing?", Pattern: "pricing"}
+	contract := Trigger{Category: TriggerFollowUp, Value: "Send the contract", Pattern: "contract"}
+	acme := Trigger{Category: TriggerEntity, Value: "Acme", Pattern: "(?i)acme"}
+
+	h := newRoutingHandler(t, "sales@example.com, ops@example.com", []Route{
+		{Name: "legal", Categories: []string{"follow_up"}, To: []string{"legal@example.com"}},
+		{Name: "pricing", Patterns: []string{"(?i)pricing"}, To: []string{"finance@example.com"}, Cc: []string{"cfo@example.com"}},
+		{Name: "questions", Categories: []string{"question"}, To: []string{"support@example.com"}, Bcc: []string{"audit@example.com"}},
+	})
+	if err := h.parseRoutes(); err != nil {
+		t.Fatalf("parseRoutes failed. Err: %v", err)
+	}
+
+	got := make(map[string][]Trigger)
+	for _, routed := range h.routeTriggers([]Trigger{pricing, contract, acme}) {
+		got[routed.route.Name] = routed.triggers
+	}
+	want := map[string][]Trigger{
+		"legal":      {contract},
+		"pricing":    {pricing},
+		"questions":  {pricing},
+		DefaultRoute: {acme},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("routeTriggers = %v, want %v", got, want)
+	}
+
+	emails, err := h.routeEmails(&ConversationResult{ConversationID: "conversation-1"}, []Trigger{pricing, contract, acme}, "")
+	if err != nil {
+		t.Fatalf("routeEmails failed. Err: %v", err)
+	}
+	recipients := make(map[string][][]string)
+	for _, email := range emails {
+		recipients[email.Route] = [][]string{email.To, email.Cc, email.Bcc}
+		if email.Subject != email.Route+": 1 triggers" {
+			t.Errorf("subject = %q for route %s", email.Subject, email.Route)
+		}
+	}
+	wantRecipients := map[string][][]string{
+		"legal":      {{"legal@example.com"}, nil, nil},
+		"pricing":    {{"finance@example.com"}, {"cfo@example.com"}, nil},
+		"questions":  {{"support@example.com"}, nil, {"audit@example.com"}},
+		DefaultRoute: {{"sales@example.com", "ops@example.com"}, nil, nil},
+	}
+	if !reflect.DeepEqual(recipients, wantRecipients) {
+		t.Errorf("recipients = %v, want %v", recipients, wantRecipients)
+	}
+}
+
+func TestRouteTriggersWithoutDefault(t *testing.T) {
+	h := newRoutingHandler(t, "", []Route{
+		{Name: "everything", To: []string{"a@example.com"}},
+	})
+	if err := h.parseRoutes(); err != nil {
+		t.Fatalf("parseRoutes failed. Err: %v", err)
+	}
+
+	triggers := []Trigger{{Category: TriggerTopic, Value: "renewal"}}
+	routed := h.routeTriggers(triggers)
+	if len(routed) != 1 || routed[0].route.Name != "everything" || !reflect.DeepEqual(routed[0].triggers, triggers) {
+		t.Errorf("routeTriggers = %v, want every trigger on the catch all route", routed)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	klog "k8s.io/klog/v2"
+)
+
+// compileMatchers compiles the match list for each trigger category so a bad pattern is
+// reported when the config is loaded instead of being skipped on every result
+func (h *Handler) compileMatchers() error {
+	patterns := map[string][]string{
+		TriggerQuestion:   h.config.QuestionMatch,
+		TriggerFollowUp:   h.config.FollowUpMatch,
+		TriggerActionItem: h.config.ActionItemMatch,
+		TriggerTopic:      h.config.TopicMatch,
+		TriggerTracker:    h.config.TrackerMatch,
+		TriggerEntity:     h.config.EntityMatch,
+	}
+
+	matchers := make(map[string][]*regexp.Regexp)
+	for category, list := range patterns {
+		compiled := make([]*regexp.Regexp, 0, len(list))
+		for _, pattern := range list {
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				klog.V(1).Infof("regexp.Compile(%s) for %s failed. Err: %v\n", pattern, category, err)
+				return fmt.Errorf("%w: %s match %q: %v", ErrInvalidPattern, category, pattern, err)
+			}
+			compiled = append(compiled, regex)
+		}
+		matchers[category] = compiled
+	}
+
+	h.matchers = matchers
+	return nil
+}
+
+// matchTriggers checks the value against the match list for the category and records a
+// trigger with the description for every pattern that matches
+func (h *Handler) matchTriggers(conversationId, category, value, description string) {
+	for _, regex := range h.matchers[category] {
+		if !regex.MatchString(value) {
+			klog.V(6).Infof("%s != %s\n", regex, value)
+			continue
+		}
+		klog.V(2).Infof("Match %s = %s\n", regex, description)
+		h.triggers[conversationId] = append(h.triggers[conversationId], Trigger{
+			Category: category,
+			Value:    description,
+			Pattern:  regex.String(),
+		})
+	}
+}
+
+// compiledPatterns trigger patterns compiled for highlighting. Triggers only carry the pattern
+// so they survive being stored as JSON by the digest, and patterns only come from the config.
+var compiledPatterns sync.Map
+
+// regex the compiled pattern of the trigger, nil when the pattern does not compile
+func (t Trigger) regex() *regexp.Regexp {
+	if t.Pattern == "" {
+		return nil
+	}
+	if regex, ok := compiledPatterns.Load(t.Pattern); ok {
+		return regex.(*regexp.Regexp)
+	}
+
+	regex, err := regexp.Compile(t.Pattern)
+	if err != nil {
+		klog.V(1).Infof("regexp.Compile(%s) failed. Err: %v\n", t.Pattern, err)
+		return nil
+	}
+	compiledPatterns.Store(t.Pattern, regex)
+	return regex
+}
+
+// String keeps the "Category - Value" form used by plain text templates
+func (t Trigger) String() string {
+	return fmt.Sprintf("%s - %s", t.Category, t.Value)
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTriggerHandler(t *testing.T) *Handler {
+	h := &Handler{
+		config: Config{
+			QuestionMatch:   []string{"(?i)pricing", "(?i)discount"},
+			FollowUpMatch:   []string{"(?i)contract"},
+			ActionItemMatch: []string{"(?i)send"},
+			TopicMatch:      []string{"(?i)^renewal$"},
+			TrackerMatch:    []string{"(?i)competitor"},
+			EntityMatch:     []string{"(?i)acme"},
+		},
+		triggers: make(map[string][]Trigger),
+	}
+	if err := h.compileMatchers(); err != nil {
+		t.Fatalf("compileMatchers failed. Err: %v", err)
+	}
+	return h
+}
+
+func TestMatchTriggers(t *testing.T) {
+	tests := []struct {
+		name         string
+		category     string
+		value        string
+		description  string
+		wantPatterns []string
+	}{
+		{"question matches", TriggerQuestion, "What is the pricing?", "What is the pricing?", []string{"(?i)pricing"}},
+		{"question matches every pattern", TriggerQuestion, "Is there a discount on pricing?", "Is there a discount on pricing?", []string{"(?i)pricing", "(?i)discount"}},
+		{"question ignores other lists", TriggerQuestion, "Can you send the contract?", "Can you send the contract?", nil},
+		{"follow up matches", TriggerFollowUp, "Review the contract", "Review the contract", []string{"(?i)contract"}},
+		{"follow up ignores question list", TriggerFollowUp, "Share the pricing", "Share the pricing", nil},
+		{"action item matches", TriggerActionItem, "Send the quote", "Send the quote", []string{"(?i)send"}},
+		{"action item ignores follow up list", TriggerActionItem, "Sign the contract", "Sign the contract", nil},
+		{"topic matches", TriggerTopic, "Renewal", "Renewal", []string{"(?i)^renewal$"}},
+		{"topic is anchored", TriggerTopic, "renewal date", "renewal date", nil},
+		{"tracker matches on the name", TriggerTracker, "Competitor", "Competitor/globex", []string{"(?i)competitor"}},
+		{"tracker ignores entity list", TriggerTracker, "Acme", "Acme/acme", nil},
+		{"entity matches", TriggerEntity, "ACME Corp", "ACME Corp", []string{"(?i)acme"}},
+		{"entity ignores tracker list", TriggerEntity, "competitor", "competitor", nil},
+		{"unknown category", "Sentiment", "pricing", "pricing", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTriggerHandler(t)
+			h.matchTriggers("conversation-1", test.category, test.value, test.description)
+
+			got := h.triggers["conversation-1"]
+			if len(got) != len(test.wantPatterns) {
+				t.Fatalf("triggers = %v, want patterns %v", got, test.wantPatterns)
+			}
+			for i, trigger := range got {
+				if trigger.Category != test.category || trigger.Value != test.description || trigger.Pattern != test.wantPatterns[i] {
+					t.Errorf("trigger %d = %+v, want %s/%s/%s", i, trigger, test.category, test.description, test.wantPatterns[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCompileMatchersRejectsInvalidPatterns(t *testing.T) {
+	tests := []struct {
+		category string
+		config   Config
+	}{
+		{TriggerQuestion, Config{QuestionMatch: []string{"("}}},
+		{TriggerFollowUp, Config{FollowUpMatch: []string{"["}}},
+		{TriggerActionItem, Config{ActionItemMatch: []string{"*"}}},
+		{TriggerTopic, Config{TopicMatch: []string{"a{2,1}"}}},
+		{TriggerTracker, Config{TrackerMatch: []string{"(?P<x"}}},
+		{TriggerEntity, Config{EntityMatch: []string{`\`}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.category, func(t *testing.T) {
+			h := &Handler{config: test.config}
+			err := h.compileMatchers()
+			if !errors.Is(err, ErrInvalidPattern) {
+				t.Fatalf("compileMatchers = %v, want ErrInvalidPattern", err)
+			}
+			if !strings.Contains(err.Error(), test.category) {
+				t.Errorf("error %q does not name the category %s", err, test.category)
+			}
+		})
+	}
+}
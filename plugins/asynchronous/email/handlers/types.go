@@ -4,11 +4,16 @@
 package handlers
 
 import (
+	htmltemplate "html/template"
+	"regexp"
+	"sync"
 	"text/template"
+	"time"
 
 	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
 	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
 	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/async/v1/interfaces"
+	gomail "gopkg.in/mail.v2"
 )
 
 /*
@@ -25,25 +30,194 @@ type ConversationResult struct {
 	EntityResult     *sdkinterfaces.EntityResult     `json:"entityResult,omitempty"`
 }
 
+/*
+	Trigger hit recorded when a match pattern fires
+*/
+type Trigger struct {
+	Category string `json:"category,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Pattern  string `json:"pattern,omitempty"`
+}
+
+/*
+	Report rendered into the email templates
+*/
+type Report struct {
+	ConversationID string
+	Route          string
+	Triggers       []Trigger
+	Messages       []sdkinterfaces.Message
+	Questions      []sdkinterfaces.Question
+	FollowUps      []sdkinterfaces.FollowUp
+	ActionItems    []sdkinterfaces.ActionItem
+	Topics         []sdkinterfaces.Topic
+	Tracker        *sdkinterfaces.TrackerResult
+	Entities       []sdkinterfaces.Entity
+
+	// raw ConversationResult as JSON
+	Dump string
+}
+
+/*
+	Rendered email ready to be sent
+*/
+type Email struct {
+	Route   string   `json:"route,omitempty"`
+	To      []string `json:"to,omitempty"`
+	Cc      []string `json:"cc,omitempty"`
+	Bcc     []string `json:"bcc,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+	Text    string   `json:"text,omitempty"`
+	Html    string   `json:"html,omitempty"`
+}
+
+/*
+	Email waiting in the outbox
+*/
+type OutboxEntry struct {
+	ID             string    `json:"id,omitempty"`
+	ConversationID string    `json:"conversationId,omitempty"`
+	Email          *Email    `json:"email,omitempty"`
+	Attempts       int       `json:"attempts,omitempty"`
+	Created        time.Time `json:"created,omitempty"`
+	NextAttempt    time.Time `json:"nextAttempt,omitempty"`
+	LastError      string    `json:"lastError,omitempty"`
+}
+
+/*
+	Conversation waiting for the next digest. Recipients are removed once their digest has
+	been queued, so a failure part way through doesn't send anyone the same digest twice.
+*/
+type DigestEntry struct {
+	ID             string    `json:"id,omitempty"`
+	ConversationID string    `json:"conversationId,omitempty"`
+	Route          string    `json:"route,omitempty"`
+	To             []string  `json:"to,omitempty"`
+	Cc             []string  `json:"cc,omitempty"`
+	Bcc            []string  `json:"bcc,omitempty"`
+	Triggers       []Trigger `json:"triggers,omitempty"`
+	Created        time.Time `json:"created,omitempty"`
+}
+
+type digestRecipient struct {
+	address string
+	kind    string
+}
+
+/*
+	Digest rendered into the digest templates
+*/
+type TriggerGroup struct {
+	Category string
+	Triggers []Trigger
+}
+
+type DigestConversation struct {
+	ConversationID string
+	Routes         []string
+	Created        time.Time
+	Categories     []TriggerGroup
+}
+
+type Digest struct {
+	Recipient     string
+	Kind          string
+	Start         time.Time
+	End           time.Time
+	Categories    []TriggerGroup
+	Conversations []DigestConversation
+}
+
 /*
 	Config
 */
+type DigestConfig struct {
+	Enabled      bool   `json:"enabled,omitempty"`
+	Schedule     string `json:"schedule,omitempty"`
+	At           string `json:"at,omitempty"`
+	TimeZone     string `json:"timeZone,omitempty"`
+	Subject      string `json:"subject,omitempty"`
+	Template     string `json:"template,omitempty"`
+	HtmlTemplate string `json:"htmlTemplate,omitempty"`
+
+	// parsed values
+	hour      int
+	minute    int
+	location  *time.Location
+	templates reportTemplates
+}
+
+type OutboxConfig struct {
+	Directory      string `json:"directory,omitempty"`
+	MaxAttempts    int    `json:"maxAttempts,omitempty"`
+	InitialBackoff string `json:"initialBackoff,omitempty"`
+	MaxBackoff     string `json:"maxBackoff,omitempty"`
+	Interval       string `json:"interval,omitempty"`
+
+	// parsed values
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	interval       time.Duration
+}
+
+type Route struct {
+	Name         string   `json:"name,omitempty"`
+	Categories   []string `json:"categories,omitempty"`
+	Patterns     []string `json:"patterns,omitempty"`
+	To           []string `json:"to,omitempty"`
+	Cc           []string `json:"cc,omitempty"`
+	Bcc          []string `json:"bcc,omitempty"`
+	Subject      string   `json:"subject,omitempty"`
+	Template     string   `json:"template,omitempty"`
+	HtmlTemplate string   `json:"htmlTemplate,omitempty"`
+
+	// parsed values
+	patterns  []*regexp.Regexp
+	templates reportTemplates
+}
+
+type routedTriggers struct {
+	route    *Route
+	triggers []Trigger
+}
+
+type reportTemplates struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
 type Config struct {
-	Template          string   `json:"template,omitempty"`
-	SkipServerAuth    bool     `json:"skipServerAuth,omitempty"`
-	EmailTo           string   `json:"emailTo,omitempty"`
-	EmailFrom         string   `json:"emailFrom,omitempty"`
-	EmailSubject      string   `json:"emailSubject,omitempty"`
-	EmailSmtpAddr     string   `json:"emailSmtpAddr,omitempty"`
-	EmailSmtpPort     string   `json:"emailPort,omitempty"`
-	EmailSmtpUsername string   `json:"emailSmtpUsername,omitempty"`
-	EmailSmtpPassword string   `json:"emailSmtpPassword,omitempty"`
-	QuestionMatch     []string `json:"questionMatch,omitempty"`
-	FollowUpMatch     []string `json:"followUpMatch,omitempty"`
-	ActionItemMatch   []string `json:"actionItemMatch,omitempty"`
-	TopicMatch        []string `json:"topicMatch,omitempty"`
-	TrackerMatch      []string `json:"trackerMatch,omitempty"`
-	EntityMatch       []string `json:"entityMatch,omitempty"`
+	Template          string       `json:"template,omitempty"`
+	HtmlTemplate      string       `json:"htmlTemplate,omitempty"`
+	TimeFormat        string       `json:"timeFormat,omitempty"`
+	SkipServerAuth    bool         `json:"skipServerAuth,omitempty"`
+	EmailTo           string       `json:"emailTo,omitempty"`
+	EmailFrom         string       `json:"emailFrom,omitempty"`
+	EmailSubject      string       `json:"emailSubject,omitempty"`
+	EmailSmtpAddr     string       `json:"emailSmtpAddr,omitempty"`
+	EmailSmtpPort     string       `json:"emailPort,omitempty"`
+	EmailSmtpUsername string       `json:"emailSmtpUsername,omitempty"`
+	EmailSmtpPassword string       `json:"emailSmtpPassword,omitempty"`
+	QuestionMatch     []string     `json:"questionMatch,omitempty"`
+	FollowUpMatch     []string     `json:"followUpMatch,omitempty"`
+	ActionItemMatch   []string     `json:"actionItemMatch,omitempty"`
+	TopicMatch        []string     `json:"topicMatch,omitempty"`
+	TrackerMatch      []string     `json:"trackerMatch,omitempty"`
+	EntityMatch       []string     `json:"entityMatch,omitempty"`
+	Routes            []Route      `json:"routes,omitempty"`
+	Outbox            OutboxConfig `json:"outbox,omitempty"`
+	Digest            DigestConfig `json:"digest,omitempty"`
+
+	// parsed values
+	smtpPort int
+}
+
+/*
+	Delivers rendered emails, the SMTP dialer unless one is set for tests
+*/
+type emailSender interface {
+	DialAndSend(m ...*gomail.Message) error
 }
 
 /*
@@ -61,8 +235,17 @@ type Handler struct {
 	// properties
 	cache         map[string]*utils.MessageCache
 	conversations map[string]*ConversationResult
-	triggers      map[string][]string
-	template      *template.Template
+	triggers      map[string][]Trigger
+	matchers      map[string][]*regexp.Regexp
+	templates     reportTemplates
+	defaultRoute  Route
+
+	// outbox and digest workers
+	sender      emailSender
+	workersWg   sync.WaitGroup
+	wakeOutbox  chan struct{}
+	stopWorkers chan struct{}
+	stopOnce    sync.Once
 
 	// housekeeping
 	msgPublisher *interfacessdk.MessagePublisher
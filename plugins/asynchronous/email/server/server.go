@@ -93,6 +93,10 @@ func (s *Server) RebuildAsynchronousAnalyzer() error {
 		}
 		s.middlewareAnalyzer = nil
 	}
+	if s.messageHandler != nil {
+		s.messageHandler.Stop()
+		s.messageHandler = nil
+	}
 
 	// create handler
 	messageHandler := handlers.NewHandler(handlers.HandlerOptions{
@@ -106,6 +110,14 @@ func (s *Server) RebuildAsynchronousAnalyzer() error {
 		return err
 	}
 
+	// start delivering queued emails
+	err = messageHandler.Start()
+	if err != nil {
+		klog.V(1).Infof("messageHandler.Start failed. Err: %v\n", err)
+		klog.V(6).Infof("Server.RebuildAsynchronousAnalyzer LEAVE\n")
+		return err
+	}
+
 	// create middleware
 	var callback interfacessdk.AsynchronousCallback
 	callback = messageHandler
@@ -116,12 +128,14 @@ func (s *Server) RebuildAsynchronousAnalyzer() error {
 	})
 	if err != nil {
 		klog.V(1).Infof("NewAsynchronousAnalyzer failed. Err: %v\n", err)
+		messageHandler.Stop()
 		klog.V(6).Infof("Server.RebuildAsynchronousAnalyzer LEAVE\n")
 		return err
 	}
 
 	// housekeeping
 	s.middlewareAnalyzer = middlewareAnalyzer
+	s.messageHandler = messageHandler
 
 	klog.V(4).Infof("Server.RebuildAsynchronousAnalyzer Succeeded\n")
 	klog.V(6).Infof("Server.RebuildAsynchronousAnalyzer LEAVE\n")
@@ -143,6 +157,12 @@ func (s *Server) Stop() error {
 	}
 	s.middlewareAnalyzer = nil
 
+	// stop the outbox worker, anything not sent yet is picked up on the next start
+	if s.messageHandler != nil {
+		s.messageHandler.Stop()
+	}
+	s.messageHandler = nil
+
 	klog.V(4).Infof("Server.Stop Succeeded\n")
 	klog.V(6).Infof("Server.Stop LEAVE\n")
 
@@ -5,6 +5,8 @@ package server
 
 import (
 	middlewaresdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk"
+
+	handlers "github.com/dvonthenen/enterprise-conversation-plugins/plugins/asynchronous/email/handlers"
 )
 
 // ServerOptions for the main HTTP endpoint
@@ -23,4 +25,5 @@ type Server struct {
 
 	// middleware
 	middlewareAnalyzer *middlewaresdk.AsynchronousAnalyzer
+	messageHandler     *handlers.Handler
 }
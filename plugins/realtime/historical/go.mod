@@ -4,6 +4,7 @@ go 1.18
 
 require (
 	github.com/dvonthenen/enterprise-conversation-application v0.1.10
+	github.com/dvonthenen/enterprise-conversation-plugins/pkg v0.0.0
 	github.com/dvonthenen/symbl-go-sdk v0.1.8
 	github.com/neo4j/neo4j-go-driver/v5 v5.3.0
 	k8s.io/klog/v2 v2.90.0
@@ -25,3 +26,5 @@ require (
 	golang.org/x/sys v0.6.0 // indirect
 	gopkg.in/go-playground/validator.v9 v9.31.0 // indirect
 )
+
+replace github.com/dvonthenen/enterprise-conversation-plugins/pkg => ../../../pkg
@@ -5,7 +5,41 @@ package handlers
 
 import "errors"
 
+const (
+	// DefaultMaxResults number of previous mentions returned per correlation
+	DefaultMaxResults int = 5
+
+	// policyOverfetchFactor rows fetched per result when results need to be filtered
+	policyOverfetchFactor int = 10
+
+	// topicCandidateFactor candidate topics fetched per result, most candidates fall below the
+	// similarity threshold once they are scored
+	topicCandidateFactor int = 10
+
+	// minTopicRootLength shortest root used to find candidate topics
+	minTopicRootLength int = 3
+
+	// DefaultMaxExperts number of speakers suggested per correlation
+	DefaultMaxExperts int = 3
+
+	// topic similarity algorithms
+	MatchingAlgorithmExact   string = "exact"
+	MatchingAlgorithmJaccard string = "jaccard"
+	MatchingAlgorithmTrigram string = "trigram"
+
+	// DefaultSimilarityThreshold minimum similarity for two topics to correlate
+	DefaultSimilarityThreshold float64 = 0.5
+
+	// historical scopes
+	ScopeGlobal      string = "global"
+	ScopeParticipant string = "participant"
+	ScopeAccount     string = "account"
+)
+
 var (
+	// ErrInvalidPolicy the historical policy file contains an invalid value
+	ErrInvalidPolicy = errors.New("the historical policy file contains an invalid value")
+
 	// ErrUnhandledMessage runhandled message from symbl-proxy-dataminer
 	ErrUnhandledMessage = errors.New("unhandled message from symbl-proxy-dataminer")
 )
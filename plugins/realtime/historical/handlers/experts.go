@@ -0,0 +1,143 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"sort"
+
+	klog "k8s.io/klog/v2"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/interfaces"
+)
+
+const (
+	// expertsAggregation groups the matched mentions by speaker. The preceding part of the query
+	// must bind lookup, the mention relationship x, the message or insight m and the speaker u.
+	expertsAggregation string = `
+		WITH lookup, u, x, m ORDER BY x.created DESC
+		WITH lookup, u, count(DISTINCT m) AS mentions, max(x.created) AS lastMentioned, collect({
+			id: coalesce(m.messageId, m.insightId), content: m.content
+		})[0] AS sample
+		ORDER BY mentions DESC, lastMentioned DESC
+		WITH lookup, collect({
+			userId: u.userId, name: u.name, email: u.email,
+			mentions: mentions, lastMentioned: lastMentioned,
+			id: sample.id, content: sample.content
+		})[..$expert_limit] AS experts
+		RETURN lookup.key, experts`
+
+	// topicExpertsQuery lookup.values are the stored topics which matched the topic using the
+	// configured similarity, see topicExpertLookups
+	topicExpertsQuery string = `
+		UNWIND $lookups AS lookup
+		MATCH (t:Topic)-[x:TOPIC_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
+		WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND t.value IN lookup.values
+			AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+			#scope_filter#` + expertsAggregation
+
+	trackerExpertsQuery string = `
+		UNWIND $lookups AS lookup
+		MATCH (t:Tracker)-[x:TRACKER_MESSAGE_REF|TRACKER_INSIGHT_REF]-(m)-[y:SPOKE]-(u:User)
+		WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND t.name = lookup.key
+			AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+			#scope_filter#` + expertsAggregation
+
+	entityExpertsQuery string = `
+		UNWIND $lookups AS lookup
+		MATCH (e:Entity)-[x:ENTITY_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
+		WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND e.category = lookup.category AND e.type = lookup.type AND e.subType = lookup.subType AND e.value = lookup.value
+			AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+			#scope_filter#` + expertsAggregation
+)
+
+// lookupExperts runs one of the experts queries for all lookups and returns the top speakers
+// grouped by the lookup key
+func (h *Handler) lookupExperts(ctx context.Context, cp *CategoryPolicy, query, conversationId string, lookups []map[string]any) (map[string][]interfaces.Expert, error) {
+	experts := make(map[string][]interfaces.Expert)
+
+	err := h.runLookup(ctx, cp, query, map[string]any{
+		"conversation_id": conversationId,
+		"lookups":         lookups,
+		"max_age":         cp.maxAgeSeconds(),
+		"expert_limit":    h.policy.Experts.MaxResults,
+	}, func(key string, props map[string]any) {
+		experts[key] = append(experts[key], interfaces.Expert{
+			Author: interfaces.Author{
+				ID:    recordString(props["userId"]),
+				Name:  recordString(props["name"]),
+				Email: recordString(props["email"]),
+			},
+			Mentions:      recordInt(props["mentions"]),
+			LastMentioned: formatCreated(recordTime(props["lastMentioned"])),
+			Sample: interfaces.Message{
+				ID:   recordString(props["id"]),
+				Text: recordString(props["content"]),
+			},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return experts, nil
+}
+
+// topicExpertLookups the experts for a topic are the speakers of the stored topics which matched
+// it, matches maps the lookup key to the matching stored topic values
+func topicExpertLookups(lookups []map[string]any, matches map[string]map[string]bool) []map[string]any {
+	expertLookups := make([]map[string]any, 0, len(lookups))
+	for _, lookup := range lookups {
+		key := recordString(lookup["key"])
+		if len(matches[key]) == 0 {
+			continue
+		}
+
+		values := make([]string, 0, len(matches[key]))
+		for value := range matches[key] {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+
+		expertLookups = append(expertLookups, map[string]any{
+			"key":    key,
+			"values": values,
+		})
+	}
+	return expertLookups
+}
+
+// processExperts publishes who has discussed each correlation the most in prior conversations
+func (h *Handler) processExperts(ctx context.Context, conversationId, category string, cp *CategoryPolicy, query string, lookups []map[string]any) error {
+	if h.policy.Experts.Disabled || len(lookups) == 0 {
+		return nil
+	}
+
+	experts, err := h.lookupExperts(ctx, cp, query, conversationId, lookups)
+	if err != nil {
+		klog.V(1).Infof("[%s] lookupExperts failed. Err: %v\n", category, err)
+		return err
+	}
+
+	msgs := make([]*interfaces.AppSpecificHistorical, 0)
+	for _, lookup := range lookups {
+		correlation := recordString(lookup["key"])
+		if len(experts[correlation]) == 0 {
+			continue
+		}
+
+		for _, expert := range experts[correlation] {
+			klog.V(2).Infof("Expert for %s: %s / %s (%d mentions)\n", correlation, expert.Author.Name, expert.Author.Email, expert.Mentions)
+		}
+
+		msg := newHistoricalMessage(interfaces.UserHistoricalTypeExperts, category, correlation)
+		msg.Historical.Experts = experts[correlation]
+
+		msgs = append(msgs, msg)
+	}
+
+	h.publishHistorical(ctx, conversationId, category, msgs)
+
+	return nil
+}
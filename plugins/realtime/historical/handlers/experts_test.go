@@ -0,0 +1,84 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	shared "github.com/dvonthenen/enterprise-conversation-application/pkg/shared"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/interfaces"
+)
+
+func TestTopicExpertLookups(t *testing.T) {
+	lookups := []map[string]any{
+		{"key": "renewal policies", "roots": []string{"renewal", "polic"}},
+		{"key": "quarterly forecast", "roots": []string{"quarterly", "forecast"}},
+	}
+
+	// the stored topics which passed the similarity threshold for each lookup
+	matches := make(map[string]map[string]bool)
+	policy := MatchingPolicy{Algorithm: MatchingAlgorithmJaccard}
+	for _, candidate := range []string{"Renewal Policy", "renewal policies", "pricing policy", "renewal"} {
+		if policy.matches(policy.similarity("renewal policies", candidate)) {
+			if matches["renewal policies"] == nil {
+				matches["renewal policies"] = make(map[string]bool)
+			}
+			matches["renewal policies"][candidate] = true
+		}
+	}
+
+	got := topicExpertLookups(lookups, matches)
+	want := []map[string]any{
+		{"key": "renewal policies", "values": []string{"Renewal Policy", "renewal", "renewal policies"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("topicExpertLookups = %v, want %v", got, want)
+	}
+}
+
+func TestHistoricalMessagesCarryCategory(t *testing.T) {
+	_, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		if !strings.Contains(cypher, "TRACKER_MESSAGE_REF") {
+			return nil
+		}
+		return lookupRows(params, func(lookup map[string]any) []any {
+			return []any{map[string]any{
+				"id": "message-1", "content": "what about pricing", "value": "pricing",
+				"userId": "user-1", "name": "Jane", "email": "jane@example.com", "mentions": int64(1),
+				"conversationId": "conversation-2", "created": time.Now(), "lastMentioned": time.Now(),
+			}}
+		})
+	})
+	h := newLookupHandler(driver)
+	publisher := h.setFakePublisher()
+
+	err := h.processTrackerResponse(&shared.TrackerResponse{
+		ConversationID: "conversation-1",
+		TrackerResponse: &sdkinterfaces.TrackerResponse{
+			Trackers: []sdkinterfaces.Tracker{{Name: "Pricing"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("processTrackerResponse failed. Err: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, msg := range publisher.messages {
+		got[msg.Historical.Type] = msg.Historical.Category
+	}
+	want := map[string]string{
+		interfaces.UserHistoricalTypeTracker: "tracker",
+		interfaces.UserHistoricalTypeExperts: "tracker",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("categories = %v, want %v", got, want)
+	}
+}
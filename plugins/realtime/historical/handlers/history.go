@@ -0,0 +1,354 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	klog "k8s.io/klog/v2"
+
+	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/interfaces"
+)
+
+// lookupHistory runs a batched query which UNWINDs $lookups and returns one row per lookup
+// key with the collected hits (newest first). The result is grouped by the lookup key.
+func (h *Handler) lookupHistory(ctx context.Context, cp *CategoryPolicy, query string, params map[string]any) (map[string][]historicalHit, error) {
+	hits := make(map[string][]historicalHit)
+
+	err := h.runLookup(ctx, cp, query, params, func(key string, props map[string]any) {
+		hits[key] = append(hits[key], newHistoricalHit(props))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hits, nil
+}
+
+// runLookup runs a batched query returning rows of [key, list of maps] and calls rowFn for
+// each map in the list
+func (h *Handler) runLookup(ctx context.Context, cp *CategoryPolicy, query string, params map[string]any, rowFn func(key string, props map[string]any)) error {
+	session := h.newSession(ctx, neo4j.AccessModeRead)
+	defer session.Close(ctx)
+
+	// copy so the caller's params are left as they were
+	queryParams := make(map[string]any, len(params)+1)
+	for key, value := range params {
+		queryParams[key] = value
+	}
+
+	_, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		err := h.scopeParams(ctx, tx, cp.Scope, recordString(params["conversation_id"]), queryParams)
+		if err != nil {
+			return nil, err
+		}
+
+		myQuery := utils.ReplaceIndexes(replaceScope(query, cp.Scope))
+		result, err := tx.Run(ctx, myQuery, queryParams)
+		if err != nil {
+			return nil, err
+		}
+
+		for result.Next(ctx) {
+			key := recordString(result.Record().Values[0])
+			rows, ok := result.Record().Values[1].([]any)
+			if !ok {
+				continue
+			}
+
+			for _, row := range rows {
+				props, ok := row.(map[string]any)
+				if !ok {
+					continue
+				}
+				rowFn(key, props)
+			}
+		}
+
+		return nil, result.Err()
+	})
+
+	return err
+}
+
+// newSession sessions are not goroutine safe, so each unit of work opens its own session from
+// the driver which pools the underlying connections
+func (h *Handler) newSession(ctx context.Context, accessMode neo4j.AccessMode) neo4j.SessionWithContext {
+	return (*h.driver).NewSession(ctx, neo4j.SessionConfig{
+		AccessMode:   accessMode,
+		DatabaseName: "neo4j",
+	})
+}
+
+func newHistoricalHit(props map[string]any) historicalHit {
+	return historicalHit{
+		candidate:      recordString(props["candidate"]),
+		value:          recordString(props["value"]),
+		conversationId: recordString(props["conversationId"]),
+		created:        recordTime(props["created"]),
+		message: interfaces.Message{
+			ID:   recordString(props["id"]),
+			Text: recordString(props["content"]),
+			Author: interfaces.Author{
+				ID:    recordString(props["userId"]),
+				Name:  recordString(props["name"]),
+				Email: recordString(props["email"]),
+			},
+		},
+	}
+}
+
+// mergeHits combines message and insight hits into a single list, newest first, tagging each
+// hit with where it came from
+func mergeHits(messageHits, insightHits []historicalHit) []historicalHit {
+	merged := make([]historicalHit, 0, len(messageHits)+len(insightHits))
+	for _, hit := range messageHits {
+		hit.source = interfaces.SourceMessage
+		merged = append(merged, hit)
+	}
+	for _, hit := range insightHits {
+		hit.source = interfaces.SourceInsight
+		merged = append(merged, hit)
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].created.After(merged[j].created)
+	})
+
+	return merged
+}
+
+func newHistoricalMessage(historicalType, category, correlation string) *interfaces.AppSpecificHistorical {
+	return &interfaces.AppSpecificHistorical{
+		Type: sdkinterfaces.MessageTypeUserDefined,
+		Metadata: interfaces.Metadata{
+			Type: interfaces.AppSpecificMessageTypeHistorical,
+		},
+		Historical: interfaces.Data{
+			Type:        historicalType,
+			Category:    category,
+			Correlation: correlation,
+			Current:     make([]interfaces.Insight, 0),
+			Previous:    make([]interfaces.Insight, 0),
+		},
+	}
+}
+
+// publishHistorical sends the High-level Application messages back to the Dataminer component
+func (h *Handler) publishHistorical(ctx context.Context, conversationId, category string, msgs []*interfaces.AppSpecificHistorical) {
+	pending := make([]*interfaces.AppSpecificHistorical, 0)
+	for _, msg := range msgs {
+		if !h.shouldPublish(conversationId, msg) {
+			klog.V(4).Infof("[%s] Suppressing repeat of %s/%s\n", category, msg.Historical.Type, msg.Historical.Correlation)
+			continue
+		}
+		pending = append(pending, msg)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	if h.policy.ContextMessages > 0 {
+		err := h.addContext(ctx, pending)
+		if err != nil {
+			klog.V(1).Infof("[%s] addContext failed. Err: %v\n", category, err)
+		}
+	}
+
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+
+	for _, msg := range pending {
+		data, err := json.Marshal(*msg)
+		if err != nil {
+			klog.V(1).Infof("[%s] json.Marshal failed. Err: %v\n", category, err)
+			continue
+		}
+
+		err = (*h.msgPublisher).PublishMessage(conversationId, data)
+		if err != nil {
+			klog.V(1).Infof("[%s] PublishMessage failed. Err: %v\n", category, err)
+		}
+	}
+}
+
+// addContext fills in the messages surrounding each previous mention within its own conversation
+// using a single batched query for all messages
+func (h *Handler) addContext(ctx context.Context, msgs []*interfaces.AppSpecificHistorical) error {
+	mentions := make([]map[string]any, 0)
+	for _, msg := range msgs {
+		for _, previous := range msg.Historical.Previous {
+			for _, message := range previous.Messages {
+				mentions = append(mentions, map[string]any{
+					"key":            contextKey(previous.ConversationID, message.ID),
+					"id":             message.ID,
+					"conversationId": previous.ConversationID,
+					"created":        previous.Created,
+				})
+			}
+		}
+	}
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	before := make(map[string][]interfaces.Message)
+	after := make(map[string][]interfaces.Message)
+
+	session := h.newSession(ctx, neo4j.AccessModeRead)
+	defer session.Close(ctx)
+
+	_, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		myQuery := utils.ReplaceIndexes(`
+			UNWIND $mentions AS mention
+			OPTIONAL MATCH (pm:Message)-[py:SPOKE]-(:User)
+			WHERE pm.messageId = mention.id AND py.#conversation_index# = mention.conversationId
+			WITH mention, coalesce(py.created, CASE WHEN mention.created = '' THEN null ELSE datetime(mention.created) END) AS anchor
+			MATCH (m:Message)-[y:SPOKE]-(u:User)
+			WHERE y.#conversation_index# = mention.conversationId AND m.messageId <> mention.id
+			WITH mention, anchor, m, y, u ORDER BY y.created
+			WITH mention, anchor, collect({
+				id: m.messageId, content: m.content, userId: u.userId, name: u.name, email: u.email, created: y.created
+			}) AS messages
+			RETURN mention.key,
+				[msg IN messages WHERE msg.created < anchor][-$context_size..],
+				[msg IN messages WHERE msg.created > anchor][..$context_size]`)
+		result, err := tx.Run(ctx, myQuery, map[string]any{
+			"mentions":     mentions,
+			"context_size": h.policy.ContextMessages,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for result.Next(ctx) {
+			key := recordString(result.Record().Values[0])
+			before[key] = recordMessages(result.Record().Values[1])
+			after[key] = recordMessages(result.Record().Values[2])
+		}
+
+		return nil, result.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		for i := range msg.Historical.Previous {
+			previous := &msg.Historical.Previous[i]
+			for _, message := range previous.Messages {
+				key := contextKey(previous.ConversationID, message.ID)
+				previous.Before = append(previous.Before, before[key]...)
+				previous.After = append(previous.After, after[key]...)
+			}
+		}
+	}
+
+	return nil
+}
+
+func contextKey(conversationId, messageId string) string {
+	return fmt.Sprintf("%s/%s", conversationId, messageId)
+}
+
+// recordMessages converts a list of collected message maps into messages
+func recordMessages(value any) []interfaces.Message {
+	rows, ok := value.([]any)
+	if !ok {
+		return nil
+	}
+
+	messages := make([]interfaces.Message, 0, len(rows))
+	for _, row := range rows {
+		props, ok := row.(map[string]any)
+		if !ok {
+			continue
+		}
+		messages = append(messages, interfaces.Message{
+			ID:   recordString(props["id"]),
+			Text: recordString(props["content"]),
+			Author: interfaces.Author{
+				ID:    recordString(props["userId"]),
+				Name:  recordString(props["name"]),
+				Email: recordString(props["email"]),
+			},
+		})
+	}
+
+	return messages
+}
+
+// formatCreated timestamps are reported in RFC3339 and omitted when unknown
+func formatCreated(created time.Time) string {
+	if created.IsZero() {
+		return ""
+	}
+	return created.Format(time.RFC3339)
+}
+
+// shouldPublish a correlation is only published again for the same conversation when there are
+// previous results which have not been sent yet or the cooldown has elapsed
+func (h *Handler) shouldPublish(conversationId string, msg *interfaces.AppSpecificHistorical) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	published := h.published[conversationId]
+	if published == nil {
+		published = make(map[string]*publishedState)
+		h.published[conversationId] = published
+	}
+
+	key := fmt.Sprintf("%s/%s", msg.Historical.Type, msg.Historical.Correlation)
+	state := published[key]
+	if state == nil {
+		state = &publishedState{
+			previousIds: make(map[string]bool),
+		}
+		published[key] = state
+	}
+
+	now := time.Now()
+	ids := publishedIds(msg)
+	newResults := false
+	for _, id := range ids {
+		if !state.previousIds[id] {
+			newResults = true
+		}
+	}
+	cooldownElapsed := h.policy.cooldown > 0 && now.Sub(state.lastPublished) >= h.policy.cooldown
+
+	if !newResults && !cooldownElapsed {
+		return false
+	}
+
+	for _, id := range ids {
+		state.previousIds[id] = true
+	}
+	state.lastPublished = now
+
+	return true
+}
+
+// publishedIds identifies the results within a message, a message is new when it contains an
+// ID which has not been published before
+func publishedIds(msg *interfaces.AppSpecificHistorical) []string {
+	ids := make([]string, 0)
+	for _, previous := range msg.Historical.Previous {
+		for _, message := range previous.Messages {
+			ids = append(ids, message.ID)
+		}
+	}
+	for _, expert := range msg.Historical.Experts {
+		ids = append(ids, fmt.Sprintf("expert/%s", expert.Author.ID))
+	}
+	return ids
+}
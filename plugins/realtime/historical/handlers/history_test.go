@@ -0,0 +1,197 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	shared "github.com/dvonthenen/enterprise-conversation-application/pkg/shared"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/interfaces"
+)
+
+// benchmarkLatency simulated round trip to Neo4j
+const benchmarkLatency = 200 * time.Microsecond
+
+func newLookupHandler(driver *neo4j.DriverWithContext) *Handler {
+	return &Handler{
+		driver:    driver,
+		policy:    DefaultPolicy(),
+		published: make(map[string]map[string]*publishedState),
+		accounts:  make(map[string]string),
+	}
+}
+
+func TestRunLookupKeepsParams(t *testing.T) {
+	fake, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		return lookupRows(params, func(lookup map[string]any) []any {
+			return []any{map[string]any{"id": "message-1", "conversationId": "conversation-2"}}
+		})
+	})
+	h := newLookupHandler(driver)
+	h.policy.Topic.Scope = ScopeAccount
+	h.accounts["conversation-1"] = "acme-corp"
+
+	params := map[string]any{
+		"conversation_id": "conversation-1",
+		"lookups":         []map[string]any{{"key": "renewal"}},
+	}
+	hits, err := h.lookupHistory(context.Background(), &h.policy.Topic, "UNWIND $lookups AS lookup RETURN lookup.key, []", params)
+	if err != nil {
+		t.Fatalf("lookupHistory failed. Err: %v", err)
+	}
+
+	if len(hits["renewal"]) != 1 || hits["renewal"][0].message.ID != "message-1" {
+		t.Errorf("lookupHistory returned %v", hits)
+	}
+	if _, ok := params["account_id"]; ok {
+		t.Errorf("lookupHistory added account_id to the caller's params")
+	}
+
+	queries := fake.queriesMatching("UNWIND $lookups")
+	if len(queries) != 1 || queries[0].params["account_id"] != "acme-corp" {
+		t.Errorf("query params = %v, want account_id acme-corp", queries)
+	}
+}
+
+func TestTopicLookupLimitsCandidates(t *testing.T) {
+	fake, driver := newFakeDriver(0, nil)
+	h := newLookupHandler(driver)
+
+	err := h.processTopicResponse(&shared.TopicResponse{
+		ConversationID: "conversation-1",
+		TopicResponse: &sdkinterfaces.TopicResponse{
+			Topics: []sdkinterfaces.Topic{{Phrases: "AI roadmap"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("processTopicResponse failed. Err: %v", err)
+	}
+
+	queries := fake.queriesMatching("TOPIC_MESSAGE_REF")
+	if len(queries) != 1 {
+		t.Fatalf("queries = %d, want 1", len(queries))
+	}
+	if got, want := queries[0].params["fetch_limit"], DefaultMaxResults*topicCandidateFactor; got != want {
+		t.Errorf("fetch_limit = %v, want %d", got, want)
+	}
+	lookups, _ := queries[0].params["lookups"].([]map[string]any)
+	if len(lookups) != 1 || !reflect.DeepEqual(lookups[0]["roots"], []string{"roadmap"}) {
+		t.Errorf("lookups = %v, want the roots without short tokens", lookups)
+	}
+}
+
+func TestMergeHits(t *testing.T) {
+	now := time.Now()
+	hit := func(id string, age time.Duration) historicalHit {
+		return historicalHit{
+			created: now.Add(-age),
+			message: interfaces.Message{ID: id},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		messages []historicalHit
+		insights []historicalHit
+		want     []string
+	}{
+		{
+			name:     "message only",
+			messages: []historicalHit{hit("m1", time.Minute), hit("m2", time.Hour)},
+			want:     []string{"message/m1", "message/m2"},
+		},
+		{
+			name:     "insight only",
+			insights: []historicalHit{hit("i1", time.Hour), hit("i2", time.Minute)},
+			want:     []string{"insight/i2", "insight/i1"},
+		},
+		{
+			name:     "mixed newest first",
+			messages: []historicalHit{hit("m1", time.Minute), hit("m2", 3*time.Hour)},
+			insights: []historicalHit{hit("i1", 2*time.Hour), hit("i2", time.Second)},
+			want:     []string{"insight/i2", "message/m1", "insight/i1", "message/m2"},
+		},
+		{
+			name:     "same time keeps messages first",
+			messages: []historicalHit{hit("m1", time.Minute)},
+			insights: []historicalHit{hit("i1", time.Minute)},
+			want:     []string{"message/m1", "insight/i1"},
+		},
+		{
+			name: "empty",
+			want: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		merged := mergeHits(test.messages, test.insights)
+
+		got := make([]string, 0, len(merged))
+		for _, hit := range merged {
+			got = append(got, hit.source+"/"+hit.message.ID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: mergeHits = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+/*
+	Compares resolving every item of a response with its own query, as the plugin did before the
+	lookups were batched, with a single UNWIND query for the whole response.
+*/
+func BenchmarkLookupHistory(b *testing.B) {
+	for _, items := range []int{1, 5, 20} {
+		lookups := make([]map[string]any, 0, items)
+		for i := 0; i < items; i++ {
+			lookups = append(lookups, map[string]any{"key": fmt.Sprintf("topic %d", i)})
+		}
+
+		responder := func(cypher string, params map[string]any) []*neo4j.Record {
+			return lookupRows(params, func(lookup map[string]any) []any {
+				return []any{map[string]any{"id": "message-1", "conversationId": "conversation-2"}}
+			})
+		}
+
+		b.Run(fmt.Sprintf("per_item/%d", items), func(b *testing.B) {
+			fake, driver := newFakeDriver(benchmarkLatency, responder)
+			h := newLookupHandler(driver)
+
+			for n := 0; n < b.N; n++ {
+				for _, lookup := range lookups {
+					_, err := h.lookupHistory(context.Background(), &h.policy.Topic, "UNWIND $lookups AS lookup RETURN lookup.key, []", map[string]any{
+						"lookups": []map[string]any{lookup},
+					})
+					if err != nil {
+						b.Fatalf("lookupHistory failed. Err: %v", err)
+					}
+				}
+			}
+			b.ReportMetric(float64(len(fake.queriesMatching("")))/float64(b.N), "queries/op")
+		})
+
+		b.Run(fmt.Sprintf("batched/%d", items), func(b *testing.B) {
+			fake, driver := newFakeDriver(benchmarkLatency, responder)
+			h := newLookupHandler(driver)
+
+			for n := 0; n < b.N; n++ {
+				_, err := h.lookupHistory(context.Background(), &h.policy.Topic, "UNWIND $lookups AS lookup RETURN lookup.key, []", map[string]any{
+					"lookups": lookups,
+				})
+				if err != nil {
+					b.Fatalf("lookupHistory failed. Err: %v", err)
+				}
+			}
+			b.ReportMetric(float64(len(fake.queriesMatching("")))/float64(b.N), "queries/op")
+		})
+	}
+}
@@ -5,30 +5,60 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"strings"
 
 	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
-	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
 	klog "k8s.io/klog/v2"
 
 	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
 	shared "github.com/dvonthenen/enterprise-conversation-application/pkg/shared"
 	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
 
+	insight "github.com/dvonthenen/enterprise-conversation-plugins/pkg/insight"
+	workerpool "github.com/dvonthenen/enterprise-conversation-plugins/pkg/workerpool"
 	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/interfaces"
 )
 
 func NewHandler(options HandlerOptions) *Handler {
 	handler := Handler{
-		session:     options.Session,
+		driver:      options.Driver,
 		symblClient: options.SymblClient,
+		policy:      options.Policy,
+		pool:        workerpool.New(options.Workers, options.QueueDepth),
 		cache:       make(map[string]*utils.MessageCache),
+		published:   make(map[string]map[string]*publishedState),
+		accounts:    make(map[string]string),
+	}
+	if handler.policy == nil {
+		handler.policy = DefaultPolicy()
+	}
+	if handler.driver != nil {
+		handler.pendingInsights = insight.NewPending(handler.newSession)
+
+		var ctx context.Context
+		ctx, handler.cancel = context.WithCancel(context.Background())
+		handler.background.Add(2)
+		go func() {
+			defer handler.background.Done()
+			handler.pendingInsights.Prepare(ctx)
+		}()
+		go handler.prepareAccounts(ctx)
+	} else {
+		handler.pendingInsights = insight.NewPending(nil)
 	}
 	return &handler
 }
 
+// Stop waits for all queued callbacks to be processed
+func (h *Handler) Stop() {
+	h.pool.Stop()
+
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.background.Wait()
+}
+
 func (h *Handler) SetClientPublisher(mp *interfacessdk.MessagePublisher) {
 	klog.V(4).Infof("SetClientPublisher called...\n")
 	h.msgPublisher = mp
@@ -36,9 +66,16 @@ func (h *Handler) SetClientPublisher(mp *interfacessdk.MessagePublisher) {
 
 func (h *Handler) InitializedConversation(im *shared.InitializationResponse) error {
 	conversationId := im.InitializationMessage.Message.Data.ConversationID
-	klog.V(2).Infof("InitializedConversation - conversationID: %s\n", conversationId)
-	h.cache[conversationId] = utils.NewMessageCache()
-	return nil
+	return h.dispatch(conversationId, "InitializedConversation", func() error {
+		klog.V(2).Infof("InitializedConversation - conversationID: %s\n", conversationId)
+
+		h.mu.Lock()
+		h.cache[conversationId] = utils.NewMessageCache()
+		h.published[conversationId] = make(map[string]*publishedState)
+		h.mu.Unlock()
+
+		return h.tagConversation(context.Background(), conversationId)
+	})
 }
 
 func (h *Handler) RecognitionResultMessage(rr *shared.RecognitionResponse) error {
@@ -47,459 +84,521 @@ func (h *Handler) RecognitionResultMessage(rr *shared.RecognitionResponse) error
 }
 
 func (h *Handler) MessageResponseMessage(mr *shared.MessageResponse) error {
-	cache := h.cache[mr.ConversationID]
-	if cache != nil {
-		for _, msg := range mr.MessageResponse.Messages {
-			cache.Push(msg.ID, msg.Payload.Content, msg.From.ID, msg.From.Name, msg.From.UserID)
+	return h.dispatch(mr.ConversationID, "MessageResponseMessage", func() error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		cache := h.cache[mr.ConversationID]
+		if cache != nil {
+			for _, msg := range mr.MessageResponse.Messages {
+				cache.Push(msg.ID, msg.Payload.Content, msg.From.ID, msg.From.Name, msg.From.UserID)
+			}
+		} else {
+			klog.V(1).Infof("MessageCache for ConversationID(%s) not found.", mr.ConversationID)
 		}
-	} else {
-		klog.V(1).Infof("MessageCache for ConversationID(%s) not found.", mr.ConversationID)
-	}
 
-	return nil
+		return nil
+	})
 }
 
 func (h *Handler) InsightResponseMessage(ir *shared.InsightResponse) error {
+	return h.dispatch(ir.ConversationID, "InsightResponseMessage", func() error {
+		return h.processInsightResponse(ir)
+	})
+}
+
+func (h *Handler) TopicResponseMessage(tr *shared.TopicResponse) error {
+	return h.dispatch(tr.ConversationID, "TopicResponseMessage", func() error {
+		return h.processTopicResponse(tr)
+	})
+}
+
+func (h *Handler) TrackerResponseMessage(tr *shared.TrackerResponse) error {
+	return h.dispatch(tr.ConversationID, "TrackerResponseMessage", func() error {
+		return h.processTrackerResponse(tr)
+	})
+}
+
+func (h *Handler) EntityResponseMessage(er *shared.EntityResponse) error {
+	return h.dispatch(er.ConversationID, "EntityResponseMessage", func() error {
+		return h.processEntityResponse(er)
+	})
+}
+
+func (h *Handler) TeardownConversation(tm *shared.TeardownResponse) error {
+	conversationId := tm.TeardownMessage.Message.Data.ConversationID
+	return h.dispatch(conversationId, "TeardownConversation", func() error {
+		klog.V(2).Infof("TeardownConversation - conversationID: %s\n", conversationId)
+
+		err := h.pendingInsights.Flush(context.Background(), conversationId)
+		if err != nil {
+			klog.V(1).Infof("pendingInsights.Flush failed. Err: %v\n", err)
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.cache, conversationId)
+		delete(h.published, conversationId)
+		delete(h.accounts, conversationId)
+		return err
+	})
+}
+
+func (h *Handler) UserDefinedMessage(data []byte) error {
 	// No implementation required. Return Succeess!
 	return nil
 }
 
-func (h *Handler) TopicResponseMessage(tr *shared.TopicResponse) error {
+func (h *Handler) UnhandledMessage(byMsg []byte) error {
+	klog.Errorf("\n\n-------------------------------\n")
+	klog.Errorf("UnhandledMessage:\n%v\n", string(byMsg))
+	klog.Errorf("-------------------------------\n\n")
+	return ErrUnhandledMessage
+}
+
+// dispatch queues the callback on the worker which owns the conversation. The SDK delivers the
+// callbacks from a single goroutine, so the work is not waited on and its errors are logged by
+// the worker. Only an error queuing the work is returned.
+func (h *Handler) dispatch(conversationId, callback string, work func() error) error {
+	err := h.pool.Submit(conversationId, func() {
+		err := work()
+		if err != nil {
+			klog.V(1).Infof("%s failed. Err: %v\n", callback, err)
+		}
+	})
+	if err != nil {
+		klog.V(1).Infof("%s submit failed. Err: %v\n", callback, err)
+	}
+	return err
+}
+
+func (h *Handler) processInsightResponse(ir *shared.InsightResponse) error {
 	ctx := context.Background()
 
-	for _, curTopic := range tr.TopicResponse.Topics {
-		// housekeeping
-		atLeastOnce := false
-		var msg *interfaces.AppSpecificHistorical
-
-		// get past instances
-		_, err := (*h.session).ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-			myQuery := utils.ReplaceIndexes(`
-				MATCH (t:Topic)-[x:TOPIC_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
-				WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND t.value = $topic_phrases
-				RETURN t, x, m, y, u ORDER BY x.created DESC LIMIT 5`)
-			result, err := tx.Run(ctx, myQuery, map[string]any{
-				"conversation_id": tr.ConversationID,
-				"topic_phrases":   strings.ToLower(curTopic.Phrases),
-			})
-			if err != nil {
-				return nil, err
-			}
+	for _, curInsight := range ir.InsightResponse.Insights {
+		h.pendingInsights.Add(ir.ConversationID, curInsight.ID, curInsight.Payload.Content)
+	}
 
-			for result.Next(ctx) {
-				// only init once!
-				if !atLeastOnce {
-					klog.V(2).Infof("Check Previous Topics\n")
-					klog.V(2).Infof("----------------------------------------\n")
-
-					msg = &interfaces.AppSpecificHistorical{
-						Type: sdkinterfaces.MessageTypeUserDefined,
-						Metadata: interfaces.Metadata{
-							Type: interfaces.AppSpecificMessageTypeHistorical,
-						},
-						Historical: interfaces.Data{
-							Type:        interfaces.UserHistoricalTypeTopic,
-							Correlation: strings.ToLower(curTopic.Phrases),
-							Current:     make([]interfaces.Insight, 0),
-							Previous:    make([]interfaces.Insight, 0),
-						},
-					}
-
-					msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
-						Correlation: strings.ToLower(curTopic.Phrases),
-						Messages:    h.convertMessageReferenceToSlice(tr.ConversationID, curTopic.MessageReferences),
-					})
-
-					atLeastOnce = true
-				}
+	// build lookups
+	lookups := make([]map[string]any, 0)
+	for _, curInsight := range ir.InsightResponse.Insights {
+		insightText := insight.Normalize(curInsight.Payload.Content)
+		if insightText == "" {
+			klog.V(4).Infof("[Insights] Skipping empty insight ID: %s\n", curInsight.ID)
+			continue
+		}
 
-				// prevTopic := result.Record().Values[0].(neo4j.Node)
-				message := result.Record().Values[2].(neo4j.Node)
-				relationship := result.Record().Values[1].(neo4j.Relationship)
-				user := result.Record().Values[4].(neo4j.Node)
-
-				klog.V(2).Infof("Previous Topic\n")
-				klog.V(2).Infof("Author: %s / %s\n", user.Props["name"].(string), user.Props["email"].(string))
-				klog.V(2).Infof("Topic Match: %s\n", relationship.Props["value"].(string))
-				klog.V(2).Infof("Corresponding sentence: %s\n", message.Props["content"].(string))
-
-				msg.Historical.Previous = append(msg.Historical.Previous, interfaces.Insight{
-					Correlation: strings.ToLower(relationship.Props["value"].(string)),
-					Messages: []interfaces.Message{
-						interfaces.Message{
-							ID:   message.Props["messageId"].(string),
-							Text: message.Props["content"].(string),
-							Author: interfaces.Author{
-								ID:    user.Props["userId"].(string),
-								Name:  user.Props["name"].(string),
-								Email: user.Props["email"].(string),
-							},
-						},
-					},
-				})
-			}
+		lookups = append(lookups, map[string]any{
+			"key":  insight.Correlation(curInsight.Type, insightText),
+			"type": strings.ToLower(curInsight.Type),
+			"text": insightText,
+		})
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
+
+	// get past instances
+	hits, err := h.lookupHistory(ctx, &h.policy.Insight, `
+		UNWIND $lookups AS lookup
+		MATCH (i:Insight)-[x:SPOKE]-(u:User)
+		WHERE x.#conversation_index# <> $conversation_id AND i.normalizedContent = lookup.text AND i.type = lookup.type
+			AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+			#scope_filter#
+		WITH lookup, i, x, u ORDER BY x.created DESC
+		WITH lookup, collect({
+			candidate: i.content, value: i.type, id: i.insightId, content: i.content,
+			userId: u.userId, name: u.name, email: u.email,
+			conversationId: x.#conversation_index#, created: x.created
+		})[..$fetch_limit] AS hits
+		RETURN lookup.key, hits`,
+		map[string]any{
+			"conversation_id": ir.ConversationID,
+			"lookups":         lookups,
+			"max_age":         h.policy.Insight.maxAgeSeconds(),
+			"fetch_limit":     h.policy.Insight.fetchLimit(),
+		})
+	if err != nil {
+		klog.V(1).Infof("[Insights] ExecuteRead failed. Err: %v\n", err)
+		return err
+	}
 
-			if atLeastOnce {
-				klog.V(2).Infof("----------------------------------------\n")
+	msgs := make([]*interfaces.AppSpecificHistorical, 0)
+	for _, curInsight := range ir.InsightResponse.Insights {
+		insightText := insight.Normalize(curInsight.Payload.Content)
+		correlation := insight.Correlation(curInsight.Type, insightText)
+
+		filter := h.policy.Insight.newFilter()
+		previous := make([]interfaces.Insight, 0)
+		for _, hit := range hits[correlation] {
+			if !filter.accept(hit.conversationId, hit.created) {
+				continue
 			}
 
-			return nil, result.Err()
-		})
-		if err != nil {
-			klog.V(1).Infof("[Topics] ExecuteRead failed. Err: %v\n", err)
-			return err
+			klog.V(2).Infof("Previous Insight\n")
+			klog.V(2).Infof("Author: %s / %s\n", hit.message.Author.Name, hit.message.Author.Email)
+			klog.V(2).Infof("Insight Match: %s\n", hit.value)
+			klog.V(2).Infof("Corresponding sentence: %s\n", hit.message.Text)
+
+			previous = append(previous, interfaces.Insight{
+				Correlation:    insight.Normalize(hit.candidate),
+				ConversationID: hit.conversationId,
+				Created:        formatCreated(hit.created),
+				Messages:       []interfaces.Message{hit.message},
+			})
 		}
 
 		/*
-			If there is at least one Message or Insight that has triggered this Tracker, then
+			If there is at least one previous Insight with the same type and text, then
 			send your High-level Application message back to the Dataminer component
 		*/
-		if atLeastOnce {
-			data, err := json.Marshal(*msg)
-			if err != nil {
-				klog.V(1).Infof("[Topics] json.Marshal failed. Err: %v\n", err)
-			}
-
-			err = (*h.msgPublisher).PublishMessage(tr.ConversationID, data)
-			if err != nil {
-				klog.V(1).Infof("[Topics] PublishMessage failed. Err: %v\n", err)
-			}
+		if len(previous) == 0 {
+			continue
 		}
+
+		msg := newHistoricalMessage(interfaces.UserHistoricalTypeInsight, "insight", correlation)
+		msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
+			Correlation: insightText,
+			Messages: []interfaces.Message{
+				interfaces.Message{
+					ID:   curInsight.ID,
+					Text: curInsight.Payload.Content,
+					Author: interfaces.Author{
+						ID:    curInsight.From.ID,
+						Name:  curInsight.From.Name,
+						Email: curInsight.From.UserID,
+					},
+				},
+			},
+		})
+		msg.Historical.Previous = previous
+
+		msgs = append(msgs, msg)
 	}
 
+	h.publishHistorical(ctx, ir.ConversationID, "Insights", msgs)
+
 	return nil
 }
 
-func (h *Handler) TrackerResponseMessage(tr *shared.TrackerResponse) error {
+func (h *Handler) processTopicResponse(tr *shared.TopicResponse) error {
 	ctx := context.Background()
 
-	for _, curTracker := range tr.TrackerResponse.Trackers {
-		// housekeeping
-		addCurrentMessageAlready := false
-		atLeastOnceMessage := false
-		atLeastOnceInsight := false
-		var msg *interfaces.AppSpecificHistorical
-
-		// get past messages
-		_, err := (*h.session).ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-			myQuery := utils.ReplaceIndexes(`
-				MATCH (t:Tracker)-[x:TRACKER_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
-				WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND t.name = $tracker_name
-				RETURN t, x, m, y, u ORDER BY x.created DESC LIMIT 5`)
-			result, err := tx.Run(ctx, myQuery, map[string]any{
-				"conversation_id": tr.ConversationID,
-				"tracker_name":    strings.ToLower(curTracker.Name),
-			})
-			if err != nil {
-				return nil, err
-			}
+	// build lookups
+	lookups := make([]map[string]any, 0)
+	for _, curTopic := range tr.TopicResponse.Topics {
+		lookups = append(lookups, map[string]any{
+			"key":   strings.ToLower(curTopic.Phrases),
+			"roots": topicRoots(curTopic.Phrases),
+		})
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
 
-			for result.Next(ctx) {
-				// only init once!
-				if !atLeastOnceMessage {
-					klog.V(2).Infof("Check Previous Tracker [Message]\n")
-					klog.V(2).Infof("----------------------------------------\n")
-
-					msg = &interfaces.AppSpecificHistorical{
-						Type: sdkinterfaces.MessageTypeUserDefined,
-						Metadata: interfaces.Metadata{
-							Type: interfaces.AppSpecificMessageTypeHistorical,
-						},
-						Historical: interfaces.Data{
-							Type:        interfaces.UserHistoricalTypeTracker,
-							Correlation: strings.ToLower(curTracker.Name),
-							Current:     make([]interfaces.Insight, 0),
-							Previous:    make([]interfaces.Insight, 0),
-						},
-					}
-					atLeastOnceMessage = true
-				}
+	/*
+		Get past instances. The most recent candidates sharing at least one root with the topic
+		are fetched and scored here, the max results are applied once the similarity is known.
+	*/
+	hits, err := h.lookupHistory(ctx, &h.policy.Topic, `
+		UNWIND $lookups AS lookup
+		CALL {
+			WITH lookup
+			MATCH (t:Topic)-[x:TOPIC_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
+			WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id
+				AND (toLower(t.value) = lookup.key OR ANY(root IN lookup.roots WHERE toLower(t.value) CONTAINS root))
+				AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+				#scope_filter#
+			RETURN t, x, m, u ORDER BY x.created DESC LIMIT $fetch_limit
+		}
+		WITH lookup, collect({
+			candidate: t.value, value: x.value, id: m.messageId, content: m.content,
+			userId: u.userId, name: u.name, email: u.email,
+			conversationId: x.#conversation_index#, created: x.created
+		}) AS hits
+		RETURN lookup.key, hits`,
+		map[string]any{
+			"conversation_id": tr.ConversationID,
+			"lookups":         lookups,
+			"max_age":         h.policy.Topic.maxAgeSeconds(),
+			"fetch_limit":     h.policy.Topic.fetchLimit() * topicCandidateFactor,
+		})
+	if err != nil {
+		klog.V(1).Infof("[Topics] ExecuteRead failed. Err: %v\n", err)
+		return err
+	}
 
-				message := result.Record().Values[2].(neo4j.Node)
-				relationship := result.Record().Values[1].(neo4j.Relationship)
-				user := result.Record().Values[4].(neo4j.Node)
-
-				klog.V(2).Infof("Previous Tracker [Message]\n")
-				klog.V(2).Infof("Author: %s / %s\n", user.Props["name"].(string), user.Props["email"].(string))
-				klog.V(2).Infof("Tracker Match: %s\n", relationship.Props["value"].(string))
-				klog.V(2).Infof("Corresponding sentence: %s\n", message.Props["content"].(string))
-
-				for _, match := range curTracker.Matches {
-					if !addCurrentMessageAlready {
-						msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
-							Correlation: strings.ToLower(match.Value),
-							Messages:    h.convertMessageRefsToSlice(tr.ConversationID, match.MessageRefs),
-						})
-						addCurrentMessageAlready = true
-					}
-
-					msg.Historical.Previous = append(msg.Historical.Previous, interfaces.Insight{
-						Correlation: strings.ToLower(relationship.Props["value"].(string)),
-						Messages: []interfaces.Message{
-							interfaces.Message{
-								ID:   message.Props["messageId"].(string),
-								Text: message.Props["content"].(string),
-								Author: interfaces.Author{
-									ID:    user.Props["userId"].(string),
-									Name:  user.Props["name"].(string),
-									Email: user.Props["email"].(string),
-								},
-							},
-						},
-					})
-				}
+	msgs := make([]*interfaces.AppSpecificHistorical, 0)
+	matches := make(map[string]map[string]bool)
+	for _, curTopic := range tr.TopicResponse.Topics {
+		correlation := strings.ToLower(curTopic.Phrases)
+
+		filter := h.policy.Topic.newFilter()
+		previous := make([]interfaces.Insight, 0)
+		for _, hit := range hits[correlation] {
+			similarity := h.policy.TopicMatching.similarity(curTopic.Phrases, hit.candidate)
+			if !h.policy.TopicMatching.matches(similarity) {
+				klog.V(6).Infof("Topic %s ~ %s below threshold (%f)\n", curTopic.Phrases, hit.candidate, similarity)
+				continue
 			}
-
-			if atLeastOnceMessage {
-				klog.V(2).Infof("----------------------------------------\n")
+			if matches[correlation] == nil {
+				matches[correlation] = make(map[string]bool)
+			}
+			matches[correlation][hit.candidate] = true
+			if !filter.accept(hit.conversationId, hit.created) {
+				continue
 			}
 
-			return nil, result.Err()
-		})
-		if err != nil {
-			klog.V(1).Infof("[Tracker] ExecuteRead failed. Err: %v\n", err)
-			return err
+			klog.V(2).Infof("Previous Topic\n")
+			klog.V(2).Infof("Author: %s / %s\n", hit.message.Author.Name, hit.message.Author.Email)
+			klog.V(2).Infof("Topic Match: %s (%f)\n", hit.value, similarity)
+			klog.V(2).Infof("Corresponding sentence: %s\n", hit.message.Text)
+
+			previous = append(previous, interfaces.Insight{
+				Correlation:    strings.ToLower(hit.value),
+				Similarity:     similarity,
+				ConversationID: hit.conversationId,
+				Created:        formatCreated(hit.created),
+				Messages:       []interfaces.Message{hit.message},
+			})
 		}
 
-		// get past insights
-		_, err = (*h.session).ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-			myQuery := utils.ReplaceIndexes(`
-				MATCH (t:Tracker)-[x:TRACKER_INSIGHT_REF]-(i:Insight)-[y:SPOKE]-(u:User)
-				WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND t.name = $tracker_name
-				RETURN t, x, i, y, u ORDER BY x.created DESC LIMIT 5`)
-			result, err := tx.Run(ctx, myQuery, map[string]any{
-				"conversation_id": tr.ConversationID,
-				"tracker_name":    strings.ToLower(curTracker.Name),
-			})
-			if err != nil {
-				return nil, err
-			}
+		/*
+			If there is at least one previous Message that has triggered this Topic, then
+			send your High-level Application message back to the Dataminer component
+		*/
+		if len(previous) == 0 {
+			continue
+		}
 
-			// insight
-			for result.Next(ctx) {
-				// only init once!
-				if !atLeastOnceInsight {
-					klog.V(2).Infof("Check Previous Tracker [Insight]\n")
-					klog.V(2).Infof("----------------------------------------\n")
-
-					msg = &interfaces.AppSpecificHistorical{
-						Type: sdkinterfaces.MessageTypeUserDefined,
-						Metadata: interfaces.Metadata{
-							Type: interfaces.AppSpecificMessageTypeHistorical,
-						},
-						Historical: interfaces.Data{
-							Type:        interfaces.UserHistoricalTypeTracker,
-							Correlation: strings.ToLower(curTracker.Name),
-							Current:     make([]interfaces.Insight, 0),
-							Previous:    make([]interfaces.Insight, 0),
-						},
-					}
-					atLeastOnceInsight = true
-				}
+		msg := newHistoricalMessage(interfaces.UserHistoricalTypeTopic, "topic", correlation)
+		msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
+			Correlation: correlation,
+			Messages:    h.convertMessageReferenceToSlice(tr.ConversationID, curTopic.MessageReferences),
+		})
+		msg.Historical.Previous = previous
 
-				insight := result.Record().Values[2].(neo4j.Node)
-				relationship := result.Record().Values[1].(neo4j.Relationship)
-				user := result.Record().Values[4].(neo4j.Node)
-
-				klog.V(2).Infof("Previous Tracker [Insight]\n")
-				klog.V(2).Infof("Author: %s / %s\n", user.Props["name"].(string), user.Props["email"].(string))
-				klog.V(2).Infof("Tracker Match: %s\n", relationship.Props["value"].(string))
-				klog.V(2).Infof("Corresponding sentence: %s\n", insight.Props["content"].(string))
-
-				for _, match := range curTracker.Matches {
-					if !addCurrentMessageAlready {
-						msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
-							Correlation: strings.ToLower(match.Value),
-							Messages:    h.convertInsightRefsToSlice(tr.ConversationID, match.InsightRefs),
-						})
-						addCurrentMessageAlready = true
-					}
-
-					msg.Historical.Previous = append(msg.Historical.Previous, interfaces.Insight{
-						Correlation: strings.ToLower(relationship.Props["value"].(string)),
-						Messages: []interfaces.Message{
-							interfaces.Message{
-								ID:   insight.Props["insightId"].(string),
-								Text: insight.Props["content"].(string),
-								Author: interfaces.Author{
-									ID:    user.Props["userId"].(string),
-									Name:  user.Props["name"].(string),
-									Email: user.Props["email"].(string),
-								},
-							},
-						},
-					})
-				}
-			}
+		msgs = append(msgs, msg)
+	}
 
-			if atLeastOnceInsight {
-				klog.V(2).Infof("----------------------------------------\n")
-			}
+	h.publishHistorical(ctx, tr.ConversationID, "Topics", msgs)
+
+	return h.processExperts(ctx, tr.ConversationID, "topic", &h.policy.Topic, topicExpertsQuery, topicExpertLookups(lookups, matches))
+}
+
+func (h *Handler) processTrackerResponse(tr *shared.TrackerResponse) error {
+	ctx := context.Background()
 
-			return nil, result.Err()
+	// build lookups
+	lookups := make([]map[string]any, 0)
+	for _, curTracker := range tr.TrackerResponse.Trackers {
+		lookups = append(lookups, map[string]any{
+			"key": strings.ToLower(curTracker.Name),
 		})
-		if err != nil {
-			klog.V(1).Infof("[Tracker] ExecuteRead failed. Err: %v\n", err)
-			return err
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
+
+	params := map[string]any{
+		"conversation_id": tr.ConversationID,
+		"lookups":         lookups,
+		"max_age":         h.policy.Tracker.maxAgeSeconds(),
+		"fetch_limit":     h.policy.Tracker.fetchLimit(),
+	}
+
+	// get past messages and insights, both are merged into a single list ordered by time
+	messageHits, err := h.lookupHistory(ctx, &h.policy.Tracker, `
+		UNWIND $lookups AS lookup
+		MATCH (t:Tracker)-[x:TRACKER_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
+		WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND t.name = lookup.key
+			AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+			#scope_filter#
+		WITH lookup, t, x, m, u ORDER BY x.created DESC
+		WITH lookup, collect({
+			candidate: t.name, value: x.value, id: m.messageId, content: m.content,
+			userId: u.userId, name: u.name, email: u.email,
+			conversationId: x.#conversation_index#, created: x.created
+		})[..$fetch_limit] AS hits
+		RETURN lookup.key, hits`, params)
+	if err != nil {
+		klog.V(1).Infof("[Tracker] ExecuteRead failed. Err: %v\n", err)
+		return err
+	}
+
+	// get past insights
+	insightHits, err := h.lookupHistory(ctx, &h.policy.Tracker, `
+		UNWIND $lookups AS lookup
+		MATCH (t:Tracker)-[x:TRACKER_INSIGHT_REF]-(i:Insight)-[y:SPOKE]-(u:User)
+		WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND t.name = lookup.key
+			AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+			#scope_filter#
+		WITH lookup, t, x, i, u ORDER BY x.created DESC
+		WITH lookup, collect({
+			candidate: t.name, value: x.value, id: i.insightId, content: i.content,
+			userId: u.userId, name: u.name, email: u.email,
+			conversationId: x.#conversation_index#, created: x.created
+		})[..$fetch_limit] AS hits
+		RETURN lookup.key, hits`, params)
+	if err != nil {
+		klog.V(1).Infof("[Tracker] ExecuteRead failed. Err: %v\n", err)
+		return err
+	}
+
+	msgs := make([]*interfaces.AppSpecificHistorical, 0)
+	for _, curTracker := range tr.TrackerResponse.Trackers {
+		correlation := strings.ToLower(curTracker.Name)
+
+		filter := h.policy.Tracker.newFilter()
+		previous := make([]interfaces.Insight, 0)
+		for _, hit := range mergeHits(messageHits[correlation], insightHits[correlation]) {
+			if !filter.accept(hit.conversationId, hit.created) {
+				continue
+			}
+
+			klog.V(2).Infof("Previous Tracker [%s]\n", hit.source)
+			klog.V(2).Infof("Author: %s / %s\n", hit.message.Author.Name, hit.message.Author.Email)
+			klog.V(2).Infof("Tracker Match: %s\n", hit.value)
+			klog.V(2).Infof("Corresponding sentence: %s\n", hit.message.Text)
+
+			previous = append(previous, interfaces.Insight{
+				Correlation:    strings.ToLower(hit.value),
+				Source:         hit.source,
+				ConversationID: hit.conversationId,
+				Created:        formatCreated(hit.created),
+				Messages:       []interfaces.Message{hit.message},
+			})
 		}
 
 		/*
 			If there is at least one Message or Insight that has triggered this Tracker, then
 			send your High-level Application message back to the Dataminer component
 		*/
-		if atLeastOnceMessage || atLeastOnceInsight {
-			data, err := json.Marshal(*msg)
-			if err != nil {
-				klog.V(1).Infof("[Tracker] json.Marshal failed. Err: %v\n", err)
-			}
+		if len(previous) == 0 {
+			continue
+		}
 
-			err = (*h.msgPublisher).PublishMessage(tr.ConversationID, data)
-			if err != nil {
-				klog.V(1).Infof("[Tracker] PublishMessage failed. Err: %v\n", err)
-			}
+		msg := newHistoricalMessage(interfaces.UserHistoricalTypeTracker, "tracker", correlation)
+		for _, match := range curTracker.Matches {
+			messages := h.convertMessageRefsToSlice(tr.ConversationID, match.MessageRefs)
+			messages = append(messages, h.convertInsightRefsToSlice(tr.ConversationID, match.InsightRefs)...)
+
+			msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
+				Correlation: strings.ToLower(match.Value),
+				Messages:    messages,
+			})
 		}
+		msg.Historical.Previous = previous
+
+		msgs = append(msgs, msg)
 	}
 
-	return nil
+	h.publishHistorical(ctx, tr.ConversationID, "Tracker", msgs)
+
+	return h.processExperts(ctx, tr.ConversationID, "tracker", &h.policy.Tracker, trackerExpertsQuery, lookups)
 }
 
-func (h *Handler) EntityResponseMessage(er *shared.EntityResponse) error {
+func (h *Handler) processEntityResponse(er *shared.EntityResponse) error {
 	ctx := context.Background()
 
+	// build lookups
+	lookups := make([]map[string]any, 0)
 	for _, entity := range er.EntityResponse.Entities {
 		for _, match := range entity.Matches {
-			// housekeeping
-			atLeastOnce := false
-			addCurrentMessageAlready := false
-			var msg *interfaces.AppSpecificHistorical
-
-			// get past instances
-			_, err := (*h.session).ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-				myQuery := utils.ReplaceIndexes(`
-				MATCH (e:Entity)-[x:ENTITY_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
-					WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND e.category = $entity_category AND e.type = $entity_type AND e.subType = $entity_subtype AND e.value = $entity_value
-				RETURN e, x, m, y, u ORDER BY x.created DESC LIMIT 5`)
-				result, err := tx.Run(ctx, myQuery, map[string]any{
-					"conversation_id": er.ConversationID,
-					"entity_category": strings.ToLower(entity.Category),
-					"entity_type":     strings.ToLower(entity.Type),
-					"entity_subtype":  strings.ToLower(entity.SubType),
-					"entity_value":    strings.ToLower(match.DetectedValue),
-				})
-				if err != nil {
-					return nil, err
-				}
+			lookups = append(lookups, map[string]any{
+				"key":      insight.EntityCorrelation(entity.Category, entity.Type, entity.SubType, match.DetectedValue),
+				"category": strings.ToLower(entity.Category),
+				"type":     strings.ToLower(entity.Type),
+				"subType":  strings.ToLower(entity.SubType),
+				"value":    strings.ToLower(match.DetectedValue),
+			})
+		}
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
 
-				for result.Next(ctx) {
-					// only init once!
-					if !atLeastOnce {
-						klog.V(2).Infof("Check Previous Entities\n")
-						klog.V(2).Infof("----------------------------------------\n")
-
-						msg = &interfaces.AppSpecificHistorical{
-							Type: sdkinterfaces.MessageTypeUserDefined,
-							Metadata: interfaces.Metadata{
-								Type: interfaces.AppSpecificMessageTypeHistorical,
-							},
-							Historical: interfaces.Data{
-								Type:        interfaces.UserHistoricalTypeEntity,
-								Correlation: fmt.Sprintf("%s/%s/%s/%s", strings.ToLower(entity.Category), strings.ToLower(entity.Type), strings.ToLower(entity.SubType), strings.ToLower(match.DetectedValue)),
-								Current:     make([]interfaces.Insight, 0),
-								Previous:    make([]interfaces.Insight, 0),
-							},
-						}
-						atLeastOnce = true
-					}
-
-					message := result.Record().Values[2].(neo4j.Node)
-					relationship := result.Record().Values[1].(neo4j.Relationship)
-					user := result.Record().Values[4].(neo4j.Node)
-
-					klog.V(2).Infof("Previous Entity\n")
-					klog.V(2).Infof("Author: %s / %s\n", user.Props["name"].(string), user.Props["email"].(string))
-					klog.V(2).Infof("Entity Match: %s\n", relationship.Props["value"].(string))
-					klog.V(2).Infof("Corresponding sentence: %s\n", message.Props["content"].(string))
-
-					for _, match := range entity.Matches {
-						if !addCurrentMessageAlready {
-							msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
-								Correlation: strings.ToLower(match.DetectedValue),
-								Messages:    h.convertMessageRefsToSlice(er.ConversationID, match.MessageRefs),
-							})
-							addCurrentMessageAlready = true
-						}
-
-						msg.Historical.Previous = append(msg.Historical.Previous, interfaces.Insight{
-							Correlation: strings.ToLower(relationship.Props["value"].(string)),
-							Messages: []interfaces.Message{
-								interfaces.Message{
-									ID:   message.Props["messageId"].(string),
-									Text: message.Props["content"].(string),
-									Author: interfaces.Author{
-										ID:    user.Props["userId"].(string),
-										Name:  user.Props["name"].(string),
-										Email: user.Props["email"].(string),
-									},
-								},
-							},
-						})
-					}
-				}
+	// get past instances
+	hits, err := h.lookupHistory(ctx, &h.policy.Entity, `
+		UNWIND $lookups AS lookup
+		MATCH (e:Entity)-[x:ENTITY_MESSAGE_REF]-(m:Message)-[y:SPOKE]-(u:User)
+		WHERE x.#conversation_index# <> $conversation_id AND y.#conversation_index# <> $conversation_id AND e.category = lookup.category AND e.type = lookup.type AND e.subType = lookup.subType AND e.value = lookup.value
+			AND ($max_age = 0 OR x.created > datetime() - duration({seconds: $max_age}))
+			#scope_filter#
+		WITH lookup, e, x, m, u ORDER BY x.created DESC
+		WITH lookup, collect({
+			candidate: e.value, value: x.value, id: m.messageId, content: m.content,
+			userId: u.userId, name: u.name, email: u.email,
+			conversationId: x.#conversation_index#, created: x.created
+		})[..$fetch_limit] AS hits
+		RETURN lookup.key, hits`,
+		map[string]any{
+			"conversation_id": er.ConversationID,
+			"lookups":         lookups,
+			"max_age":         h.policy.Entity.maxAgeSeconds(),
+			"fetch_limit":     h.policy.Entity.fetchLimit(),
+		})
+	if err != nil {
+		klog.V(1).Infof("[Entities] ExecuteRead failed. Err: %v\n", err)
+		return err
+	}
+
+	msgs := make([]*interfaces.AppSpecificHistorical, 0)
+	for _, entity := range er.EntityResponse.Entities {
+		for _, match := range entity.Matches {
+			correlation := insight.EntityCorrelation(entity.Category, entity.Type, entity.SubType, match.DetectedValue)
 
-				if atLeastOnce {
-					klog.V(2).Infof("----------------------------------------\n")
+			filter := h.policy.Entity.newFilter()
+			previous := make([]interfaces.Insight, 0)
+			for _, hit := range hits[correlation] {
+				if !filter.accept(hit.conversationId, hit.created) {
+					continue
 				}
 
-				return nil, result.Err()
-			})
-			if err != nil {
-				klog.V(1).Infof("[Entities] ExecuteRead failed. Err: %v\n", err)
-				return err
+				klog.V(2).Infof("Previous Entity\n")
+				klog.V(2).Infof("Author: %s / %s\n", hit.message.Author.Name, hit.message.Author.Email)
+				klog.V(2).Infof("Entity Match: %s\n", hit.value)
+				klog.V(2).Infof("Corresponding sentence: %s\n", hit.message.Text)
+
+				previous = append(previous, interfaces.Insight{
+					Correlation:    strings.ToLower(hit.value),
+					ConversationID: hit.conversationId,
+					Created:        formatCreated(hit.created),
+					Messages:       []interfaces.Message{hit.message},
+				})
 			}
 
 			/*
-				If there is at least one Message or Insight that has triggered this Tracker, then
+				If there is at least one previous Message that has triggered this Entity, then
 				send your High-level Application message back to the Dataminer component
 			*/
-			if atLeastOnce {
-				data, err := json.Marshal(*msg)
-				if err != nil {
-					klog.V(1).Infof("[Entities] json.Marshal failed. Err: %v\n", err)
-				}
-
-				err = (*h.msgPublisher).PublishMessage(er.ConversationID, data)
-				if err != nil {
-					klog.V(1).Infof("[Entities] PublishMessage failed. Err: %v\n", err)
-				}
+			if len(previous) == 0 {
+				continue
 			}
-		}
-	}
 
-	return nil
-}
+			msg := newHistoricalMessage(interfaces.UserHistoricalTypeEntity, "entity", correlation)
+			msg.Historical.Current = append(msg.Historical.Current, interfaces.Insight{
+				Correlation: strings.ToLower(match.DetectedValue),
+				Messages:    h.convertMessageRefsToSlice(er.ConversationID, match.MessageRefs),
+			})
+			msg.Historical.Previous = previous
 
-func (h *Handler) TeardownConversation(tm *shared.TeardownResponse) error {
-	conversationId := tm.TeardownMessage.Message.Data.ConversationID
-	klog.V(2).Infof("TeardownConversation - conversationID: %s\n", conversationId)
-	delete(h.cache, conversationId)
-	return nil
-}
+			msgs = append(msgs, msg)
+		}
+	}
 
-func (h *Handler) UserDefinedMessage(data []byte) error {
-	// No implementation required. Return Succeess!
-	return nil
-}
+	h.publishHistorical(ctx, er.ConversationID, "Entities", msgs)
 
-func (h *Handler) UnhandledMessage(byMsg []byte) error {
-	klog.Errorf("\n\n-------------------------------\n")
-	klog.Errorf("UnhandledMessage:\n%v\n", string(byMsg))
-	klog.Errorf("-------------------------------\n\n")
-	return ErrUnhandledMessage
+	return h.processExperts(ctx, er.ConversationID, "entity", &h.policy.Entity, entityExpertsQuery, lookups)
 }
 
 func (h *Handler) convertInsightRefsToSlice(conversationId string, inRefs []sdkinterfaces.InsightRef) []interfaces.Message {
 	tmp := make([]interfaces.Message, 0)
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	cache := h.cache[conversationId]
 	if cache == nil {
 		tmp = append(tmp, interfaces.Message{
@@ -537,6 +636,9 @@ func (h *Handler) convertInsightRefsToSlice(conversationId string, inRefs []sdki
 func (h *Handler) convertMessageRefsToSlice(conversationId string, msgRefs []sdkinterfaces.MessageRef) []interfaces.Message {
 	tmp := make([]interfaces.Message, 0)
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	cache := h.cache[conversationId]
 	if cache == nil {
 		tmp = append(tmp, interfaces.Message{
@@ -574,6 +676,9 @@ func (h *Handler) convertMessageRefsToSlice(conversationId string, msgRefs []sdk
 func (h *Handler) convertMessageReferenceToSlice(conversationId string, msgRefs []sdkinterfaces.MessageReference) []interfaces.Message {
 	tmp := make([]interfaces.Message, 0)
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	cache := h.cache[conversationId]
 	if cache == nil {
 		tmp = append(tmp, interfaces.Message{
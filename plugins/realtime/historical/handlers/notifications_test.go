@@ -0,0 +1,166 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
+	shared "github.com/dvonthenen/enterprise-conversation-application/pkg/shared"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/interfaces"
+)
+
+// fakePublisher keeps the messages published
+type fakePublisher struct {
+	mu       sync.Mutex
+	messages []*interfaces.AppSpecificHistorical
+}
+
+func (fp *fakePublisher) PublishMessage(name string, data []byte) error {
+	var msg interfaces.AppSpecificHistorical
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return err
+	}
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.messages = append(fp.messages, &msg)
+	return nil
+}
+
+func (h *Handler) setFakePublisher() *fakePublisher {
+	publisher := &fakePublisher{}
+	var mp interfacessdk.MessagePublisher = publisher
+	h.SetClientPublisher(&mp)
+	return publisher
+}
+
+func topicResponse(conversationId, phrases string) *shared.TopicResponse {
+	return &shared.TopicResponse{
+		ConversationID: conversationId,
+		TopicResponse: &sdkinterfaces.TopicResponse{
+			Topics: []sdkinterfaces.Topic{{Phrases: phrases}},
+		},
+	}
+}
+
+func TestDispatchDoesNotWaitForOtherConversations(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 100)
+	_, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		conversationId, _ := params["conversation_id"].(string)
+		if conversationId == "" {
+			return nil
+		}
+		started <- conversationId
+		if conversationId == "conversation-slow" {
+			<-release
+		}
+		return nil
+	})
+	h := NewHandler(HandlerOptions{Driver: driver, Workers: 8})
+	defer h.Stop()
+	defer close(release)
+
+	// the callbacks are delivered from one goroutine and must not wait for the slow conversation
+	delivered := make(chan error, 1)
+	go func() {
+		err := h.TopicResponseMessage(topicResponse("conversation-slow", "renewal"))
+		for i := 0; i < 8 && err == nil; i++ {
+			err = h.TopicResponseMessage(topicResponse(fmt.Sprintf("conversation-%d", i), "renewal"))
+		}
+		delivered <- err
+	}()
+
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Fatalf("TopicResponseMessage failed. Err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TopicResponseMessage waited for the slow conversation")
+	}
+
+	// other conversations are processed while the slow one is still running
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case conversationId := <-started:
+			if conversationId != "conversation-slow" {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no other conversation was processed while the slow one was running")
+		}
+	}
+}
+
+func TestConcurrentConversations(t *testing.T) {
+	fake, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		return lookupRows(params, func(lookup map[string]any) []any {
+			return []any{}
+		})
+	})
+	h := NewHandler(HandlerOptions{Driver: driver, Workers: 4, QueueDepth: 2})
+
+	const conversations = 20
+	const responses = 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < conversations; i++ {
+		wg.Add(1)
+		go func(conversationId string) {
+			defer wg.Done()
+
+			for j := 0; j < responses; j++ {
+				id := fmt.Sprintf("%s-%d", conversationId, j)
+				callbacks := []error{
+					h.MessageResponseMessage(&shared.MessageResponse{
+						ConversationID: conversationId,
+						MessageResponse: &sdkinterfaces.MessageResponse{
+							Messages: []sdkinterfaces.Message{{ID: id}},
+						},
+					}),
+					h.InsightResponseMessage(&shared.InsightResponse{
+						ConversationID: conversationId,
+						InsightResponse: &sdkinterfaces.InsightResponse{
+							Insights: []sdkinterfaces.Insight{{ID: id, Type: "question", Payload: sdkinterfaces.Payload{Content: "what is the renewal date?"}}},
+						},
+					}),
+					h.TopicResponseMessage(topicResponse(conversationId, "renewal policy")),
+					h.TrackerResponseMessage(&shared.TrackerResponse{
+						ConversationID: conversationId,
+						TrackerResponse: &sdkinterfaces.TrackerResponse{
+							Trackers: []sdkinterfaces.Tracker{{Name: "pricing"}},
+						},
+					}),
+				}
+				for _, err := range callbacks {
+					if err != nil {
+						t.Errorf("callback failed. Err: %v", err)
+					}
+				}
+			}
+		}(fmt.Sprintf("conversation-%d", i))
+	}
+	wg.Wait()
+	h.Stop()
+
+	if got := len(fake.queriesMatching("TOPIC_MESSAGE_REF")); got != conversations*responses {
+		t.Errorf("topic queries = %d, want %d", got, conversations*responses)
+	}
+	if got := len(fake.queriesMatching("TRACKER_MESSAGE_REF")); got < conversations*responses {
+		t.Errorf("tracker queries = %d, want at least %d", got, conversations*responses)
+	}
+}
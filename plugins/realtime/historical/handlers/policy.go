@@ -0,0 +1,255 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// DefaultPolicy returns the policy matching the original behavior of this plugin which is
+// the last 5 mentions from any other conversation
+func DefaultPolicy() *Policy {
+	policy := &Policy{}
+	policy.setDefaults()
+	return policy
+}
+
+// ParsePolicy reads the historical query policy from a JSON file
+func ParsePolicy(policyFile string) (*Policy, error) {
+	klog.V(6).Infof("ParsePolicy ENTER\n")
+
+	byData, err := os.ReadFile(policyFile)
+	if err != nil {
+		klog.V(1).Infof("os.ReadFile failed. Err: %v\n", err)
+		klog.V(6).Infof("ParsePolicy LEAVE\n")
+		return nil, err
+	}
+	klog.V(5).Infof("\n\nbyData:\n%s\n\n", string(byData))
+
+	var policy Policy
+	err = json.Unmarshal(byData, &policy)
+	if err != nil {
+		klog.V(1).Infof("json.Unmarshal failed. Err: %v\n", err)
+		klog.V(6).Infof("ParsePolicy LEAVE\n")
+		return nil, err
+	}
+
+	policy.setDefaults()
+
+	for name, category := range policy.categories() {
+		err = category.parse()
+		if err != nil {
+			klog.V(1).Infof("Policy for %s is invalid. Err: %v\n", name, err)
+			klog.V(6).Infof("ParsePolicy LEAVE\n")
+			return nil, err
+		}
+	}
+
+	err = policy.TopicMatching.parse()
+	if err != nil {
+		klog.V(1).Infof("Policy for topicMatching is invalid. Err: %v\n", err)
+		klog.V(6).Infof("ParsePolicy LEAVE\n")
+		return nil, err
+	}
+
+	if policy.Experts.MaxResults < 0 {
+		klog.V(1).Infof("Policy for experts is invalid. Value: %d\n", policy.Experts.MaxResults)
+		klog.V(6).Infof("ParsePolicy LEAVE\n")
+		return nil, ErrInvalidPolicy
+	}
+
+	if policy.ContextMessages < 0 {
+		klog.V(1).Infof("Policy for contextMessages is invalid. Value: %d\n", policy.ContextMessages)
+		klog.V(6).Infof("ParsePolicy LEAVE\n")
+		return nil, ErrInvalidPolicy
+	}
+
+	policy.cooldown, err = parsePolicyDuration(policy.Cooldown)
+	if err != nil {
+		klog.V(1).Infof("Policy for cooldown is invalid. Err: %v\n", err)
+		klog.V(6).Infof("ParsePolicy LEAVE\n")
+		return nil, err
+	}
+
+	klog.V(4).Infof("ParsePolicy Succeeded\n")
+	klog.V(6).Infof("ParsePolicy LEAVE\n")
+	return &policy, nil
+}
+
+func (p *Policy) categories() map[string]*CategoryPolicy {
+	return map[string]*CategoryPolicy{
+		"topic":   &p.Topic,
+		"tracker": &p.Tracker,
+		"entity":  &p.Entity,
+		"insight": &p.Insight,
+	}
+}
+
+func (p *Policy) setDefaults() {
+	if p.Scope == "" {
+		p.Scope = ScopeGlobal
+	}
+	for _, category := range p.categories() {
+		if category.MaxResults == 0 {
+			category.MaxResults = DefaultMaxResults
+		}
+		if category.Scope == "" {
+			category.Scope = p.Scope
+		}
+	}
+	if p.TopicMatching.Algorithm == "" {
+		p.TopicMatching.Algorithm = MatchingAlgorithmJaccard
+	}
+	if p.TopicMatching.Threshold == nil {
+		threshold := DefaultSimilarityThreshold
+		p.TopicMatching.Threshold = &threshold
+	}
+	if p.Experts.MaxResults == 0 {
+		p.Experts.MaxResults = DefaultMaxExperts
+	}
+}
+
+func (cp *CategoryPolicy) parse() error {
+	if cp.MaxResults < 0 {
+		return ErrInvalidPolicy
+	}
+
+	switch cp.Scope {
+	case ScopeGlobal, ScopeParticipant, ScopeAccount:
+	default:
+		return ErrInvalidPolicy
+	}
+
+	var err error
+	cp.maxAge, err = parsePolicyDuration(cp.MaxAge)
+	if err != nil {
+		return err
+	}
+	cp.minGap, err = parsePolicyDuration(cp.MinGap)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mp *MatchingPolicy) parse() error {
+	switch mp.Algorithm {
+	case MatchingAlgorithmExact, MatchingAlgorithmJaccard, MatchingAlgorithmTrigram:
+	default:
+		return ErrInvalidPolicy
+	}
+	if mp.Threshold != nil && (*mp.Threshold < 0 || *mp.Threshold > 1) {
+		return ErrInvalidPolicy
+	}
+	return nil
+}
+
+// maxAgeSeconds is passed to the queries where 0 means no age limit
+func (cp *CategoryPolicy) maxAgeSeconds() int64 {
+	return int64(cp.maxAge / time.Second)
+}
+
+// fetchLimit when results are filtered after the fact, fetch more rows than are returned
+func (cp *CategoryPolicy) fetchLimit() int {
+	if cp.DedupeConversation || cp.minGap > 0 {
+		return cp.MaxResults * policyOverfetchFactor
+	}
+	return cp.MaxResults
+}
+
+func (cp *CategoryPolicy) newFilter() *resultFilter {
+	return &resultFilter{
+		policy:        cp,
+		conversations: make(map[string]bool),
+	}
+}
+
+// parsePolicyDuration accepts anything time.ParseDuration does plus a "d" suffix for days
+func parsePolicyDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	var duration time.Duration
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, err
+		}
+		duration = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		duration, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if duration < 0 {
+		return 0, ErrInvalidPolicy
+	}
+	return duration, nil
+}
+
+// resultFilter results are returned newest first. The filter enforces the max results, the
+// minimum gap between two results and at most one result per prior conversation.
+type resultFilter struct {
+	policy        *CategoryPolicy
+	conversations map[string]bool
+	accepted      int
+	last          time.Time
+}
+
+func (rf *resultFilter) accept(conversationId string, created time.Time) bool {
+	if rf.accepted >= rf.policy.MaxResults {
+		return false
+	}
+	if rf.policy.DedupeConversation && rf.conversations[conversationId] {
+		return false
+	}
+	if rf.policy.minGap > 0 && !rf.last.IsZero() && !created.IsZero() && rf.last.Sub(created) < rf.policy.minGap {
+		return false
+	}
+
+	rf.accepted++
+	rf.conversations[conversationId] = true
+	if !created.IsZero() {
+		rf.last = created
+	}
+	return true
+}
+
+// recordTime converts a neo4j temporal value into a time.Time
+func recordTime(value any) time.Time {
+	switch t := value.(type) {
+	case time.Time:
+		return t
+	default:
+		return time.Time{}
+	}
+}
+
+// recordString converts a neo4j value into a string
+func recordString(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// recordInt converts a neo4j value into an int
+func recordInt(value any) int {
+	if i, ok := value.(int64); ok {
+		return int(i)
+	}
+	return 0
+}
@@ -0,0 +1,238 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	version "github.com/dvonthenen/symbl-go-sdk/pkg/api/version"
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	klog "k8s.io/klog/v2"
+
+	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
+)
+
+const (
+	// participantScopeFilter only prior conversations which share at least one User with this one,
+	// the participants of this conversation are looked up once per query and bound to $participants
+	participantScopeFilter string = `AND EXISTS {
+				MATCH (pu:User)-[ps:SPOKE]-()
+				WHERE pu.userId IN $participants AND ps.#conversation_index# = x.#conversation_index#
+			}`
+
+	// accountScopeFilter only prior conversations tagged with the same account
+	accountScopeFilter string = `AND EXISTS {
+				MATCH (a:AccountTag)
+				WHERE a.accountId = $account_id AND a.#conversation_index# = x.#conversation_index#
+			}`
+
+	// accountMetadataKey key in the Symbl conversation metadata holding the account
+	accountMetadataKey string = "accountId"
+)
+
+// replaceScope replaces the #scope_filter# placeholder with the clause for the scope. Queries
+// using the placeholder must bind the relationship holding the prior conversation to x.
+func replaceScope(query, scope string) string {
+	var filter string
+	switch scope {
+	case ScopeParticipant:
+		filter = participantScopeFilter
+	case ScopeAccount:
+		filter = accountScopeFilter
+	}
+	return strings.ReplaceAll(query, "#scope_filter#", filter)
+}
+
+// usesScope reports whether any category is restricted to the given scope
+func (p *Policy) usesScope(scope string) bool {
+	for _, category := range p.categories() {
+		if category.Scope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeParams adds the parameters used by the scope filter to the query parameters
+func (h *Handler) scopeParams(ctx context.Context, tx neo4j.ManagedTransaction, scope, conversationId string, params map[string]any) error {
+	switch scope {
+	case ScopeParticipant:
+		participants, err := conversationParticipants(ctx, tx, conversationId)
+		if err != nil {
+			return err
+		}
+		params["participants"] = participants
+	case ScopeAccount:
+		params["account_id"] = h.conversationAccount(conversationId)
+	}
+	return nil
+}
+
+// conversationParticipants returns the IDs of the users who have spoken in the conversation
+func conversationParticipants(ctx context.Context, tx neo4j.ManagedTransaction, conversationId string) ([]any, error) {
+	myQuery := utils.ReplaceIndexes(`
+		MATCH (u:User)-[s:SPOKE]-()
+		WHERE s.#conversation_index# = $conversation_id
+		RETURN collect(DISTINCT u.userId)`)
+	result, err := tx.Run(ctx, myQuery, map[string]any{
+		"conversation_id": conversationId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make([]any, 0)
+	if result.Next(ctx) {
+		if ids, ok := result.Record().Values[0].([]any); ok {
+			participants = ids
+		}
+	}
+
+	return participants, result.Err()
+}
+
+// conversationAccount the account the conversation was tagged with at initialization
+func (h *Handler) conversationAccount(conversationId string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.accounts[conversationId]
+}
+
+/*
+	Conversation as returned by the Symbl conversation API. The SDK drops the metadata, so only
+	the metadata is decoded here.
+*/
+type conversationMetadata struct {
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// resolveAccount the account is supplied in the metadata of the conversation being initialized,
+// the policy account is used for conversations which do not supply one
+func (h *Handler) resolveAccount(ctx context.Context, conversationId string) string {
+	if h.symblClient != nil {
+		accountId, err := h.metadataAccount(ctx, conversationId)
+		if err != nil {
+			klog.V(3).Infof("Conversation metadata for %s not found. Err: %v\n", conversationId, err)
+		}
+		if accountId != "" {
+			return accountId
+		}
+	}
+
+	return h.policy.AccountID
+}
+
+// metadataAccount reads the account from the metadata of the conversation
+func (h *Handler) metadataAccount(ctx context.Context, conversationId string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", version.GetAsyncAPI(version.ConversationURI, conversationId), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var conversation conversationMetadata
+	err = h.symblClient.Do(ctx, req, &conversation)
+	if err != nil {
+		return "", err
+	}
+
+	accountId, _ := conversation.Metadata[accountMetadataKey].(string)
+	return accountId, nil
+}
+
+// tagConversation associates the conversation with its account so later conversations can be
+// scoped to the same account
+func (h *Handler) tagConversation(ctx context.Context, conversationId string) error {
+	if !h.policy.usesScope(ScopeAccount) {
+		return nil
+	}
+
+	accountId := h.resolveAccount(ctx, conversationId)
+	if accountId == "" {
+		klog.V(1).Infof("Conversation %s has no account, account scoped lookups return nothing\n", conversationId)
+		return nil
+	}
+
+	h.mu.Lock()
+	h.accounts[conversationId] = accountId
+	h.mu.Unlock()
+
+	session := h.newSession(ctx, neo4j.AccessModeWrite)
+	defer session.Close(ctx)
+
+	_, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		myQuery := utils.ReplaceIndexes(`
+			MERGE (a:AccountTag {accountId: $account_id, #conversation_index#: $conversation_id})
+			ON CREATE SET a.created = datetime()`)
+		result, err := tx.Run(ctx, myQuery, map[string]any{
+			"conversation_id": conversationId,
+			"account_id":      accountId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, result.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	klog.V(3).Infof("Conversation %s tagged with account %s\n", conversationId, accountId)
+	return nil
+}
+
+// prepareAccounts runs in the background when the handler is created
+func (h *Handler) prepareAccounts(ctx context.Context) {
+	defer h.background.Done()
+
+	err := h.backfillAccountTags(ctx)
+	if err != nil {
+		klog.V(1).Infof("backfillAccountTags failed. Err: %v\n", err)
+	}
+}
+
+// backfillAccountTags tags the conversations stored before account scoping was enabled with the
+// policy account, otherwise they would never be found by account scoped lookups
+func (h *Handler) backfillAccountTags(ctx context.Context) error {
+	if h.policy.AccountID == "" || !h.policy.usesScope(ScopeAccount) {
+		return nil
+	}
+
+	session := h.newSession(ctx, neo4j.AccessModeWrite)
+	defer session.Close(ctx)
+
+	count, err := session.ExecuteWrite(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		myQuery := utils.ReplaceIndexes(`
+			MATCH ()-[s:SPOKE]-()
+			WITH DISTINCT s.#conversation_index# AS conversationId
+			WHERE conversationId IS NOT NULL AND NOT EXISTS {
+				MATCH (t:AccountTag)
+				WHERE t.#conversation_index# = conversationId
+			}
+			MERGE (a:AccountTag {accountId: $account_id, #conversation_index#: conversationId})
+			ON CREATE SET a.created = datetime(), a.backfilled = true
+			RETURN count(a)`)
+		result, err := tx.Run(ctx, myQuery, map[string]any{
+			"account_id": h.policy.AccountID,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		count := 0
+		if result.Next(ctx) {
+			count = recordInt(result.Record().Values[0])
+		}
+		return count, result.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	klog.V(3).Infof("Tagged %d earlier conversations with account %s\n", count, h.policy.AccountID)
+	return nil
+}
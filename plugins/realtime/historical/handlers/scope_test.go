@@ -0,0 +1,122 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+func TestParticipantScope(t *testing.T) {
+	fake, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		if strings.Contains(cypher, "collect(DISTINCT u.userId)") {
+			return []*neo4j.Record{{Values: []any{[]any{"user-1", "user-2"}}}}
+		}
+		return nil
+	})
+	h := newLookupHandler(driver)
+	h.policy.Topic.Scope = ScopeParticipant
+
+	_, err := h.lookupHistory(context.Background(), &h.policy.Topic, "UNWIND $lookups AS lookup MATCH ()-[x:SPOKE]-() WHERE true #scope_filter# RETURN lookup.key, []", map[string]any{
+		"conversation_id": "conversation-1",
+		"lookups":         []map[string]any{{"key": "renewal"}},
+	})
+	if err != nil {
+		t.Fatalf("lookupHistory failed. Err: %v", err)
+	}
+
+	participants := fake.queriesMatching("collect(DISTINCT u.userId)")
+	if len(participants) != 1 || participants[0].params["conversation_id"] != "conversation-1" {
+		t.Fatalf("participants query = %v", participants)
+	}
+
+	lookups := fake.queriesMatching("UNWIND $lookups")
+	if len(lookups) != 1 {
+		t.Fatalf("lookup queries = %v", lookups)
+	}
+	if !strings.Contains(lookups[0].cypher, "pu.userId IN $participants") {
+		t.Errorf("participant filter is not anchored on the participants:\n%s", lookups[0].cypher)
+	}
+	if !reflect.DeepEqual(lookups[0].params["participants"], []any{"user-1", "user-2"}) {
+		t.Errorf("participants = %v", lookups[0].params["participants"])
+	}
+}
+
+func TestAccountScope(t *testing.T) {
+	tests := []struct {
+		name          string
+		policyAccount string
+		scope         string
+		wantTag       string
+	}{
+		{"policy account used as fallback", "acme-corp", ScopeAccount, "acme-corp"},
+		{"no account", "", ScopeAccount, ""},
+		{"account scope unused", "acme-corp", ScopeGlobal, ""},
+	}
+
+	for _, test := range tests {
+		fake, driver := newFakeDriver(0, nil)
+		h := newLookupHandler(driver)
+		h.policy.AccountID = test.policyAccount
+		h.policy.Topic.Scope = test.scope
+
+		err := h.tagConversation(context.Background(), "conversation-1")
+		if err != nil {
+			t.Fatalf("%s: tagConversation failed. Err: %v", test.name, err)
+		}
+
+		tags := fake.queriesMatching("MERGE (a:AccountTag")
+		if test.wantTag == "" {
+			if len(tags) != 0 {
+				t.Errorf("%s: tagged with %v", test.name, tags)
+			}
+			continue
+		}
+		if len(tags) != 1 || tags[0].params["account_id"] != test.wantTag {
+			t.Fatalf("%s: tag queries = %v", test.name, tags)
+		}
+
+		// lookups use the account of the conversation
+		_, err = h.lookupHistory(context.Background(), &h.policy.Topic, "UNWIND $lookups AS lookup RETURN lookup.key, []", map[string]any{
+			"conversation_id": "conversation-1",
+			"lookups":         []map[string]any{{"key": "renewal"}},
+		})
+		if err != nil {
+			t.Fatalf("%s: lookupHistory failed. Err: %v", test.name, err)
+		}
+		lookups := fake.queriesMatching("UNWIND $lookups")
+		if len(lookups) != 1 || lookups[0].params["account_id"] != test.wantTag {
+			t.Errorf("%s: lookup queries = %v", test.name, lookups)
+		}
+	}
+}
+
+func TestBackfillAccountTags(t *testing.T) {
+	fake, driver := newFakeDriver(0, nil)
+	h := newLookupHandler(driver)
+	h.policy.Topic.Scope = ScopeAccount
+
+	// nothing to backfill with
+	err := h.backfillAccountTags(context.Background())
+	if err != nil {
+		t.Fatalf("backfillAccountTags failed. Err: %v", err)
+	}
+	if queries := fake.queriesMatching("a.backfilled = true"); len(queries) != 0 {
+		t.Fatalf("backfill ran without an account: %v", queries)
+	}
+
+	h.policy.AccountID = "acme-corp"
+	err = h.backfillAccountTags(context.Background())
+	if err != nil {
+		t.Fatalf("backfillAccountTags failed. Err: %v", err)
+	}
+	queries := fake.queriesMatching("a.backfilled = true")
+	if len(queries) != 1 || queries[0].params["account_id"] != "acme-corp" {
+		t.Errorf("backfill queries = %v", queries)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "from": true, "in": true, "into": true, "is": true,
+	"it": true, "its": true, "of": true, "on": true, "or": true, "our": true, "that": true,
+	"the": true, "their": true, "this": true, "to": true, "was": true, "we": true, "with": true,
+	"your": true,
+}
+
+// foldCase maps each rune to the lower case form of its case folding orbit so that
+// strings which differ only by case (including special cases like final sigma) compare equal
+func foldCase(text string) string {
+	return strings.Map(func(r rune) rune {
+		folded := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < folded {
+				folded = f
+			}
+		}
+		return unicode.ToLower(folded)
+	}, text)
+}
+
+// stemToken is a light suffix stripping stemmer which handles plurals and the most common
+// verb endings. Tokens are never reduced below 3 characters.
+func stemToken(token string) string {
+	switch {
+	case strings.HasSuffix(token, "sses"):
+		return strings.TrimSuffix(token, "es")
+	case strings.HasSuffix(token, "ies") && len(token) > 4:
+		return strings.TrimSuffix(token, "ies") + "y"
+	case strings.HasSuffix(token, "ss"), strings.HasSuffix(token, "us"), strings.HasSuffix(token, "is"):
+		return token
+	case strings.HasSuffix(token, "ing") && len(token) > 5:
+		return strings.TrimSuffix(token, "ing")
+	case strings.HasSuffix(token, "ed") && len(token) > 4:
+		return strings.TrimSuffix(token, "ed")
+	case strings.HasSuffix(token, "s") && len(token) > 3:
+		return strings.TrimSuffix(token, "s")
+	}
+	return token
+}
+
+// normalizeTopic folds case, removes punctuation and stop words and stems the remaining tokens
+func normalizeTopic(text string) []string {
+	fields := strings.FieldsFunc(foldCase(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	tokens := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if stopWords[field] {
+			continue
+		}
+		tokens = append(tokens, stemToken(field))
+	}
+
+	// a phrase made up only of stop words still needs to match itself
+	if len(tokens) == 0 {
+		for _, field := range fields {
+			tokens = append(tokens, stemToken(field))
+		}
+	}
+
+	return tokens
+}
+
+// topicRoots are the unstemmed roots of the normalized tokens used to find candidate topics in
+// the database. A stored topic with a token stemming to the same value contains the root, for
+// example "polic" is in both "policy" and "policies". Roots shorter than minTopicRootLength are
+// contained in almost every topic, so they are left out and the topic is matched on the other
+// roots or on its whole text.
+func topicRoots(text string) []string {
+	tokens := normalizeTopic(text)
+
+	roots := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if strings.HasSuffix(token, "y") && utf8.RuneCountInString(token) > minTopicRootLength {
+			token = strings.TrimSuffix(token, "y")
+		}
+		if utf8.RuneCountInString(token) < minTopicRootLength {
+			continue
+		}
+		roots = append(roots, token)
+	}
+
+	return roots
+}
+
+// tokenJaccard is the size of the intersection over the size of the union of both token sets
+func tokenJaccard(a, b []string) float64 {
+	setA := make(map[string]bool)
+	for _, token := range a {
+		setA[token] = true
+	}
+	setB := make(map[string]bool)
+	for _, token := range b {
+		setB[token] = true
+	}
+	return jaccard(setA, setB)
+}
+
+// trigramOverlap is the jaccard index of the character trigrams of both normalized phrases
+func trigramOverlap(a, b []string) float64 {
+	return jaccard(trigrams(a), trigrams(b))
+}
+
+func trigrams(tokens []string) map[string]bool {
+	set := make(map[string]bool)
+
+	runes := []rune("  " + strings.Join(tokens, " ") + " ")
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = true
+	}
+
+	return set
+}
+
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+
+	intersection := 0
+	for key := range a {
+		if b[key] {
+			intersection++
+		}
+	}
+	union := len(a) + len(b) - intersection
+
+	return float64(intersection) / float64(union)
+}
+
+// similarity scores two phrases between 0 and 1 using the configured algorithm
+func (mp *MatchingPolicy) similarity(a, b string) float64 {
+	switch mp.Algorithm {
+	case MatchingAlgorithmExact:
+		if strings.Join(normalizeTopic(a), " ") == strings.Join(normalizeTopic(b), " ") {
+			return 1
+		}
+		return 0
+	case MatchingAlgorithmTrigram:
+		return trigramOverlap(normalizeTopic(a), normalizeTopic(b))
+	default:
+		return tokenJaccard(normalizeTopic(a), normalizeTopic(b))
+	}
+}
+
+func (mp *MatchingPolicy) matches(score float64) bool {
+	if mp.Threshold == nil {
+		return score >= DefaultSimilarityThreshold
+	}
+	return score >= *mp.Threshold
+}
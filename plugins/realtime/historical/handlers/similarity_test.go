@@ -0,0 +1,190 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStemToken(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"policies", "policy"},
+		{"policy", "policy"},
+		{"classes", "class"},
+		{"class", "class"},
+		{"status", "status"},
+		{"analysis", "analysis"},
+		{"contracts", "contract"},
+		{"renewing", "renew"},
+		{"renewed", "renew"},
+		{"bus", "bus"},
+		{"its", "its"},
+	}
+
+	for _, test := range tests {
+		if got := stemToken(test.token); got != test.want {
+			t.Errorf("stemToken(%q) = %q, want %q", test.token, got, test.want)
+		}
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	tests := []struct {
+		a string
+		b string
+	}{
+		{"Renewal Policy", "renewal policy"},
+		{"ΣΊΣΥΦΟΣ", "σίσυφος"},
+		{"KELVIN K", "kelvin k"},
+	}
+
+	for _, test := range tests {
+		if foldCase(test.a) != foldCase(test.b) {
+			t.Errorf("foldCase(%q) = %q, foldCase(%q) = %q", test.a, foldCase(test.a), test.b, foldCase(test.b))
+		}
+	}
+}
+
+func TestNormalizeTopic(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"The Renewal Policies", []string{"renewal", "policy"}},
+		{"renewal policy", []string{"renewal", "policy"}},
+		{"pricing, for the contracts!", []string{"pric", "contract"}},
+		{"the", []string{"the"}},
+	}
+
+	for _, test := range tests {
+		if got := normalizeTopic(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("normalizeTopic(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTopicRoots(t *testing.T) {
+	// every stored form which stems to the same token must contain one of the roots, the
+	// stored value is lower cased by the query
+	tests := []struct {
+		topic  string
+		stored []string
+	}{
+		{"policies", []string{"policy", "Policies", "renewal policy"}},
+		{"Policy", []string{"policies", "POLICY"}},
+		{"classes", []string{"class", "classes"}},
+		{"renewed contracts", []string{"renewing", "contract"}},
+	}
+
+	for _, test := range tests {
+		roots := topicRoots(test.topic)
+		for _, stored := range test.stored {
+			found := false
+			for _, root := range roots {
+				if strings.Contains(strings.ToLower(stored), root) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("topicRoots(%q) = %v, none are in %q", test.topic, roots, stored)
+			}
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		a         string
+		b         string
+		want      float64
+	}{
+		{MatchingAlgorithmExact, "Renewal Policies", "the renewal policy", 1},
+		{MatchingAlgorithmExact, "renewal policy", "pricing policy", 0},
+		{MatchingAlgorithmJaccard, "RENEWAL POLICIES", "renewal policy", 1},
+		{MatchingAlgorithmJaccard, "renewal policy", "pricing policy", 1.0 / 3.0},
+		{MatchingAlgorithmJaccard, "renewal policy", "quarterly forecast", 0},
+		{MatchingAlgorithmTrigram, "Renewal Policies", "renewal policy", 1},
+	}
+
+	for _, test := range tests {
+		mp := MatchingPolicy{Algorithm: test.algorithm}
+		if got := mp.similarity(test.a, test.b); got != test.want {
+			t.Errorf("%s similarity(%q, %q) = %f, want %f", test.algorithm, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestMatchingThreshold(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		score float64
+		want  bool
+	}{
+		{"default accepts", `{}`, DefaultSimilarityThreshold, true},
+		{"default rejects", `{}`, 0.4, false},
+		{"zero accepts anything", `{"topicMatching": {"threshold": 0}}`, 0, true},
+		{"one requires identical", `{"topicMatching": {"threshold": 1}}`, 0.99, false},
+		{"configured", `{"topicMatching": {"threshold": 0.25}}`, 0.3, true},
+	}
+
+	for _, test := range tests {
+		policy, err := ParsePolicy(writePolicy(t, test.json))
+		if err != nil {
+			t.Fatalf("%s: ParsePolicy failed. Err: %v", test.name, err)
+		}
+		if got := policy.TopicMatching.matches(test.score); got != test.want {
+			t.Errorf("%s: matches(%f) = %v, want %v", test.name, test.score, got, test.want)
+		}
+	}
+
+	for _, invalid := range []string{`{"topicMatching": {"threshold": -0.1}}`, `{"topicMatching": {"threshold": 1.5}}`} {
+		_, err := ParsePolicy(writePolicy(t, invalid))
+		if err == nil {
+			t.Errorf("ParsePolicy(%s) succeeded, want an error", invalid)
+		}
+	}
+
+	// a zero value policy uses the default
+	if (&MatchingPolicy{}).matches(0.4) {
+		t.Errorf("MatchingPolicy{}.matches(0.4) = true, want false")
+	}
+}
+
+func writePolicy(t *testing.T, data string) string {
+	t.Helper()
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	err := os.WriteFile(policyFile, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("os.WriteFile failed. Err: %v", err)
+	}
+	return policyFile
+}
+
+func TestTopicRootsSkipsShortTokens(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"AI roadmap", []string{"roadmap"}},
+		{"AI", []string{}},
+		{"key accounts", []string{"key", "account"}},
+		{"renewal policy", []string{"renewal", "polic"}},
+	}
+
+	for _, test := range tests {
+		if got := topicRoots(test.topic); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("topicRoots(%q) = %v, want %v", test.topic, got, test.want)
+		}
+	}
+}
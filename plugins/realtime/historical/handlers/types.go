@@ -4,26 +4,113 @@
 package handlers
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
 	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
 	symbl "github.com/dvonthenen/symbl-go-sdk/pkg/client"
 	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	insight "github.com/dvonthenen/enterprise-conversation-plugins/pkg/insight"
+	workerpool "github.com/dvonthenen/enterprise-conversation-plugins/pkg/workerpool"
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/interfaces"
 )
 
+/*
+	Query policy
+*/
+type CategoryPolicy struct {
+	MaxResults         int    `json:"maxResults,omitempty"`
+	MaxAge             string `json:"maxAge,omitempty"`
+	MinGap             string `json:"minGap,omitempty"`
+	DedupeConversation bool   `json:"dedupeConversation,omitempty"`
+	Scope              string `json:"scope,omitempty"`
+
+	// parsed values
+	maxAge time.Duration
+	minGap time.Duration
+}
+
+type MatchingPolicy struct {
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// nil uses DefaultSimilarityThreshold, 0 accepts every candidate sharing a root
+	Threshold *float64 `json:"threshold,omitempty"`
+}
+
+type ExpertPolicy struct {
+	Disabled   bool `json:"disabled,omitempty"`
+	MaxResults int  `json:"maxResults,omitempty"`
+}
+
+type Policy struct {
+	Topic           CategoryPolicy `json:"topic,omitempty"`
+	Tracker         CategoryPolicy `json:"tracker,omitempty"`
+	Entity          CategoryPolicy `json:"entity,omitempty"`
+	Insight         CategoryPolicy `json:"insight,omitempty"`
+	TopicMatching   MatchingPolicy `json:"topicMatching,omitempty"`
+	Experts         ExpertPolicy   `json:"experts,omitempty"`
+	Cooldown        string         `json:"cooldown,omitempty"`
+	ContextMessages int            `json:"contextMessages,omitempty"`
+	Scope           string         `json:"scope,omitempty"`
+	AccountID       string         `json:"accountId,omitempty"`
+
+	// parsed values
+	cooldown time.Duration
+}
+
+/*
+	Previous mention returned from a batched lookup
+*/
+type historicalHit struct {
+	candidate      string
+	value          string
+	conversationId string
+	created        time.Time
+	source         string
+	message        interfaces.Message
+}
+
+/*
+	What was last published for a correlation within a conversation
+*/
+type publishedState struct {
+	previousIds   map[string]bool
+	lastPublished time.Time
+}
+
 /*
 	Handler for messages
 */
 type HandlerOptions struct {
-	Session     *neo4j.SessionWithContext // retrieve insights
+	Driver      *neo4j.DriverWithContext // retrieve insights
 	SymblClient *symbl.RestClient
+	Policy      *Policy
+	Workers     int
+	QueueDepth  int
 }
 
 type Handler struct {
 	// properties
-	cache map[string]*utils.MessageCache
+	mu        sync.Mutex
+	cache     map[string]*utils.MessageCache
+	published map[string]map[string]*publishedState
+	accounts  map[string]string
+
+	// insights waiting for the normalized text to be stored
+	pendingInsights *insight.Pending
+
+	// background work
+	cancel     context.CancelFunc
+	background sync.WaitGroup
 
 	// housekeeping
-	session      *neo4j.SessionWithContext
+	policy       *Policy
+	pool         *workerpool.Pool
+	driver       *neo4j.DriverWithContext
 	symblClient  *symbl.RestClient
+	publishMu    sync.Mutex
 	msgPublisher *interfacessdk.MessagePublisher
 }
@@ -11,6 +11,12 @@ const (
 	UserHistoricalTypeTopic   string = "historical_topic"
 	UserHistoricalTypeTracker string = "historical_tracker"
 	UserHistoricalTypeEntity  string = "historical_entity"
+	UserHistoricalTypeInsight string = "historical_insight"
+	UserHistoricalTypeExperts string = "historical_experts"
+
+	// where a previous mention was found
+	SourceMessage string = "message"
+	SourceInsight string = "insight"
 
 	// app specific message type
 	MessageNotFound string = "**MESSAGE NOT FOUND**"
@@ -19,15 +19,30 @@ type Message struct {
 }
 
 type Insight struct {
-	Correlation string    `json:"correlation,omitempty"`
-	Messages    []Message `json:"message,omitempty"`
+	Correlation    string    `json:"correlation,omitempty"`
+	Similarity     float64   `json:"similarity,omitempty"`
+	Source         string    `json:"source,omitempty"`
+	ConversationID string    `json:"conversationId,omitempty"`
+	Created        string    `json:"created,omitempty"`
+	Messages       []Message `json:"message,omitempty"`
+	Before         []Message `json:"before,omitempty"`
+	After          []Message `json:"after,omitempty"`
+}
+
+type Expert struct {
+	Author        Author  `json:"author,omitempty"`
+	Mentions      int     `json:"mentions,omitempty"`
+	LastMentioned string  `json:"lastMentioned,omitempty"`
+	Sample        Message `json:"sample,omitempty"`
 }
 
 type Data struct {
 	Type        string    `json:"type,omitempty"`
+	Category    string    `json:"category,omitempty"`
 	Correlation string    `json:"correlation,omitempty"`
 	Current     []Insight `json:"current,omitempty"`
 	Previous    []Insight `json:"previous,omitempty"`
+	Experts     []Expert  `json:"experts,omitempty"`
 }
 
 /*
@@ -6,6 +6,7 @@ package server
 import (
 	"context"
 	"os"
+	"strconv"
 
 	middlewaresdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk"
 	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
@@ -52,10 +53,50 @@ func New(options ServerOptions) (*Server, error) {
 		Password:      password,
 	}
 
+	// query policy
+	policy := handlers.DefaultPolicy()
+	if v := os.Getenv("HISTORICAL_POLICY_FILE"); v != "" {
+		klog.V(4).Info("HISTORICAL_POLICY_FILE found")
+		options.PolicyFile = v
+	}
+	if options.PolicyFile != "" {
+		var err error
+		policy, err = handlers.ParsePolicy(options.PolicyFile)
+		if err != nil {
+			klog.Errorf("ParsePolicy failed. Err: %v\n", err)
+			return nil, err
+		}
+	}
+	if v := os.Getenv("HISTORICAL_ACCOUNT_ID"); v != "" {
+		klog.V(4).Info("HISTORICAL_ACCOUNT_ID found")
+		policy.AccountID = v
+	}
+
+	// worker pool
+	if v := os.Getenv("HISTORICAL_WORKERS"); v != "" {
+		klog.V(4).Info("HISTORICAL_WORKERS found")
+		workers, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("HISTORICAL_WORKERS is invalid. Err: %v\n", err)
+			return nil, ErrInvalidInput
+		}
+		options.Workers = workers
+	}
+	if v := os.Getenv("HISTORICAL_QUEUE_DEPTH"); v != "" {
+		klog.V(4).Info("HISTORICAL_QUEUE_DEPTH found")
+		queueDepth, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("HISTORICAL_QUEUE_DEPTH is invalid. Err: %v\n", err)
+			return nil, ErrInvalidInput
+		}
+		options.QueueDepth = queueDepth
+	}
+
 	// server
 	server := &Server{
 		options: options,
 		creds:   creds,
+		policy:  policy,
 	}
 	return server, nil
 }
@@ -209,15 +250,18 @@ func (s *Server) RebuildMiddlewareAnalyzer() error {
 		}
 		s.middlewareAnalyzer = nil
 	}
-
-	// create database session
-	ctx := context.Background()
-	session := (*s.driver).NewSession(ctx, neo4j.SessionConfig{DatabaseName: "neo4j"})
+	if s.messageHandler != nil {
+		s.messageHandler.Stop()
+		s.messageHandler = nil
+	}
 
 	// create handler
 	messageHandler := handlers.NewHandler(handlers.HandlerOptions{
-		Session:     &session,
+		Driver:      s.driver,
 		SymblClient: s.symblClient,
+		Policy:      s.policy,
+		Workers:     s.options.Workers,
+		QueueDepth:  s.options.QueueDepth,
 	})
 
 	// create middleware
@@ -236,6 +280,7 @@ func (s *Server) RebuildMiddlewareAnalyzer() error {
 
 	// housekeeping
 	s.middlewareAnalyzer = middlewareAnalyzer
+	s.messageHandler = messageHandler
 
 	klog.V(4).Infof("Server.RebuildMiddlewareAnalyzer Succeeded\n")
 	klog.V(6).Infof("Server.RebuildMiddlewareAnalyzer LEAVE\n")
@@ -257,6 +302,12 @@ func (s *Server) Stop() error {
 	}
 	s.middlewareAnalyzer = nil
 
+	// drain queued callbacks
+	if s.messageHandler != nil {
+		s.messageHandler.Stop()
+	}
+	s.messageHandler = nil
+
 	// clean up symbl client
 	s.symblClient = nil
 
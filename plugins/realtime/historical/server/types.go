@@ -7,6 +7,8 @@ import (
 	middlewaresdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk"
 	symbl "github.com/dvonthenen/symbl-go-sdk/pkg/client"
 	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	handlers "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/historical/handlers"
 )
 
 // Credentials is the input needed to login to neo4j
@@ -23,15 +25,20 @@ type ServerOptions struct {
 	BindAddress string
 	BindPort    int
 	RabbitURI   string
+	PolicyFile  string
+	Workers     int
+	QueueDepth  int
 }
 
 type Server struct {
 	// server versions
 	options ServerOptions
 	creds   Credentials
+	policy  *handlers.Policy
 
 	// middleware
 	middlewareAnalyzer *middlewaresdk.RealtimeAnalyzer
+	messageHandler     *handlers.Handler
 
 	// neo4j
 	driver *neo4j.DriverWithContext
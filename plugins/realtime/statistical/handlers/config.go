@@ -0,0 +1,464 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	klog "k8s.io/klog/v2"
+)
+
+// DefaultConfig returns the configuration matching the original behavior of this plugin
+// which is the 7 windows from 30 mins to 1 month
+func DefaultConfig() *Config {
+	config := &Config{}
+	config.setDefaults()
+
+	err := config.parse()
+	if err != nil {
+		klog.V(1).Infof("DefaultConfig is invalid. Err: %v\n", err)
+	}
+	return config
+}
+
+// ParseConfig reads the statistical configuration from a JSON file
+func ParseConfig(configFile string) (*Config, error) {
+	klog.V(6).Infof("ParseConfig ENTER\n")
+
+	byData, err := os.ReadFile(configFile)
+	if err != nil {
+		klog.V(1).Infof("os.ReadFile failed. Err: %v\n", err)
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return nil, err
+	}
+	klog.V(5).Infof("\n\nbyData:\n%s\n\n", string(byData))
+
+	var config Config
+	err = json.Unmarshal(byData, &config)
+	if err != nil {
+		klog.V(1).Infof("json.Unmarshal failed. Err: %v\n", err)
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return nil, err
+	}
+
+	config.setDefaults()
+
+	err = config.parse()
+	if err != nil {
+		klog.V(1).Infof("Config is invalid. Err: %v\n", err)
+		klog.V(6).Infof("ParseConfig LEAVE\n")
+		return nil, err
+	}
+
+	klog.V(4).Infof("ParseConfig Succeeded\n")
+	klog.V(6).Infof("ParseConfig LEAVE\n")
+	return &config, nil
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Windows) == 0 {
+		c.Windows = append(c.Windows, legacyWindows...)
+	}
+	if c.Trend.Window == "" {
+		c.Trend.Window = DefaultTrendWindow
+	}
+	if c.Trend.Baseline == "" {
+		c.Trend.Baseline = DefaultTrendBaseline
+	}
+	if c.Trend.Threshold == 0 {
+		c.Trend.Threshold = DefaultTrendThreshold
+	}
+	if c.Trend.MinCount == 0 {
+		c.Trend.MinCount = DefaultTrendMinCount
+	}
+	if c.Cooccurrence.Window == "" {
+		c.Cooccurrence.Window = DefaultCooccurrenceWindow
+	}
+	if c.Cooccurrence.MaxResults == 0 {
+		c.Cooccurrence.MaxResults = DefaultCooccurrenceMaxResults
+	}
+	if c.TimeZone == "" {
+		c.TimeZone = DefaultTimeZone
+	}
+	if c.BusinessHours.Start == 0 && c.BusinessHours.End == 0 {
+		c.BusinessHours.Start = DefaultBusinessStart
+		c.BusinessHours.End = DefaultBusinessEnd
+	}
+	if len(c.BusinessHours.Days) == 0 {
+		c.BusinessHours.Days = append(c.BusinessHours.Days, defaultBusinessDays...)
+	}
+	if c.Counters.Bucket == "" {
+		c.Counters.Bucket = DefaultCounterBucket
+	}
+	if c.Counters.Reconcile == "" {
+		c.Counters.Reconcile = DefaultCounterReconcile
+	}
+}
+
+func (c *Config) parse() error {
+	var err error
+	c.location, err = time.LoadLocation(c.TimeZone)
+	if err != nil {
+		klog.V(1).Infof("timeZone %s is invalid. Err: %v\n", c.TimeZone, err)
+		return err
+	}
+
+	err = c.BusinessHours.parse()
+	if err != nil {
+		klog.V(1).Infof("Business hours config is invalid. Err: %v\n", err)
+		return err
+	}
+
+	c.windows = make([]statWindow, 0, len(c.Windows))
+	c.queryWindows = make([]statWindow, 0, len(c.Windows))
+	for _, spec := range c.Windows {
+		window, err := c.addQueryWindow(spec)
+		if err != nil {
+			return err
+		}
+		c.windows = append(c.windows, window)
+	}
+
+	// the legacy fields are always computed from the original windows
+	if c.LegacyStats {
+		for _, spec := range legacyWindows {
+			_, err := c.addQueryWindow(spec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.Trend.Enabled {
+		err := c.Trend.parse(c)
+		if err != nil {
+			klog.V(1).Infof("Trend config is invalid. Err: %v\n", err)
+			return err
+		}
+	}
+
+	if c.TopSpeakers < 0 {
+		klog.V(1).Infof("topSpeakers is invalid. Value: %d\n", c.TopSpeakers)
+		return ErrInvalidConfig
+	}
+
+	if c.Cooccurrence.Enabled {
+		c.Cooccurrence.window, err = parseWindow(c.Cooccurrence.Window)
+		if err != nil {
+			klog.V(1).Infof("Cooccurrence window is invalid. Err: %v\n", err)
+			return err
+		}
+		if c.Cooccurrence.MaxResults < 0 {
+			return ErrInvalidConfig
+		}
+	}
+
+	if c.Counters.Enabled {
+		err := c.Counters.parse()
+		if err != nil {
+			klog.V(1).Infof("Counters config is invalid. Err: %v\n", err)
+			return err
+		}
+	}
+
+	for i := range c.Histograms {
+		err := c.Histograms[i].parse()
+		if err != nil {
+			klog.V(1).Infof("Histogram config is invalid. Err: %v\n", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// histogram returns the histogram config by name
+func (c *Config) histogram(name string) *HistogramConfig {
+	for i := range c.Histograms {
+		if c.Histograms[i].name() == name {
+			return &c.Histograms[i]
+		}
+	}
+	return nil
+}
+
+// parse buckets have a fixed length, so calendar based units like "mo" and "y" are rejected
+func (hc *HistogramConfig) parse() error {
+	var err error
+	hc.window, err = parseWindow(hc.Window)
+	if err != nil {
+		return err
+	}
+	hc.bucket, err = parseWindow(hc.Bucket)
+	if err != nil {
+		return err
+	}
+
+	if hc.window.months > 0 || hc.bucket.months > 0 || hc.window.calendar != "" || hc.bucket.calendar != "" {
+		klog.V(1).Infof("Histogram %s does not support calendar months or years\n", hc.name())
+		return ErrInvalidConfig
+	}
+	if hc.bucket.seconds > hc.window.seconds || int64(hc.buckets()) > maxHistogramBuckets {
+		klog.V(1).Infof("Histogram %s has an invalid number of buckets\n", hc.name())
+		return ErrInvalidConfig
+	}
+
+	return nil
+}
+
+func (hc *HistogramConfig) name() string {
+	return fmt.Sprintf("%s/%s", hc.window.name, hc.bucket.name)
+}
+
+// buckets number of buckets, a partial bucket at the start of the window is counted as a bucket
+func (hc *HistogramConfig) buckets() int {
+	return int((hc.window.seconds + hc.bucket.seconds - 1) / hc.bucket.seconds)
+}
+
+// parse the bucket size and reconcile interval have a fixed length
+func (cc *CountersConfig) parse() error {
+	bucket, err := parseWindow(cc.Bucket)
+	if err != nil {
+		return err
+	}
+	reconcile, err := parseWindow(cc.Reconcile)
+	if err != nil {
+		return err
+	}
+	if bucket.months > 0 || reconcile.months > 0 || bucket.calendar != "" || reconcile.calendar != "" {
+		return ErrInvalidConfig
+	}
+
+	cc.bucket = time.Duration(bucket.seconds) * time.Second
+	cc.reconcile = time.Duration(reconcile.seconds) * time.Second
+	return nil
+}
+
+func (tc *TrendConfig) parse(c *Config) error {
+	var err error
+	tc.window, err = c.addQueryWindow(tc.Window)
+	if err != nil {
+		return err
+	}
+	tc.baseline, err = c.addQueryWindow(tc.Baseline)
+	if err != nil {
+		return err
+	}
+
+	now := c.now()
+	if tc.baseline.length(now) <= tc.window.length(now) {
+		klog.V(1).Infof("Trend baseline %s must be longer than the window %s\n", tc.Baseline, tc.Window)
+		return ErrInvalidConfig
+	}
+	if tc.Threshold < 0 || tc.MinCount < 0 {
+		return ErrInvalidConfig
+	}
+
+	return nil
+}
+
+// addQueryWindow parses the window and makes sure it is counted by the stats queries
+func (c *Config) addQueryWindow(spec string) (statWindow, error) {
+	window, err := parseWindow(spec)
+	if err != nil {
+		klog.V(1).Infof("Window %s is invalid. Err: %v\n", spec, err)
+		return window, err
+	}
+
+	if !containsWindow(c.queryWindows, window.name) {
+		c.queryWindows = append(c.queryWindows, window)
+	}
+	return window, nil
+}
+
+// parseWindow accepts anything time.ParseDuration does plus "d" (days), "w" (weeks),
+// "mo" (calendar months) and "y" (calendar years)
+func parseWindow(spec string) (statWindow, error) {
+	spec = strings.ToLower(strings.Join(strings.Fields(spec), " "))
+	window := statWindow{
+		name: spec,
+	}
+
+	switch spec {
+	case CalendarToday, CalendarWeek, CalendarMonth, CalendarQuarter, CalendarYear:
+		window.calendar = spec
+		return window, nil
+	}
+
+	suffixes := []struct {
+		suffix string
+		months int64
+		period time.Duration
+	}{
+		{suffix: "mo", months: 1},
+		{suffix: "y", months: 12},
+		{suffix: "w", period: 7 * 24 * time.Hour},
+		{suffix: "d", period: 24 * time.Hour},
+	}
+	for _, s := range suffixes {
+		if !strings.HasSuffix(spec, s.suffix) {
+			continue
+		}
+
+		value, err := strconv.ParseInt(strings.TrimSuffix(spec, s.suffix), 10, 64)
+		if err != nil {
+			return window, err
+		}
+		if value <= 0 {
+			return window, ErrInvalidConfig
+		}
+
+		window.months = value * s.months
+		window.seconds = value * int64(s.period/time.Second)
+		return window, nil
+	}
+
+	duration, err := time.ParseDuration(spec)
+	if err != nil {
+		return window, err
+	}
+	if duration < time.Second {
+		return window, ErrInvalidConfig
+	}
+
+	window.seconds = int64(duration / time.Second)
+	return window, nil
+}
+
+func containsWindow(windows []statWindow, name string) bool {
+	for _, window := range windows {
+		if window.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// now the current time in the configured time zone
+func (c *Config) now() time.Time {
+	if c.location == nil {
+		return time.Now()
+	}
+	return time.Now().In(c.location)
+}
+
+// since the start of the window ending now, calendar windows start at the boundary in the
+// time zone of now
+func (w *statWindow) since(now time.Time) time.Time {
+	year, month, day := now.Date()
+
+	switch w.calendar {
+	case CalendarToday:
+		return time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	case CalendarWeek:
+		// weeks start on Monday
+		offset := (int(now.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, now.Location())
+	case CalendarMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+	case CalendarQuarter:
+		quarter := ((int(month)-1)/3)*3 + 1
+		return time.Date(year, time.Month(quarter), 1, 0, 0, 0, 0, now.Location())
+	case CalendarYear:
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, now.Location())
+	}
+
+	return now.AddDate(0, -int(w.months), 0).Add(-time.Duration(w.seconds) * time.Second)
+}
+
+// length of the window ending now in seconds
+func (w *statWindow) length(now time.Time) float64 {
+	return now.Sub(w.since(now)).Seconds()
+}
+
+func (bh *BusinessHoursConfig) parse() error {
+	if bh.Start < 0 || bh.End > 24 || bh.Start >= bh.End {
+		return ErrInvalidConfig
+	}
+
+	bh.days = make([]int64, 0, len(bh.Days))
+	for _, day := range bh.Days {
+		name := strings.ToLower(strings.TrimSpace(day))
+		if len(name) > 3 {
+			name = name[:3]
+		}
+		isoDay, ok := isoWeekdays[name]
+		if !ok {
+			klog.V(1).Infof("Business day %s is invalid\n", day)
+			return ErrInvalidConfig
+		}
+		bh.days = append(bh.days, isoDay)
+	}
+
+	return nil
+}
+
+// contains reports whether the local time is within business hours, always true when the
+// business hours filter is disabled
+func (bh *BusinessHoursConfig) contains(local time.Time) bool {
+	if !bh.Enabled {
+		return true
+	}
+	if local.Hour() < bh.Start || local.Hour() >= bh.End {
+		return false
+	}
+	return bh.businessDay(local)
+}
+
+// businessDay reports whether the local time falls on one of the business days
+func (bh *BusinessHoursConfig) businessDay(local time.Time) bool {
+	isoDay := int64(local.Weekday())
+	if isoDay == 0 {
+		isoDay = 7
+	}
+	for _, day := range bh.days {
+		if day == isoDay {
+			return true
+		}
+	}
+	return false
+}
+
+// length of the window ending now in seconds, only the seconds within business hours are
+// counted when the business hours filter is enabled since nothing else is counted
+func (bh *BusinessHoursConfig) length(w *statWindow, now time.Time) float64 {
+	if !bh.Enabled {
+		return w.length(now)
+	}
+	return bh.seconds(w.since(now), now)
+}
+
+// seconds within business hours between from and to in the time zone of to
+func (bh *BusinessHoursConfig) seconds(from, to time.Time) float64 {
+	location := to.Location()
+	from = from.In(location)
+
+	var total time.Duration
+	year, month, day := from.Date()
+	for midnight := time.Date(year, month, day, 0, 0, 0, 0, location); midnight.Before(to); midnight = midnight.AddDate(0, 0, 1) {
+		if !bh.businessDay(midnight) {
+			continue
+		}
+
+		y, m, d := midnight.Date()
+		start := time.Date(y, m, d, bh.Start, 0, 0, 0, location)
+		end := time.Date(y, m, d, bh.End, 0, 0, 0, location)
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+		}
+	}
+
+	return total.Seconds()
+}
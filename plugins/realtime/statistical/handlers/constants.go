@@ -5,19 +5,63 @@ package handlers
 
 import "errors"
 
-type StatisticType int
-
 const (
-	StatType1Month StatisticType = iota
-	StatType1Week
-	StatType2Days
-	StatType1Day
-	StatType4Hours
-	StatType1Hour
-	StatType30Mins
+	// trend detection defaults, the last hour compared to the rate over the past month
+	DefaultTrendWindow    string  = "1h"
+	DefaultTrendBaseline  string  = "30d"
+	DefaultTrendThreshold float64 = 3.0
+	DefaultTrendMinCount  int64   = 3
+
+	// co-occurrence defaults
+	DefaultCooccurrenceWindow     string = "90d"
+	DefaultCooccurrenceMaxResults int    = 5
+
+	// in memory counter defaults
+	DefaultCounterBucket    string = "1m"
+	DefaultCounterReconcile string = "15m"
+
+	// maxHistogramBuckets upper bound on the number of buckets in a single histogram
+	maxHistogramBuckets int64 = 1000
+
+	// DefaultTimeZone time zone calendar windows and business hours are evaluated in
+	DefaultTimeZone string = "UTC"
+
+	// default business hours which are 9am to 5pm
+	DefaultBusinessStart int = 9
+	DefaultBusinessEnd   int = 17
+
+	// calendar aligned windows
+	CalendarToday   string = "today"
+	CalendarWeek    string = "this week"
+	CalendarMonth   string = "this month"
+	CalendarQuarter string = "this quarter"
+	CalendarYear    string = "this year"
+
+	// the windows reported by the original fixed set of statistics
+	legacyWindow30Mins string = "30m"
+	legacyWindow1Hour  string = "1h"
+	legacyWindow4Hours string = "4h"
+	legacyWindow1Day   string = "1d"
+	legacyWindow2Days  string = "2d"
+	legacyWindow1Week  string = "1w"
+	legacyWindow1Month string = "1mo"
 )
 
 var (
+	// legacyWindows the windows reported by the original fixed set of statistics
+	legacyWindows = []string{legacyWindow30Mins, legacyWindow1Hour, legacyWindow4Hours, legacyWindow1Day, legacyWindow2Days, legacyWindow1Week, legacyWindow1Month}
+
+	// defaultBusinessDays Monday to Friday
+	defaultBusinessDays = []string{"mon", "tue", "wed", "thu", "fri"}
+
+	// isoWeekdays day names to the ISO day of the week used by Neo4j
+	isoWeekdays = map[string]int64{"mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6, "sun": 7}
+)
+
+var (
+	// ErrInvalidConfig the statistical config file contains an invalid value
+	ErrInvalidConfig = errors.New("the statistical config file contains an invalid value")
+
 	// ErrUnhandledMessage runhandled message from symbl-proxy-dataminer
 	ErrUnhandledMessage = errors.New("unhandled message from symbl-proxy-dataminer")
 )
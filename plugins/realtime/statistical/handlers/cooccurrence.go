@@ -0,0 +1,108 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"strings"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
+	klog "k8s.io/klog/v2"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
+)
+
+const (
+	// cooccurrenceCounts finds the prior conversations the lookup was mentioned in and counts in
+	// how many of those each other topic, tracker and entity was mentioned. Only mentions during
+	// business hours are used when the filter is enabled, the same as the in memory counters.
+	cooccurrenceCounts string = `
+			AND x.created > $window_since` + businessHoursFilter + `
+		WITH lookup, collect(DISTINCT x.#conversation_index#) AS conversations
+		UNWIND conversations AS conversationId
+		CALL {
+			WITH conversationId
+			MATCH (t:Topic)-[r:TOPIC_MESSAGE_REF]-(:Message)
+			WHERE r.#conversation_index# = conversationId #related_business_hours#
+			RETURN 'topic' AS category, toLower(r.value) AS value
+			UNION
+			WITH conversationId
+			MATCH (t:Tracker)-[r:TRACKER_MESSAGE_REF]-(:Message)
+			WHERE r.#conversation_index# = conversationId #related_business_hours#
+			RETURN 'tracker' AS category, toLower(t.name) AS value
+			UNION
+			WITH conversationId
+			MATCH (e:Entity)-[r:ENTITY_MESSAGE_REF]-(:Message)
+			WHERE r.#conversation_index# = conversationId #related_business_hours#
+			RETURN 'entity' AS category, toLower(e.category + '/' + e.type + '/' + e.subType + '/' + r.value) AS value
+		}
+		WITH lookup, category, value, count(DISTINCT conversationId) AS total
+		WHERE NOT (category = $category AND value = lookup.key)
+		WITH lookup, category, value, total ORDER BY total DESC
+		WITH lookup, collect({category: category, value: value, conversations: total})[..$max_results] AS related
+		RETURN lookup.key, related`
+)
+
+// cooccurrenceQuery the query finding related correlations for the category match clause, the
+// business hours filter is applied to the related mentions r as well
+func cooccurrenceQuery(match string) string {
+	related := strings.ReplaceAll(strings.TrimSpace(businessHoursFilter), "x.created", "r.created")
+	return lookupPrefix + match + strings.ReplaceAll(cooccurrenceCounts, "#related_business_hours#", related)
+}
+
+// cooccurrenceStats runs a single query returning the correlations which were most often
+// mentioned in the same prior conversations grouped by the lookup key
+func (h *Handler) cooccurrenceStats(ctx context.Context, category, match, conversationId string, lookups []map[string]any) (map[string][]interfaces.Related, error) {
+	related := make(map[string][]interfaces.Related)
+	if !h.config.Cooccurrence.Enabled {
+		return related, nil
+	}
+
+	window := h.config.Cooccurrence.window
+	err := h.runLookup(ctx, cooccurrenceQuery(match), h.config.queryParams(map[string]any{
+		"conversation_id": conversationId,
+		"lookups":         lookups,
+		"category":        category,
+		"window_since":    window.since(h.config.now()),
+		"max_results":     h.config.Cooccurrence.MaxResults,
+	}), func(key string, props map[string]any) {
+		related[key] = append(related[key], interfaces.Related{
+			Category:      recordString(props["category"]),
+			Correlation:   recordString(props["value"]),
+			Conversations: recordInt64(props["conversations"]),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return related, nil
+}
+
+// publishCooccurrence sends a statistical_cooccurrence message with what is usually discussed
+// alongside the correlations in msg
+func (h *Handler) publishCooccurrence(conversationId, label string, msg *interfaces.AppSpecificStatistical, related []interfaces.Related) {
+	if len(related) == 0 {
+		return
+	}
+
+	for _, curRelated := range related {
+		klog.V(2).Infof("[%s] Related %s: %s (%d conversations)\n", label, curRelated.Category, curRelated.Correlation, curRelated.Conversations)
+	}
+
+	cooccurrenceMsg := &interfaces.AppSpecificStatistical{
+		Type: sdkinterfaces.MessageTypeUserDefined,
+		Metadata: interfaces.Metadata{
+			Type: interfaces.AppSpecificMessageTypeStatistical,
+		},
+		Statistical: interfaces.Data{
+			Type:     interfaces.UserStatisticalTypeCooccurrence,
+			Category: msg.Statistical.Category,
+			Insights: msg.Statistical.Insights,
+			Related:  related,
+		},
+	}
+
+	h.publishStatistical(conversationId, label, cooccurrenceMsg)
+}
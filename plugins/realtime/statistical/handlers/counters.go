@@ -0,0 +1,626 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	klog "k8s.io/klog/v2"
+
+	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
+
+	insight "github.com/dvonthenen/enterprise-conversation-plugins/pkg/insight"
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
+)
+
+const (
+	// the sync queries return every mention created in ($since, $until] as
+	// [key, conversation, userId, name, email, created]
+	topicSync string = `
+		MATCH (t:Topic)-[x:TOPIC_MESSAGE_REF]-(m:Message)
+		WHERE x.created > $since AND x.created <= $until
+		OPTIONAL MATCH (m)-[:SPOKE]-(u:User)
+		RETURN x.value, x.#conversation_index#, u.userId, u.name, u.email, x.created`
+
+	trackerSync string = `
+		MATCH (t:Tracker)-[x:TRACKER_MESSAGE_REF]-(m:Message)
+		WHERE x.created > $since AND x.created <= $until
+		OPTIONAL MATCH (m)-[:SPOKE]-(u:User)
+		RETURN t.name, x.#conversation_index#, u.userId, u.name, u.email, x.created`
+
+	entitySync string = `
+		MATCH (e:Entity)-[x:ENTITY_MESSAGE_REF]-(m:Message)
+		WHERE x.created > $since AND x.created <= $until
+		OPTIONAL MATCH (m)-[:SPOKE]-(u:User)
+		RETURN e.category + '/' + e.type + '/' + e.subType + '/' + x.value, x.#conversation_index#, u.userId, u.name, u.email, x.created`
+
+	insightSync string = `
+		MATCH (m:Insight)-[x:SPOKE]-(u:User)
+		WHERE x.created > $since AND x.created <= $until
+		RETURN m.type + '/' + m.content, x.#conversation_index#, u.userId, u.name, u.email, x.created`
+
+	// counterSettleDelay mentions this recent may not be committed yet, they are loaded by the
+	// next sync instead
+	counterSettleDelay time.Duration = 30 * time.Second
+)
+
+func newCounterStore(bucket time.Duration) *counterStore {
+	return &counterStore{
+		bucket:        bucket,
+		keys:          make(map[string]map[int64]map[string]*conversationCount),
+		conversations: make(map[string]map[string]int64),
+		speakers:      make(map[string]speakerInfo),
+		live:          make(map[string]time.Time),
+		recorded:      make(map[string]map[string]bool),
+	}
+}
+
+// counterKey counters for all categories share a store, so the key is prefixed by the category
+func counterKey(category, correlation string) string {
+	return fmt.Sprintf("%s|%s", category, correlation)
+}
+
+// splitCounterKey returns the category and the correlation of a counter key
+func splitCounterKey(key string) (string, string) {
+	parts := strings.SplitN(key, "|", 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
+
+// speakerKey the Symbl participant ID and the userId stored by the dataminer are not the same
+// value, so speakers are identified by their email and only fall back to the ID without one.
+// The stats queries use the same key, see speakerKeyExpr.
+func speakerKey(id, email string) string {
+	if email != "" {
+		return strings.ToLower(email)
+	}
+	return id
+}
+
+func (cs *counterStore) bucketStart(index int64) time.Time {
+	return time.Unix(0, index*int64(cs.bucket))
+}
+
+// markLive counts the conversation as it happens from now on
+func (cs *counterStore) markLive(conversationId string, now time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.live[conversationId] = now
+}
+
+// record counts a mention of the correlation key. Mentions loaded from the database are
+// skipped for the conversations counted live, otherwise they would be counted twice. Live
+// mentions are counted once per message or insight ID.
+func (cs *counterStore) record(key, conversationId, mentionId string, speaker speakerInfo, created time.Time, stored bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	seen, live := cs.live[conversationId]
+	if live && stored {
+		return
+	}
+	if !stored && (!live || created.After(seen)) {
+		cs.live[conversationId] = created
+	}
+
+	if mentionId != "" {
+		recorded := cs.recorded[conversationId]
+		if recorded == nil {
+			recorded = make(map[string]bool)
+			cs.recorded[conversationId] = recorded
+		}
+		id := fmt.Sprintf("%s|%s", key, mentionId)
+		if recorded[id] {
+			return
+		}
+		recorded[id] = true
+	}
+
+	buckets := cs.keys[key]
+	if buckets == nil {
+		buckets = make(map[int64]map[string]*conversationCount)
+		cs.keys[key] = buckets
+	}
+
+	index := created.UnixNano() / int64(cs.bucket)
+	conversations := buckets[index]
+	if conversations == nil {
+		conversations = make(map[string]*conversationCount)
+		buckets[index] = conversations
+	}
+
+	count := conversations[conversationId]
+	if count == nil {
+		count = &conversationCount{
+			speakers: make(map[string]int64),
+		}
+		conversations[conversationId] = count
+	}
+
+	count.count++
+	if id := speakerKey(speaker.id, speaker.email); id != "" {
+		count.speakers[id]++
+		if _, ok := cs.speakers[id]; !ok {
+			cs.speakers[id] = speaker
+		}
+	}
+
+	mentioned := cs.conversations[conversationId]
+	if mentioned == nil {
+		mentioned = make(map[string]int64)
+		cs.conversations[conversationId] = mentioned
+	}
+	if index > mentioned[key] {
+		mentioned[key] = index
+	}
+}
+
+// windowCounts answers the same counts as the window query for a single key. Buckets which
+// overlap the start of a window are counted, so windows are accurate to the bucket size.
+func (cs *counterStore) windowCounts(key, conversationId string, windows []statWindow, now time.Time) map[string]windowCount {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	counts := make(map[string]windowCount)
+	for _, window := range windows {
+		since := window.since(now)
+		conversations := make(map[string]bool)
+		speakers := make(map[string]bool)
+
+		var total int64
+		for index, byConversation := range cs.keys[key] {
+			if cs.bucketStart(index + 1).Before(since) {
+				continue
+			}
+
+			for curConversationId, count := range byConversation {
+				if curConversationId == conversationId {
+					continue
+				}
+
+				total += count.count
+				conversations[curConversationId] = true
+				for speaker := range count.speakers {
+					speakers[speaker] = true
+				}
+			}
+		}
+
+		counts[window.name] = windowCount{
+			count:         total,
+			conversations: int64(len(conversations)),
+			speakers:      int64(len(speakers)),
+		}
+	}
+
+	return counts
+}
+
+// histograms answers the same buckets as the histogram query for a single key, accurate to
+// the counter bucket size
+func (cs *counterStore) histograms(key, conversationId string, histograms []HistogramConfig, now time.Time) []interfaces.Histogram {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	result := make([]interfaces.Histogram, 0, len(histograms))
+	for _, hc := range histograms {
+		since := now.Add(-time.Duration(hc.window.seconds) * time.Second)
+		bucketSize := time.Duration(hc.bucket.seconds) * time.Second
+
+		// oldest bucket first which is the order charts are drawn in
+		counts := make([]int64, hc.buckets())
+		for index, byConversation := range cs.keys[key] {
+			if cs.bucketStart(index + 1).Before(since) {
+				continue
+			}
+
+			bucket := int(now.Sub(cs.bucketStart(index)) / bucketSize)
+			if bucket < 0 {
+				bucket = 0
+			}
+			if bucket >= len(counts) {
+				bucket = len(counts) - 1
+			}
+
+			for curConversationId, count := range byConversation {
+				if curConversationId != conversationId {
+					counts[len(counts)-1-bucket] += count.count
+				}
+			}
+		}
+
+		result = append(result, interfaces.Histogram{
+			Window: hc.window.name,
+			Bucket: hc.bucket.name,
+			Counts: counts,
+		})
+	}
+
+	return result
+}
+
+// topSpeakers answers the same speakers as the speaker query for a single key. Speakers are
+// ranked by their most mentions in any of the queried windows and reported for the windows.
+func (cs *counterStore) topSpeakers(key, conversationId string, queryWindows, windows []statWindow, limit int, now time.Time) []interfaces.Speaker {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	bySpeaker := make(map[string]map[string]int64)
+	most := make(map[string]int64)
+	for _, window := range queryWindows {
+		since := window.since(now)
+		for index, byConversation := range cs.keys[key] {
+			if cs.bucketStart(index + 1).Before(since) {
+				continue
+			}
+
+			for curConversationId, count := range byConversation {
+				if curConversationId == conversationId {
+					continue
+				}
+
+				for speaker, mentions := range count.speakers {
+					if bySpeaker[speaker] == nil {
+						bySpeaker[speaker] = make(map[string]int64)
+					}
+					bySpeaker[speaker][window.name] += mentions
+				}
+			}
+		}
+	}
+
+	ranked := make([]string, 0, len(bySpeaker))
+	for speaker, counts := range bySpeaker {
+		for _, count := range counts {
+			if count > most[speaker] {
+				most[speaker] = count
+			}
+		}
+		ranked = append(ranked, speaker)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if most[ranked[i]] != most[ranked[j]] {
+			return most[ranked[i]] > most[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+
+	speakers := make([]interfaces.Speaker, 0, len(ranked))
+	for _, key := range ranked {
+		info := cs.speakers[key]
+		speaker := interfaces.Speaker{
+			ID:     info.id,
+			Name:   info.name,
+			Email:  info.email,
+			Counts: make([]interfaces.WindowCount, 0, len(windows)),
+		}
+		for _, window := range windows {
+			speaker.Counts = append(speaker.Counts, interfaces.WindowCount{
+				Window: window.name,
+				Count:  bySpeaker[key][window.name],
+			})
+		}
+		speakers = append(speakers, speaker)
+	}
+
+	return speakers
+}
+
+// related answers the same correlations as the co-occurrence query for a single key, the
+// other topics, trackers and entities of the prior conversations the key was mentioned in
+// since the start of the window
+func (cs *counterStore) related(key, conversationId string, since time.Time, maxResults int) []interfaces.Related {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	conversations := make(map[string]bool)
+	for index, byConversation := range cs.keys[key] {
+		if cs.bucketStart(index + 1).Before(since) {
+			continue
+		}
+		for curConversationId := range byConversation {
+			if curConversationId != conversationId {
+				conversations[curConversationId] = true
+			}
+		}
+	}
+
+	totals := make(map[string]int64)
+	for curConversationId := range conversations {
+		for otherKey := range cs.conversations[curConversationId] {
+			category, _ := splitCounterKey(otherKey)
+			if otherKey == key || category == interfaces.StatisticalCategoryInsight {
+				continue
+			}
+			totals[otherKey]++
+		}
+	}
+
+	ranked := make([]string, 0, len(totals))
+	for otherKey := range totals {
+		ranked = append(ranked, otherKey)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if totals[ranked[i]] != totals[ranked[j]] {
+			return totals[ranked[i]] > totals[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+	if len(ranked) > maxResults {
+		ranked = ranked[:maxResults]
+	}
+
+	related := make([]interfaces.Related, 0, len(ranked))
+	for _, otherKey := range ranked {
+		category, correlation := splitCounterKey(otherKey)
+		related = append(related, interfaces.Related{
+			Category:      category,
+			Correlation:   correlation,
+			Conversations: totals[otherKey],
+		})
+	}
+
+	return related
+}
+
+// prune forgets the mentions and live conversations older than the horizon
+func (cs *counterStore) prune(horizon time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for key, buckets := range cs.keys {
+		for index := range buckets {
+			if cs.bucketStart(index + 1).Before(horizon) {
+				delete(buckets, index)
+			}
+		}
+		if len(buckets) == 0 {
+			delete(cs.keys, key)
+		}
+	}
+
+	for conversationId, mentioned := range cs.conversations {
+		for key, index := range mentioned {
+			if cs.bucketStart(index + 1).Before(horizon) {
+				delete(mentioned, key)
+			}
+		}
+		if len(mentioned) == 0 {
+			delete(cs.conversations, conversationId)
+		}
+	}
+
+	for conversationId, seen := range cs.live {
+		if seen.Before(horizon) {
+			delete(cs.live, conversationId)
+			delete(cs.recorded, conversationId)
+		}
+	}
+}
+
+// counterLookup answers the counts, histograms, top speakers and co-occurrence from the
+// counters once they have been loaded. Returns nil when they need to be queried from the
+// database.
+func (h *Handler) counterLookup(category, conversationId string, lookups []map[string]any) *lookupStats {
+	if h.counters == nil {
+		return nil
+	}
+
+	h.counters.mu.RLock()
+	ready := h.counters.ready
+	h.counters.mu.RUnlock()
+	if !ready {
+		return nil
+	}
+
+	now := h.config.now()
+	stats := &lookupStats{
+		counts:     make(map[string]map[string]windowCount),
+		histograms: make(map[string][]interfaces.Histogram),
+		speakers:   make(map[string][]interfaces.Speaker),
+		related:    make(map[string][]interfaces.Related),
+	}
+	for _, lookup := range lookups {
+		correlation := recordString(lookup["key"])
+		key := counterKey(category, correlation)
+
+		stats.counts[correlation] = h.counters.windowCounts(key, conversationId, h.config.queryWindows, now)
+		if len(h.config.Histograms) > 0 {
+			stats.histograms[correlation] = h.counters.histograms(key, conversationId, h.config.Histograms, now)
+		}
+		if h.config.TopSpeakers > 0 {
+			stats.speakers[correlation] = h.counters.topSpeakers(key, conversationId, h.config.queryWindows, h.config.windows, h.config.TopSpeakers, now)
+		}
+		if h.config.Cooccurrence.Enabled && category != interfaces.StatisticalCategoryInsight {
+			stats.related[correlation] = h.counters.related(key, conversationId, h.config.Cooccurrence.window.since(now), h.config.Cooccurrence.MaxResults)
+		}
+	}
+
+	return stats
+}
+
+// markLive counts the conversation from the messages this instance handles
+func (h *Handler) markLive(conversationId string) {
+	if h.counters == nil {
+		return
+	}
+	h.counters.markLive(conversationId, h.config.now())
+}
+
+// recordMention updates the counters with a mention in the current conversation, mentionId is
+// the message or insight the correlation was found in
+func (h *Handler) recordMention(category, correlation, conversationId, mentionId string, speaker speakerInfo) {
+	if h.counters == nil {
+		return
+	}
+
+	now := h.config.now()
+	if !h.config.BusinessHours.contains(now) {
+		return
+	}
+
+	h.counters.record(counterKey(category, correlation), conversationId, mentionId, speaker, now, false)
+}
+
+// runCounters loads the counters from the database and then periodically loads the mentions
+// stored since the previous sync by conversations other instances handled
+func (h *Handler) runCounters() {
+	defer h.countersWg.Done()
+
+	h.syncCounters()
+
+	ticker := time.NewTicker(h.config.Counters.reconcile)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stopCounters:
+			return
+		case <-ticker.C:
+			h.syncCounters()
+		}
+	}
+}
+
+func (h *Handler) syncCounters() {
+	ctx := context.Background()
+
+	now := h.config.now()
+	horizon := h.counterHorizon(now)
+	until := now.Add(-counterSettleDelay)
+
+	h.counters.mu.RLock()
+	since := h.counters.synced
+	ready := h.counters.ready
+	h.counters.mu.RUnlock()
+	if !ready || since.Before(horizon) {
+		since = horizon
+	}
+
+	count, err := h.loadMentions(ctx, since, until)
+	if err != nil {
+		klog.V(1).Infof("loadMentions failed. Err: %v\n", err)
+		return
+	}
+
+	h.counters.mu.Lock()
+	h.counters.synced = until
+	h.counters.ready = true
+	h.counters.mu.Unlock()
+
+	h.counters.prune(horizon)
+
+	klog.V(3).Infof("Counters synced with %d mentions since %v\n", count, since)
+}
+
+// counterHorizon the start of the longest window answered from the counters
+func (h *Handler) counterHorizon(now time.Time) time.Time {
+	horizon := now
+	for _, window := range h.config.queryWindows {
+		if since := window.since(now); since.Before(horizon) {
+			horizon = since
+		}
+	}
+	for _, hc := range h.config.Histograms {
+		if since := now.Add(-time.Duration(hc.window.seconds) * time.Second); since.Before(horizon) {
+			horizon = since
+		}
+	}
+	if h.config.Cooccurrence.Enabled {
+		if since := h.config.Cooccurrence.window.since(now); since.Before(horizon) {
+			horizon = since
+		}
+	}
+	return horizon
+}
+
+// loadMentions adds every mention created in (since, until] to the counters and returns the
+// number of mentions read. The mentions are only added once every query has succeeded, so a
+// failed sync can be retried from the same point without counting anything twice.
+func (h *Handler) loadMentions(ctx context.Context, since, until time.Time) (int, error) {
+	syncs := []struct {
+		category string
+		query    string
+		keyFn    func(string) string
+	}{
+		{category: interfaces.StatisticalCategoryTopic, query: topicSync, keyFn: strings.ToLower},
+		{category: interfaces.StatisticalCategoryTracker, query: trackerSync, keyFn: strings.ToLower},
+		{category: interfaces.StatisticalCategoryEntity, query: entitySync, keyFn: strings.ToLower},
+		{category: interfaces.StatisticalCategoryInsight, query: insightSync, keyFn: normalizeInsightKey},
+	}
+
+	session := h.newSession(ctx, neo4j.AccessModeRead)
+	defer session.Close(ctx)
+
+	mentions := make([]storedMention, 0)
+	for _, curSync := range syncs {
+		// the transaction function may be retried, so it only returns the rows it read
+		rows, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+			myQuery := utils.ReplaceIndexes(curSync.query)
+			result, err := tx.Run(ctx, myQuery, map[string]any{
+				"since": since,
+				"until": until,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			rows := make([]storedMention, 0)
+			for result.Next(ctx) {
+				values := result.Record().Values
+				created, ok := values[5].(time.Time)
+				if !ok || !h.config.BusinessHours.contains(created.In(h.config.location)) {
+					continue
+				}
+
+				rows = append(rows, storedMention{
+					key:            counterKey(curSync.category, curSync.keyFn(recordString(values[0]))),
+					conversationId: recordString(values[1]),
+					speaker: speakerInfo{
+						id:    recordString(values[2]),
+						name:  recordString(values[3]),
+						email: recordString(values[4]),
+					},
+					created: created,
+				})
+			}
+
+			return rows, result.Err()
+		})
+		if err != nil {
+			klog.V(1).Infof("[%s] Sync ExecuteRead failed. Err: %v\n", curSync.category, err)
+			return 0, err
+		}
+
+		if curRows, ok := rows.([]storedMention); ok {
+			mentions = append(mentions, curRows...)
+		}
+	}
+
+	for _, mention := range mentions {
+		h.counters.record(mention.key, mention.conversationId, "", mention.speaker, mention.created, true)
+	}
+
+	return len(mentions), nil
+}
+
+// normalizeInsightKey converts "type/content" into the insight correlation
+func normalizeInsightKey(value string) string {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return insight.Correlation(parts[0], insight.Normalize(parts[1]))
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
+)
+
+func newCountersConfig(t *testing.T) *Config {
+	config := &Config{
+		Windows:      []string{"1h", "1d"},
+		TopSpeakers:  2,
+		Histograms:   []HistogramConfig{{Window: "1h", Bucket: "15m"}},
+		Cooccurrence: CooccurrenceConfig{Enabled: true, Window: "1d"},
+		Counters:     CountersConfig{Enabled: true},
+	}
+	config.setDefaults()
+	if err := config.parse(); err != nil {
+		t.Fatalf("parse failed. Err: %v", err)
+	}
+	return config
+}
+
+func newCountersHandler(t *testing.T, driver *neo4j.DriverWithContext) *Handler {
+	h := newStatsHandler(driver, newCountersConfig(t))
+	h.counters = newCounterStore(h.config.Counters.bucket)
+	return h
+}
+
+func TestCounterStoreSkipsStoredLiveMentions(t *testing.T) {
+	now := time.Now()
+	cs := newCounterStore(time.Minute)
+	cs.markLive("conversation-1", now.Add(-time.Hour))
+
+	cs.record("topic|pricing", "conversation-1", "", speakerInfo{id: "u-1"}, now.Add(-time.Minute), true)
+	cs.record("topic|pricing", "conversation-1", "message-1", speakerInfo{id: "u-1"}, now.Add(-time.Minute), false)
+	cs.record("topic|pricing", "conversation-2", "", speakerInfo{id: "u-2"}, now.Add(-time.Minute), true)
+
+	counts := cs.windowCounts("topic|pricing", "conversation-3", []statWindow{{name: "1h", seconds: 3600}}, now)
+	if got := counts["1h"]; got.count != 2 || got.conversations != 2 || got.speakers != 2 {
+		t.Errorf("counts = %+v, want 2 mentions in 2 conversations by 2 speakers", got)
+	}
+}
+
+func TestCounterStoreSpeakerKey(t *testing.T) {
+	now := time.Now()
+	cs := newCounterStore(time.Minute)
+
+	// the same person loaded from the database and counted live
+	cs.record("topic|pricing", "conversation-1", "", speakerInfo{id: "user-1", name: "Ann", email: "ann@example.com"}, now.Add(-2*time.Minute), true)
+	cs.record("topic|pricing", "conversation-2", "message-1", speakerInfo{id: "participant-9", name: "Ann", email: "Ann@Example.com"}, now.Add(-time.Minute), false)
+
+	counts := cs.windowCounts("topic|pricing", "conversation-3", []statWindow{{name: "1h", seconds: 3600}}, now)
+	if got := counts["1h"].speakers; got != 1 {
+		t.Errorf("speakers = %d, want 1", got)
+	}
+
+	windows := []statWindow{{name: "1h", seconds: 3600}}
+	speakers := cs.topSpeakers("topic|pricing", "conversation-3", windows, windows, 5, now)
+	if len(speakers) != 1 || speakers[0].ID != "user-1" || speakers[0].Counts[0].Count != 2 {
+		t.Errorf("speakers = %+v, want user-1 with 2 mentions", speakers)
+	}
+}
+
+func TestCounterStorePrune(t *testing.T) {
+	now := time.Now()
+	cs := newCounterStore(time.Minute)
+	cs.markLive("conversation-1", now.Add(-3*time.Hour))
+	cs.record("topic|pricing", "conversation-2", "", speakerInfo{id: "u-1"}, now.Add(-2*time.Hour), true)
+	cs.record("topic|renewal", "conversation-2", "", speakerInfo{id: "u-1"}, now.Add(-time.Minute), true)
+
+	cs.prune(now.Add(-time.Hour))
+
+	if _, ok := cs.keys["topic|pricing"]; ok {
+		t.Errorf("mentions older than the horizon were kept")
+	}
+	if _, ok := cs.conversations["conversation-2"]["topic|pricing"]; ok {
+		t.Errorf("co-occurrence older than the horizon was kept")
+	}
+	if _, ok := cs.keys["topic|renewal"]; !ok {
+		t.Errorf("mentions within the horizon were pruned")
+	}
+	if _, ok := cs.live["conversation-1"]; ok {
+		t.Errorf("live conversation older than the horizon was kept")
+	}
+}
+
+func TestSyncCountersIsIncremental(t *testing.T) {
+	created := time.Now().Add(-10 * time.Minute)
+	fake, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		if !strings.Contains(cypher, "TOPIC_MESSAGE_REF") {
+			return nil
+		}
+		since, _ := params["since"].(time.Time)
+		if !created.After(since) {
+			return nil
+		}
+		return []*neo4j.Record{
+			{Values: []any{"Pricing", "conversation-2", "user-1", "Ann", "ann@example.com", created}},
+			{Values: []any{"Pricing", "conversation-1", "user-2", "Bob", "bob@example.com", created}},
+		}
+	})
+	h := newCountersHandler(t, driver)
+	h.markLive("conversation-1")
+
+	h.syncCounters()
+	first := fake.queriesMatching("TOPIC_MESSAGE_REF")
+	if len(first) != 1 {
+		t.Fatalf("topic sync queries = %d, want 1", len(first))
+	}
+	if since := first[0].params["since"].(time.Time); time.Since(since) < 24*time.Hour {
+		t.Errorf("first sync since %v, want the start of the longest window", since)
+	}
+
+	h.syncCounters()
+	second := fake.queriesMatching("TOPIC_MESSAGE_REF")
+	if len(second) != 2 {
+		t.Fatalf("topic sync queries = %d, want 2", len(second))
+	}
+	if since, until := second[1].params["since"].(time.Time), first[0].params["until"].(time.Time); !since.Equal(until) {
+		t.Errorf("second sync since %v, want the end of the first sync %v", since, until)
+	}
+
+	// conversation-1 is counted live so its stored mention is skipped
+	counts := h.counters.windowCounts(counterKey(interfaces.StatisticalCategoryTopic, "pricing"), "conversation-3", h.config.queryWindows, h.config.now())
+	if got := counts["1h"]; got.count != 1 || got.conversations != 1 {
+		t.Errorf("counts = %+v, want the single mention in conversation-2", got)
+	}
+}
+
+func TestCounterLookupAnswersFromMemory(t *testing.T) {
+	fake, driver := newFakeDriver(0, nil)
+	h := newCountersHandler(t, driver)
+	h.syncCounters()
+
+	now := h.config.now()
+	ann := speakerInfo{id: "user-1", name: "Ann", email: "ann@example.com"}
+	bob := speakerInfo{id: "user-2", name: "Bob", email: "bob@example.com"}
+	h.counters.record(counterKey(interfaces.StatisticalCategoryTopic, "pricing"), "conversation-2", "", ann, now.Add(-5*time.Minute), true)
+	h.counters.record(counterKey(interfaces.StatisticalCategoryTopic, "pricing"), "conversation-2", "", ann, now.Add(-20*time.Minute), true)
+	h.counters.record(counterKey(interfaces.StatisticalCategoryTopic, "pricing"), "conversation-3", "", bob, now.Add(-50*time.Minute), true)
+	h.counters.record(counterKey(interfaces.StatisticalCategoryTracker, "discount"), "conversation-2", "", bob, now.Add(-5*time.Minute), true)
+	h.counters.record(counterKey(interfaces.StatisticalCategoryInsight, "question/what is the price"), "conversation-2", "", bob, now.Add(-5*time.Minute), true)
+	queries := len(fake.queriesMatching(""))
+
+	lookups := []map[string]any{{"key": "pricing"}}
+	stats := h.lookupStats(context.Background(), interfaces.StatisticalCategoryTopic, topicMatch, "conversation-1", lookups)
+
+	if got := len(fake.queriesMatching("")); got != queries {
+		t.Errorf("lookupStats sent %d queries, want none", got-queries)
+	}
+	if got := stats.counts["pricing"]["1h"]; got.count != 3 || got.conversations != 2 || got.speakers != 2 {
+		t.Errorf("counts = %+v, want 3 mentions in 2 conversations by 2 speakers", got)
+	}
+	if got := stats.histograms["pricing"]; len(got) != 1 || len(got[0].Counts) != 4 || got[0].Counts[3] != 1 || got[0].Counts[2] != 1 || got[0].Counts[0] != 1 {
+		t.Errorf("histograms = %+v, want one mention in the 1st, 2nd and 4th of 4 buckets", got)
+	}
+	if got := stats.speakers["pricing"]; len(got) != 2 || got[0].ID != "user-1" || got[1].ID != "user-2" {
+		t.Errorf("speakers = %+v, want user-1 then user-2", got)
+	}
+	if got := stats.related["pricing"]; len(got) != 1 || got[0].Category != interfaces.StatisticalCategoryTracker || got[0].Correlation != "discount" || got[0].Conversations != 1 {
+		t.Errorf("related = %+v, want the discount tracker", got)
+	}
+}
+
+func TestCounterLookupWaitsForSync(t *testing.T) {
+	_, driver := newFakeDriver(0, nil)
+	h := newCountersHandler(t, driver)
+
+	if stats := h.counterLookup(interfaces.StatisticalCategoryTopic, "conversation-1", []map[string]any{{"key": "pricing"}}); stats != nil {
+		t.Errorf("counterLookup answered before the counters were loaded")
+	}
+}
+
+func TestRecordMentionCountsEachMessageOnce(t *testing.T) {
+	_, driver := newFakeDriver(0, nil)
+	h := newCountersHandler(t, driver)
+	h.syncCounters()
+
+	// Symbl repeats the message references every time the topic is updated
+	for _, messageId := range []string{"message-1", "message-1", "message-2", "message-1"} {
+		h.recordMention(interfaces.StatisticalCategoryTopic, "pricing", "conversation-2", messageId, speakerInfo{id: "user-1"})
+	}
+	// the same message can mention other correlations
+	h.recordMention(interfaces.StatisticalCategoryTopic, "renewal", "conversation-2", "message-1", speakerInfo{id: "user-1"})
+
+	for key, want := range map[string]int64{"pricing": 2, "renewal": 1} {
+		counts := h.counters.windowCounts(counterKey(interfaces.StatisticalCategoryTopic, key), "conversation-1", h.config.queryWindows, h.config.now())
+		if got := counts["1h"].count; got != want {
+			t.Errorf("%s count = %d, want %d", key, got, want)
+		}
+	}
+
+	h.counters.prune(h.config.now().Add(time.Hour))
+	if len(h.counters.recorded) != 0 {
+		t.Errorf("recorded mentions = %v, want them pruned with the live conversation", h.counters.recorded)
+	}
+}
+
+func TestSyncCountersFailureAddsNothing(t *testing.T) {
+	created := time.Now().Add(-10 * time.Minute)
+	fake, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		if !strings.Contains(cypher, "TOPIC_MESSAGE_REF") {
+			return nil
+		}
+		return []*neo4j.Record{
+			{Values: []any{"Pricing", "conversation-2", "user-1", "Ann", "ann@example.com", created}},
+		}
+	})
+	h := newCountersHandler(t, driver)
+
+	// the topics are read before the insight query fails
+	fake.err = errors.New("connection reset")
+	fake.failOn = "(m:Insight)"
+	h.syncCounters()
+
+	if len(h.counters.keys) != 0 || h.counters.ready {
+		t.Fatalf("keys = %v, ready = %v, want nothing added by the failed sync", h.counters.keys, h.counters.ready)
+	}
+
+	fake.err = nil
+	h.syncCounters()
+
+	counts := h.counters.windowCounts(counterKey(interfaces.StatisticalCategoryTopic, "pricing"), "conversation-1", h.config.queryWindows, h.config.now())
+	if got := counts["1h"].count; got != 1 {
+		t.Errorf("count = %d, want the mention counted once", got)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+/*
+	Local stand-in for Neo4j. Every query costs one simulated round trip and is answered by the
+	responder, which lets tests check the queries and parameters sent and benchmarks compare the
+	number of round trips. When err is set the queries containing failOn, or every query when
+	failOn is empty, fail with it. The embedded interfaces are never called, they only satisfy
+	the unexported methods of the driver interfaces.
+*/
+type fakeDriver struct {
+	neo4j.DriverWithContext
+
+	latency   time.Duration
+	responder func(cypher string, params map[string]any) []*neo4j.Record
+	err       error
+	failOn    string
+
+	mu      sync.Mutex
+	queries []fakeQuery
+}
+
+type fakeQuery struct {
+	cypher string
+	params map[string]any
+}
+
+type fakeSession struct {
+	neo4j.SessionWithContext
+	driver *fakeDriver
+}
+
+type fakeTransaction struct {
+	neo4j.ManagedTransaction
+	driver *fakeDriver
+}
+
+type fakeResult struct {
+	neo4j.ResultWithContext
+	records []*neo4j.Record
+	current *neo4j.Record
+}
+
+// newFakeDriver returns a handler driver backed by the stand-in
+func newFakeDriver(latency time.Duration, responder func(cypher string, params map[string]any) []*neo4j.Record) (*fakeDriver, *neo4j.DriverWithContext) {
+	fake := &fakeDriver{
+		latency:   latency,
+		responder: responder,
+	}
+	var driver neo4j.DriverWithContext = fake
+	return fake, &driver
+}
+
+// queriesMatching returns the queries sent which contain the text
+func (fd *fakeDriver) queriesMatching(text string) []fakeQuery {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	matching := make([]fakeQuery, 0)
+	for _, query := range fd.queries {
+		if strings.Contains(query.cypher, text) {
+			matching = append(matching, query)
+		}
+	}
+	return matching
+}
+
+func (fd *fakeDriver) NewSession(ctx context.Context, config neo4j.SessionConfig) neo4j.SessionWithContext {
+	return &fakeSession{driver: fd}
+}
+
+func (fs *fakeSession) ExecuteRead(ctx context.Context, work neo4j.ManagedTransactionWork, configurers ...func(*neo4j.TransactionConfig)) (any, error) {
+	return work(&fakeTransaction{driver: fs.driver})
+}
+
+func (fs *fakeSession) ExecuteWrite(ctx context.Context, work neo4j.ManagedTransactionWork, configurers ...func(*neo4j.TransactionConfig)) (any, error) {
+	return work(&fakeTransaction{driver: fs.driver})
+}
+
+func (fs *fakeSession) Close(ctx context.Context) error {
+	return nil
+}
+
+func (ft *fakeTransaction) Run(ctx context.Context, cypher string, params map[string]any) (neo4j.ResultWithContext, error) {
+	if ft.driver.latency > 0 {
+		time.Sleep(ft.driver.latency)
+	}
+
+	ft.driver.mu.Lock()
+	ft.driver.queries = append(ft.driver.queries, fakeQuery{cypher: cypher, params: params})
+	ft.driver.mu.Unlock()
+
+	if ft.driver.err != nil && strings.Contains(cypher, ft.driver.failOn) {
+		return nil, ft.driver.err
+	}
+
+	var records []*neo4j.Record
+	if ft.driver.responder != nil {
+		records = ft.driver.responder(cypher, params)
+	}
+	return &fakeResult{records: records}, nil
+}
+
+func (fr *fakeResult) Next(ctx context.Context) bool {
+	if len(fr.records) == 0 {
+		fr.current = nil
+		return false
+	}
+	fr.current = fr.records[0]
+	fr.records = fr.records[1:]
+	return true
+}
+
+func (fr *fakeResult) Record() *neo4j.Record {
+	return fr.current
+}
+
+func (fr *fakeResult) Err() error {
+	return nil
+}
+
+func (fr *fakeResult) Consume(ctx context.Context) (neo4j.ResultSummary, error) {
+	return nil, nil
+}
+
+// lookupRows answers a batched lookup with one row per lookup key holding the rows
+func lookupRows(params map[string]any, rows func(lookup map[string]any) []any) []*neo4j.Record {
+	lookups, _ := params["lookups"].([]map[string]any)
+
+	records := make([]*neo4j.Record, 0, len(lookups))
+	for _, lookup := range lookups {
+		records = append(records, &neo4j.Record{
+			Keys:   []string{"key", "rows"},
+			Values: []any{lookup["key"], rows(lookup)},
+		})
+	}
+	return records
+}
@@ -6,7 +6,6 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"strings"
 
 	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
@@ -17,18 +16,60 @@ import (
 	shared "github.com/dvonthenen/enterprise-conversation-application/pkg/shared"
 	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
 
+	insight "github.com/dvonthenen/enterprise-conversation-plugins/pkg/insight"
+	workerpool "github.com/dvonthenen/enterprise-conversation-plugins/pkg/workerpool"
 	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
 )
 
 func NewHandler(options HandlerOptions) *Handler {
 	handler := Handler{
-		session:     options.Session,
+		driver:      options.Driver,
 		symblClient: options.SymblClient,
+		config:      options.Config,
+		pool:        workerpool.New(options.Workers, options.QueueDepth),
 		cache:       make(map[string]*utils.MessageCache),
 	}
+	if handler.config == nil {
+		handler.config = DefaultConfig()
+	}
+	if handler.driver != nil {
+		handler.pendingInsights = insight.NewPending(handler.newSession)
+
+		var ctx context.Context
+		ctx, handler.cancel = context.WithCancel(context.Background())
+		handler.background.Add(1)
+		go func() {
+			defer handler.background.Done()
+			handler.pendingInsights.Prepare(ctx)
+		}()
+	} else {
+		handler.pendingInsights = insight.NewPending(nil)
+	}
+	if handler.config.Counters.Enabled && handler.driver != nil {
+		handler.counters = newCounterStore(handler.config.Counters.bucket)
+		handler.stopCounters = make(chan struct{})
+		handler.countersWg.Add(1)
+		go handler.runCounters()
+	}
 	return &handler
 }
 
+// Stop waits for all queued callbacks to be processed
+func (h *Handler) Stop() {
+	h.pool.Stop()
+
+	if h.cancel != nil {
+		h.cancel()
+	}
+	h.background.Wait()
+
+	if h.stopCounters != nil {
+		close(h.stopCounters)
+		h.countersWg.Wait()
+		h.stopCounters = nil
+	}
+}
+
 func (h *Handler) SetClientPublisher(mp *interfacessdk.MessagePublisher) {
 	klog.V(4).Infof("SetClientPublisher called...\n")
 	h.msgPublisher = mp
@@ -36,9 +77,16 @@ func (h *Handler) SetClientPublisher(mp *interfacessdk.MessagePublisher) {
 
 func (h *Handler) InitializedConversation(im *shared.InitializationResponse) error {
 	conversationId := im.InitializationMessage.Message.Data.ConversationID
-	klog.V(2).Infof("InitializedConversation - conversationID: %s\n", conversationId)
-	h.cache[conversationId] = utils.NewMessageCache()
-	return nil
+	return h.dispatch(conversationId, "InitializedConversation", func() error {
+		klog.V(2).Infof("InitializedConversation - conversationID: %s\n", conversationId)
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.cache[conversationId] = utils.NewMessageCache()
+		h.markLive(conversationId)
+		return nil
+	})
 }
 
 func (h *Handler) RecognitionResultMessage(rr *shared.RecognitionResponse) error {
@@ -47,124 +95,250 @@ func (h *Handler) RecognitionResultMessage(rr *shared.RecognitionResponse) error
 }
 
 func (h *Handler) MessageResponseMessage(mr *shared.MessageResponse) error {
-	cache := h.cache[mr.ConversationID]
-	if cache != nil {
-		for _, msg := range mr.MessageResponse.Messages {
-			cache.Push(msg.ID, msg.Payload.Content, msg.From.ID, msg.From.Name, msg.From.UserID)
+	return h.dispatch(mr.ConversationID, "MessageResponseMessage", func() error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		cache := h.cache[mr.ConversationID]
+		if cache != nil {
+			for _, msg := range mr.MessageResponse.Messages {
+				cache.Push(msg.ID, msg.Payload.Content, msg.From.ID, msg.From.Name, msg.From.UserID)
+			}
+		} else {
+			klog.V(1).Infof("MessageCache for ConversationID(%s) not found.", mr.ConversationID)
 		}
-	} else {
-		klog.V(1).Infof("MessageCache for ConversationID(%s) not found.", mr.ConversationID)
-	}
 
-	return nil
+		return nil
+	})
 }
 
 func (h *Handler) InsightResponseMessage(ir *shared.InsightResponse) error {
+	return h.dispatch(ir.ConversationID, "InsightResponseMessage", func() error {
+		return h.processInsightResponse(ir)
+	})
+}
+
+func (h *Handler) TopicResponseMessage(tr *shared.TopicResponse) error {
+	return h.dispatch(tr.ConversationID, "TopicResponseMessage", func() error {
+		return h.processTopicResponse(tr)
+	})
+}
+
+func (h *Handler) TrackerResponseMessage(tr *shared.TrackerResponse) error {
+	return h.dispatch(tr.ConversationID, "TrackerResponseMessage", func() error {
+		return h.processTrackerResponse(tr)
+	})
+}
+
+func (h *Handler) EntityResponseMessage(er *shared.EntityResponse) error {
+	return h.dispatch(er.ConversationID, "EntityResponseMessage", func() error {
+		return h.processEntityResponse(er)
+	})
+}
+
+func (h *Handler) TeardownConversation(tm *shared.TeardownResponse) error {
+	conversationId := tm.TeardownMessage.Message.Data.ConversationID
+	return h.dispatch(conversationId, "TeardownConversation", func() error {
+		klog.V(2).Infof("TeardownConversation - conversationID: %s\n", conversationId)
+
+		err := h.pendingInsights.Flush(context.Background(), conversationId)
+		if err != nil {
+			klog.V(1).Infof("pendingInsights.Flush failed. Err: %v\n", err)
+		}
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.cache, conversationId)
+		return err
+	})
+}
+
+func (h *Handler) UserDefinedMessage(data []byte) error {
 	// No implementation required. Return Succeess!
 	return nil
 }
 
-func (h *Handler) TopicResponseMessage(tr *shared.TopicResponse) error {
-	for _, curTopic := range tr.TopicResponse.Topics {
+func (h *Handler) UnhandledMessage(byMsg []byte) error {
+	klog.Errorf("\n\n-------------------------------\n")
+	klog.Errorf("UnhandledMessage:\n%v\n", string(byMsg))
+	klog.Errorf("-------------------------------\n\n")
+	return ErrUnhandledMessage
+}
 
-		last30Mins := h.topicStats(tr.ConversationID, &curTopic, StatType30Mins)
-		lastHour := h.topicStats(tr.ConversationID, &curTopic, StatType1Hour)
-		last4Hours := h.topicStats(tr.ConversationID, &curTopic, StatType4Hours)
-		lastDay := h.topicStats(tr.ConversationID, &curTopic, StatType1Day)
-		last2Days := h.topicStats(tr.ConversationID, &curTopic, StatType2Days)
-		lastWeek := h.topicStats(tr.ConversationID, &curTopic, StatType1Week)
-		lastMonth := h.topicStats(tr.ConversationID, &curTopic, StatType1Month)
+// dispatch queues the callback on the worker which owns the conversation. The SDK delivers the
+// callbacks from a single goroutine, so the work is not waited on and its errors are logged by
+// the worker. Only an error queuing the work is returned.
+func (h *Handler) dispatch(conversationId, callback string, work func() error) error {
+	err := h.pool.Submit(conversationId, func() {
+		err := work()
+		if err != nil {
+			klog.V(1).Infof("%s failed. Err: %v\n", callback, err)
+		}
+	})
+	if err != nil {
+		klog.V(1).Infof("%s submit failed. Err: %v\n", callback, err)
+	}
+	return err
+}
 
-		klog.V(2).Infof("Topic Stats: %s\n", curTopic.Phrases)
-		klog.V(2).Infof("----------------------------------------\n")
-		klog.V(2).Infof("last30Mins: %d\n", last30Mins)
-		klog.V(2).Infof("lastHour: %d\n", lastHour)
-		klog.V(2).Infof("last4Hours: %d\n", last4Hours)
-		klog.V(2).Infof("lastDay: %d\n", lastDay)
-		klog.V(2).Infof("last2Days: %d\n", last2Days)
-		klog.V(2).Infof("lastWeek: %d\n", lastWeek)
-		klog.V(2).Infof("lastMonth: %d\n", lastMonth)
-
-		msg := &interfaces.AppSpecificStatistical{
-			Type: sdkinterfaces.MessageTypeUserDefined,
-			Metadata: interfaces.Metadata{
-				Type: interfaces.AppSpecificMessageTypeStatistical,
-			},
-			Statistical: interfaces.Data{
-				Type:     interfaces.UserStatisticalTypeTopic,
-				Insights: make([]interfaces.Insight, 0),
-				Stats: interfaces.Stats{
-					Last30Mins: last30Mins,
-					LastHour:   lastHour,
-					Last4Hours: last4Hours,
-					LastDay:    lastDay,
-					Last2Days:  last2Days,
-					LastWeek:   lastWeek,
-					LastMonth:  lastMonth,
+// newSession sessions are not goroutine safe, so each unit of work opens its own session from
+// the driver which pools the underlying connections
+func (h *Handler) newSession(ctx context.Context, accessMode neo4j.AccessMode) neo4j.SessionWithContext {
+	return (*h.driver).NewSession(ctx, neo4j.SessionConfig{
+		AccessMode:   accessMode,
+		DatabaseName: "neo4j",
+	})
+}
+
+// publish sends the High-level Application message back to the Dataminer component
+func (h *Handler) publish(conversationId string, data []byte) error {
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+
+	return (*h.msgPublisher).PublishMessage(conversationId, data)
+}
+
+func (h *Handler) publishStatistical(conversationId, label string, msg *interfaces.AppSpecificStatistical) {
+	data, err := json.Marshal(*msg)
+	if err != nil {
+		klog.V(1).Infof("[%s] json.Marshal failed. Err: %v\n", label, err)
+		return
+	}
+
+	err = h.publish(conversationId, data)
+	if err != nil {
+		klog.V(1).Infof("[%s] PublishMessage failed. Err: %v\n", label, err)
+	}
+}
+
+func (h *Handler) processInsightResponse(ir *shared.InsightResponse) error {
+	ctx := context.Background()
+
+	for _, curInsight := range ir.InsightResponse.Insights {
+		h.pendingInsights.Add(ir.ConversationID, curInsight.ID, curInsight.Payload.Content)
+	}
+
+	// build lookups
+	lookups := make([]map[string]any, 0)
+	for _, curInsight := range ir.InsightResponse.Insights {
+		insightText := insight.Normalize(curInsight.Payload.Content)
+		if insightText == "" {
+			klog.V(4).Infof("[Insights] Skipping empty insight ID: %s\n", curInsight.ID)
+			continue
+		}
+
+		lookups = append(lookups, map[string]any{
+			"key":  insight.Correlation(curInsight.Type, insightText),
+			"type": strings.ToLower(curInsight.Type),
+			"text": insightText,
+		})
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
+
+	stats := h.lookupStats(ctx, interfaces.StatisticalCategoryInsight, insightMatch, ir.ConversationID, lookups)
+
+	for _, curInsight := range ir.InsightResponse.Insights {
+		insightText := insight.Normalize(curInsight.Payload.Content)
+		if insightText == "" {
+			continue
+		}
+		correlation := insight.Correlation(curInsight.Type, insightText)
+
+		klog.V(2).Infof("Insight Stats: %s\n", curInsight.Payload.Content)
+		h.logStats(stats.counts[correlation])
+
+		msg := h.newStatisticalMessage(interfaces.UserStatisticalTypeInsight, interfaces.StatisticalCategoryInsight, correlation, stats)
+		msg.Statistical.Insights = append(msg.Statistical.Insights, interfaces.Insight{
+			Correlation: correlation,
+			Messages: []interfaces.Message{
+				interfaces.Message{
+					Text: curInsight.Payload.Content,
 				},
 			},
-		}
+		})
+
+		// send the stat
+		h.publishStatistical(ir.ConversationID, "Insights", msg)
+		h.publishTrend(ir.ConversationID, "Insights", msg, stats.counts[correlation])
+		h.publishCooccurrence(ir.ConversationID, "Insights", msg, stats.related[correlation])
+
+		h.recordMention(interfaces.StatisticalCategoryInsight, correlation, ir.ConversationID, curInsight.ID, speakerInfo{
+			id:    curInsight.From.ID,
+			name:  curInsight.From.Name,
+			email: curInsight.From.UserID,
+		})
+	}
 
+	return nil
+}
+
+func (h *Handler) processTopicResponse(tr *shared.TopicResponse) error {
+	ctx := context.Background()
+
+	// build lookups
+	lookups := make([]map[string]any, 0)
+	for _, curTopic := range tr.TopicResponse.Topics {
+		lookups = append(lookups, map[string]any{
+			"key": strings.ToLower(curTopic.Phrases),
+		})
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
+
+	stats := h.lookupStats(ctx, interfaces.StatisticalCategoryTopic, topicMatch, tr.ConversationID, lookups)
+
+	for _, curTopic := range tr.TopicResponse.Topics {
+		correlation := strings.ToLower(curTopic.Phrases)
+
+		klog.V(2).Infof("Topic Stats: %s\n", curTopic.Phrases)
+		h.logStats(stats.counts[correlation])
+
+		msg := h.newStatisticalMessage(interfaces.UserStatisticalTypeTopic, interfaces.StatisticalCategoryTopic, correlation, stats)
 		msg.Statistical.Insights = append(msg.Statistical.Insights, interfaces.Insight{
-			Correlation: strings.ToLower(curTopic.Phrases),
+			Correlation: correlation,
 			Messages:    h.convertMessageReferenceToSlice(tr.ConversationID, curTopic.MessageReferences),
 		})
 
 		// send the stat
-		data, err := json.Marshal(*msg)
-		if err != nil {
-			klog.V(1).Infof("[Topic] json.Marshal failed. Err: %v\n", err)
-		}
+		h.publishStatistical(tr.ConversationID, "Topic", msg)
+		h.publishTrend(tr.ConversationID, "Topic", msg, stats.counts[correlation])
+		h.publishCooccurrence(tr.ConversationID, "Topic", msg, stats.related[correlation])
 
-		err = (*h.msgPublisher).PublishMessage(tr.ConversationID, data)
-		if err != nil {
-			klog.V(1).Infof("[Topic] PublishMessage failed. Err: %v\n", err)
+		for _, msgRef := range curTopic.MessageReferences {
+			h.recordMention(interfaces.StatisticalCategoryTopic, correlation, tr.ConversationID, msgRef.ID, h.authorOf(tr.ConversationID, msgRef.ID))
 		}
 	}
 
 	return nil
 }
 
-func (h *Handler) TrackerResponseMessage(tr *shared.TrackerResponse) error {
+func (h *Handler) processTrackerResponse(tr *shared.TrackerResponse) error {
+	ctx := context.Background()
+
+	// build lookups
+	lookups := make([]map[string]any, 0)
 	for _, curTracker := range tr.TrackerResponse.Trackers {
-		last30Mins := h.trackerStats(tr.ConversationID, &curTracker, StatType30Mins)
-		lastHour := h.trackerStats(tr.ConversationID, &curTracker, StatType1Hour)
-		last4Hours := h.trackerStats(tr.ConversationID, &curTracker, StatType4Hours)
-		lastDay := h.trackerStats(tr.ConversationID, &curTracker, StatType1Day)
-		last2Days := h.trackerStats(tr.ConversationID, &curTracker, StatType2Days)
-		lastWeek := h.trackerStats(tr.ConversationID, &curTracker, StatType1Week)
-		lastMonth := h.trackerStats(tr.ConversationID, &curTracker, StatType1Month)
-
-		klog.V(2).Infof("Topic Stats: %s\n", curTracker.Name)
-		klog.V(2).Infof("----------------------------------------\n")
-		klog.V(2).Infof("last30Mins: %d\n", last30Mins)
-		klog.V(2).Infof("lastHour: %d\n", lastHour)
-		klog.V(2).Infof("last4Hours: %d\n", last4Hours)
-		klog.V(2).Infof("lastDay: %d\n", lastDay)
-		klog.V(2).Infof("last2Days: %d\n", last2Days)
-		klog.V(2).Infof("lastWeek: %d\n", lastWeek)
-		klog.V(2).Infof("lastMonth: %d\n", lastMonth)
-
-		msg := &interfaces.AppSpecificStatistical{
-			Type: sdkinterfaces.MessageTypeUserDefined,
-			Metadata: interfaces.Metadata{
-				Type: interfaces.AppSpecificMessageTypeStatistical,
-			},
-			Statistical: interfaces.Data{
-				Type:     interfaces.UserStatisticalTypeTracker,
-				Insights: make([]interfaces.Insight, 0),
-				Stats: interfaces.Stats{
-					Last30Mins: last30Mins,
-					LastHour:   lastHour,
-					Last4Hours: last4Hours,
-					LastDay:    lastDay,
-					Last2Days:  last2Days,
-					LastWeek:   lastWeek,
-					LastMonth:  lastMonth,
-				},
-			},
-		}
+		lookups = append(lookups, map[string]any{
+			"key": strings.ToLower(curTracker.Name),
+		})
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
 
+	stats := h.lookupStats(ctx, interfaces.StatisticalCategoryTracker, trackerMatch, tr.ConversationID, lookups)
+
+	for _, curTracker := range tr.TrackerResponse.Trackers {
+		correlation := strings.ToLower(curTracker.Name)
+
+		klog.V(2).Infof("Tracker Stats: %s\n", curTracker.Name)
+		h.logStats(stats.counts[correlation])
+
+		msg := h.newStatisticalMessage(interfaces.UserStatisticalTypeTracker, interfaces.StatisticalCategoryTracker, correlation, stats)
 		for _, match := range curTracker.Matches {
 			msg.Statistical.Insights = append(msg.Statistical.Insights, interfaces.Insight{
 				Correlation: strings.ToLower(match.Value),
@@ -173,75 +347,62 @@ func (h *Handler) TrackerResponseMessage(tr *shared.TrackerResponse) error {
 		}
 
 		// send the stat
-		data, err := json.Marshal(*msg)
-		if err != nil {
-			klog.V(1).Infof("[Topic] json.Marshal failed. Err: %v\n", err)
-		}
+		h.publishStatistical(tr.ConversationID, "Tracker", msg)
+		h.publishTrend(tr.ConversationID, "Tracker", msg, stats.counts[correlation])
+		h.publishCooccurrence(tr.ConversationID, "Tracker", msg, stats.related[correlation])
 
-		err = (*h.msgPublisher).PublishMessage(tr.ConversationID, data)
-		if err != nil {
-			klog.V(1).Infof("[Topic] PublishMessage failed. Err: %v\n", err)
+		for _, match := range curTracker.Matches {
+			for _, msgRef := range match.MessageRefs {
+				h.recordMention(interfaces.StatisticalCategoryTracker, correlation, tr.ConversationID, msgRef.ID, h.authorOf(tr.ConversationID, msgRef.ID))
+			}
 		}
 	}
 
 	return nil
 }
 
-func (h *Handler) EntityResponseMessage(er *shared.EntityResponse) error {
+func (h *Handler) processEntityResponse(er *shared.EntityResponse) error {
+	ctx := context.Background()
+
+	// build lookups
+	lookups := make([]map[string]any, 0)
 	for _, curEntity := range er.EntityResponse.Entities {
 		for _, curMatch := range curEntity.Matches {
-			last30Mins := h.entityStats(er.ConversationID, &curEntity, &curMatch, StatType30Mins)
-			lastHour := h.entityStats(er.ConversationID, &curEntity, &curMatch, StatType1Hour)
-			last4Hours := h.entityStats(er.ConversationID, &curEntity, &curMatch, StatType4Hours)
-			lastDay := h.entityStats(er.ConversationID, &curEntity, &curMatch, StatType1Day)
-			last2Days := h.entityStats(er.ConversationID, &curEntity, &curMatch, StatType2Days)
-			lastWeek := h.entityStats(er.ConversationID, &curEntity, &curMatch, StatType1Week)
-			lastMonth := h.entityStats(er.ConversationID, &curEntity, &curMatch, StatType1Month)
-
-			klog.V(2).Infof("Topic Stats: %s\n", curMatch.DetectedValue)
-			klog.V(2).Infof("----------------------------------------\n")
-			klog.V(2).Infof("last30Mins: %d\n", last30Mins)
-			klog.V(2).Infof("lastHour: %d\n", lastHour)
-			klog.V(2).Infof("last4Hours: %d\n", last4Hours)
-			klog.V(2).Infof("lastDay: %d\n", lastDay)
-			klog.V(2).Infof("last2Days: %d\n", last2Days)
-			klog.V(2).Infof("lastWeek: %d\n", lastWeek)
-			klog.V(2).Infof("lastMonth: %d\n", lastMonth)
-
-			msg := &interfaces.AppSpecificStatistical{
-				Type: sdkinterfaces.MessageTypeUserDefined,
-				Metadata: interfaces.Metadata{
-					Type: interfaces.AppSpecificMessageTypeStatistical,
-				},
-				Statistical: interfaces.Data{
-					Type:     interfaces.UserStatisticalTypeEntity,
-					Insights: make([]interfaces.Insight, 0),
-					Stats: interfaces.Stats{
-						Last30Mins: last30Mins,
-						LastHour:   lastHour,
-						Last4Hours: last4Hours,
-						LastDay:    lastDay,
-						Last2Days:  last2Days,
-						LastWeek:   lastWeek,
-						LastMonth:  lastMonth,
-					},
-				},
-			}
+			lookups = append(lookups, map[string]any{
+				"key":      insight.EntityCorrelation(curEntity.Category, curEntity.Type, curEntity.SubType, curMatch.DetectedValue),
+				"category": strings.ToLower(curEntity.Category),
+				"type":     strings.ToLower(curEntity.Type),
+				"subType":  strings.ToLower(curEntity.SubType),
+				"value":    strings.ToLower(curMatch.DetectedValue),
+			})
+		}
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
+
+	stats := h.lookupStats(ctx, interfaces.StatisticalCategoryEntity, entityMatch, er.ConversationID, lookups)
+
+	for _, curEntity := range er.EntityResponse.Entities {
+		for _, curMatch := range curEntity.Matches {
+			correlation := insight.EntityCorrelation(curEntity.Category, curEntity.Type, curEntity.SubType, curMatch.DetectedValue)
+
+			klog.V(2).Infof("Entity Stats: %s\n", curMatch.DetectedValue)
+			h.logStats(stats.counts[correlation])
 
+			msg := h.newStatisticalMessage(interfaces.UserStatisticalTypeEntity, interfaces.StatisticalCategoryEntity, correlation, stats)
 			msg.Statistical.Insights = append(msg.Statistical.Insights, interfaces.Insight{
-				Correlation: fmt.Sprintf("%s/%s/%s/%s", strings.ToLower(curEntity.Category), strings.ToLower(curEntity.Type), strings.ToLower(curEntity.SubType), strings.ToLower(curMatch.DetectedValue)),
+				Correlation: correlation,
 				Messages:    h.convertMessageRefsToSlice(curMatch.MessageRefs),
 			})
 
 			// send the stat
-			data, err := json.Marshal(*msg)
-			if err != nil {
-				klog.V(1).Infof("[Entities] json.Marshal failed. Err: %v\n", err)
-			}
+			h.publishStatistical(er.ConversationID, "Entities", msg)
+			h.publishTrend(er.ConversationID, "Entities", msg, stats.counts[correlation])
+			h.publishCooccurrence(er.ConversationID, "Entities", msg, stats.related[correlation])
 
-			err = (*h.msgPublisher).PublishMessage(er.ConversationID, data)
-			if err != nil {
-				klog.V(1).Infof("[Entities] PublishMessage failed. Err: %v\n", err)
+			for _, msgRef := range curMatch.MessageRefs {
+				h.recordMention(interfaces.StatisticalCategoryEntity, correlation, er.ConversationID, msgRef.ID, h.authorOf(er.ConversationID, msgRef.ID))
 			}
 		}
 	}
@@ -249,23 +410,76 @@ func (h *Handler) EntityResponseMessage(er *shared.EntityResponse) error {
 	return nil
 }
 
-func (h *Handler) TeardownConversation(tm *shared.TeardownResponse) error {
-	conversationId := tm.TeardownMessage.Message.Data.ConversationID
-	klog.V(2).Infof("TeardownConversation - conversationID: %s\n", conversationId)
-	delete(h.cache, conversationId)
-	return nil
+// newStatisticalMessage reports the counts for the configured windows and, when enabled,
+// the legacy fixed set of fields, the histograms and the top speakers
+func (h *Handler) newStatisticalMessage(statisticalType, category, correlation string, stats *lookupStats) *interfaces.AppSpecificStatistical {
+	counts := stats.counts[correlation]
+	msg := &interfaces.AppSpecificStatistical{
+		Type: sdkinterfaces.MessageTypeUserDefined,
+		Metadata: interfaces.Metadata{
+			Type: interfaces.AppSpecificMessageTypeStatistical,
+		},
+		Statistical: interfaces.Data{
+			Type:       statisticalType,
+			Category:   category,
+			Insights:   make([]interfaces.Insight, 0),
+			Windows:    make([]interfaces.Window, 0),
+			Histograms: stats.histograms[correlation],
+			Speakers:   stats.speakers[correlation],
+		},
+	}
+
+	for _, window := range h.config.windows {
+		msg.Statistical.Windows = append(msg.Statistical.Windows, interfaces.Window{
+			Window:        window.name,
+			Count:         counts[window.name].count,
+			Conversations: counts[window.name].conversations,
+			Speakers:      counts[window.name].speakers,
+		})
+	}
+
+	if h.config.LegacyStats {
+		msg.Statistical.Stats = &interfaces.Stats{
+			Last30Mins: counts[legacyWindow30Mins].count,
+			LastHour:   counts[legacyWindow1Hour].count,
+			Last4Hours: counts[legacyWindow4Hours].count,
+			LastDay:    counts[legacyWindow1Day].count,
+			Last2Days:  counts[legacyWindow2Days].count,
+			LastWeek:   counts[legacyWindow1Week].count,
+			LastMonth:  counts[legacyWindow1Month].count,
+		}
+	}
+
+	return msg
 }
 
-func (h *Handler) UserDefinedMessage(data []byte) error {
-	// No implementation required. Return Succeess!
-	return nil
+func (h *Handler) logStats(counts map[string]windowCount) {
+	klog.V(2).Infof("----------------------------------------\n")
+	for _, window := range h.config.queryWindows {
+		count := counts[window.name]
+		klog.V(2).Infof("%s: %d (conversations: %d, speakers: %d)\n", window.name, count.count, count.conversations, count.speakers)
+	}
 }
 
-func (h *Handler) UnhandledMessage(byMsg []byte) error {
-	klog.Errorf("\n\n-------------------------------\n")
-	klog.Errorf("UnhandledMessage:\n%v\n", string(byMsg))
-	klog.Errorf("-------------------------------\n\n")
-	return ErrUnhandledMessage
+// authorOf returns the speaker of a message in the conversation when it is known
+func (h *Handler) authorOf(conversationId, messageId string) speakerInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cache := h.cache[conversationId]
+	if cache == nil {
+		return speakerInfo{}
+	}
+
+	cacheMessage, err := cache.Find(messageId)
+	if err != nil {
+		return speakerInfo{}
+	}
+	return speakerInfo{
+		id:    cacheMessage.Author.ID,
+		name:  cacheMessage.Author.Name,
+		email: cacheMessage.Author.Email,
+	}
 }
 
 func (h *Handler) convertMessageAndInsightRefsToSlice(msgRefs []sdkinterfaces.MessageRef, inRefs []sdkinterfaces.InsightRef) []interfaces.Message {
@@ -300,6 +514,9 @@ func (h *Handler) convertMessageRefsToSlice(msgRefs []sdkinterfaces.MessageRef)
 func (h *Handler) convertMessageReferenceToSlice(conversationId string, msgRefs []sdkinterfaces.MessageReference) []interfaces.Message {
 	tmp := make([]interfaces.Message, 0)
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	cache := h.cache[conversationId]
 	if cache == nil {
 		tmp = append(tmp, interfaces.Message{
@@ -325,154 +542,3 @@ func (h *Handler) convertMessageReferenceToSlice(conversationId string, msgRefs
 
 	return tmp
 }
-
-func (h *Handler) statTypeToString(length StatisticType) string {
-	switch length {
-	case StatType1Month:
-		return "duration({months: 1})"
-	case StatType1Week:
-		return "duration({days: 7})"
-	case StatType2Days:
-		return "duration({days: 2})"
-	case StatType1Day:
-		return "duration({days: 1})"
-	case StatType4Hours:
-		return "duration({hours: 4})"
-	case StatType1Hour:
-		return "duration({hours: 1})"
-	case StatType30Mins:
-		return "duration({minutes: 30})"
-	default:
-		return "duration({seconds: 1})" // dont return anything
-	}
-}
-
-func (h *Handler) topicQuery(length StatisticType) string {
-	const queryPre = `
-	MATCH (t:Topic)-[x:TOPIC_MESSAGE_REF]-(m:Message)
-	WHERE x.#conversation_index# <> $conversation_id AND x.value = $topic_phrases AND x.created > datetime() - `
-	const queryPost = `
-	RETURN count(x)`
-
-	duration := h.statTypeToString(length)
-
-	return fmt.Sprintf("%s%s%s", queryPre, duration, queryPost)
-}
-
-func (h *Handler) trackerQuery(length StatisticType) string {
-	const queryPre = `
-	MATCH (t:Tracker)-[x:TRACKER_MESSAGE_REF]-(m:Message)
-	WHERE x.#conversation_index# <> $conversation_id AND x.name = $tracker_name AND x.createdAt > datetime() - `
-	const queryPost = `
-	RETURN count(x)`
-
-	duration := h.statTypeToString(length)
-
-	return fmt.Sprintf("%s%s%s", queryPre, duration, queryPost)
-}
-
-func (h *Handler) entityQuery(length StatisticType) string {
-	const queryPre = `
-	MATCH (e:Entity)-[x:ENTITY_MESSAGE_REF]-(m:Message)
-	WHERE x.#conversation_index# <> $conversation_id AND e.category = $entity_category AND e.type = $entity_type AND e.subType = $entity_subtype AND x.value = $entity_value AND x.createdAt > datetime() - `
-	const queryPost = `
-	RETURN count(x)`
-
-	duration := h.statTypeToString(length)
-
-	return fmt.Sprintf("%s%s%s", queryPre, duration, queryPost)
-}
-
-func (h *Handler) topicStats(conversationId string, curTopic *sdkinterfaces.Topic, length StatisticType) int64 {
-	ctx := context.Background()
-
-	var retValue int64
-
-	_, err := (*h.session).ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-		myQuery := utils.ReplaceIndexes(h.topicQuery(length))
-		result, err := tx.Run(ctx, myQuery, map[string]any{
-			"conversation_id": conversationId,
-			"topic_phrases":   strings.ToLower(curTopic.Phrases),
-		})
-		if err != nil {
-			return nil, err
-		}
-
-		for result.Next(ctx) {
-			retValue = result.Record().Values[0].(int64)
-		}
-
-		return nil, result.Err()
-	})
-	if err != nil {
-		klog.V(1).Infof("[Entities] ExecuteRead failed. Err: %v\n", err)
-		return 0
-	}
-
-	return retValue
-}
-
-func (h *Handler) trackerStats(conversationId string, curTracker *sdkinterfaces.Tracker, length StatisticType) int64 {
-	ctx := context.Background()
-
-	var retValue int64
-
-	_, err := (*h.session).ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-		query := h.trackerQuery(length)
-		klog.V(2).Infof("QUERY: \n%s\n", query)
-		myQuery := utils.ReplaceIndexes(query)
-		result, err := tx.Run(ctx, myQuery, map[string]any{
-			"conversation_id": conversationId,
-			"tracker_name":    strings.ToLower(curTracker.Name),
-		})
-		if err != nil {
-			return nil, err
-		}
-
-		for result.Next(ctx) {
-			retValue = result.Record().Values[0].(int64)
-		}
-
-		return nil, result.Err()
-	})
-	if err != nil {
-		klog.V(1).Infof("[Tracker] ExecuteRead failed. Err: %v\n", err)
-		return 0
-	}
-
-	return retValue
-}
-
-func (h *Handler) entityStats(conversationId string, entity *sdkinterfaces.Entity, match *sdkinterfaces.EntityMatch, length StatisticType) int64 {
-	ctx := context.Background()
-
-	var retValue int64
-
-	_, err := (*h.session).ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
-		query := h.entityQuery(length)
-		klog.V(2).Infof("QUERY: \n%s\n", query)
-		myQuery := utils.ReplaceIndexes(query)
-		result, err := tx.Run(ctx, myQuery, map[string]any{
-			"conversation_id": conversationId,
-			"entity_category": strings.ToLower(entity.Category),
-			"entity_type":     strings.ToLower(entity.Type),
-			"entity_subtype":  strings.ToLower(entity.SubType),
-			"entity_value":    strings.ToLower(match.DetectedValue),
-		})
-		if err != nil {
-			return nil, err
-		}
-
-		for result.Next(ctx) {
-			retValue = result.Record().Values[0].(int64)
-		}
-
-		return nil, result.Err()
-	})
-	if err != nil {
-		klog.V(1).Infof("entityStats ExecuteRead failed. Err: %v\n", err)
-		return 0
-	}
-
-	return retValue
-}
@@ -0,0 +1,150 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
+	shared "github.com/dvonthenen/enterprise-conversation-application/pkg/shared"
+)
+
+// fakePublisher counts the messages published per conversation
+type fakePublisher struct {
+	mu        sync.Mutex
+	published map[string]int
+}
+
+func (fp *fakePublisher) PublishMessage(name string, data []byte) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.published[name]++
+	return nil
+}
+
+func newNotificationHandler(driver *neo4j.DriverWithContext, workers, queueDepth int) (*Handler, *fakePublisher) {
+	h := NewHandler(HandlerOptions{Driver: driver, Workers: workers, QueueDepth: queueDepth})
+
+	publisher := &fakePublisher{published: make(map[string]int)}
+	var mp interfacessdk.MessagePublisher = publisher
+	h.SetClientPublisher(&mp)
+	return h, publisher
+}
+
+func topicResponse(conversationId, phrases string) *shared.TopicResponse {
+	return &shared.TopicResponse{
+		ConversationID: conversationId,
+		TopicResponse: &sdkinterfaces.TopicResponse{
+			Topics: []sdkinterfaces.Topic{{Phrases: phrases}},
+		},
+	}
+}
+
+func TestDispatchDoesNotWaitForOtherConversations(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 100)
+	_, driver := newFakeDriver(0, func(cypher string, params map[string]any) []*neo4j.Record {
+		conversationId, _ := params["conversation_id"].(string)
+		if conversationId == "" {
+			return nil
+		}
+		started <- conversationId
+		if conversationId == "conversation-slow" {
+			<-release
+		}
+		return nil
+	})
+	h, _ := newNotificationHandler(driver, 8, 0)
+	defer h.Stop()
+	defer close(release)
+
+	// the callbacks are delivered from one goroutine and must not wait for the slow conversation
+	delivered := make(chan error, 1)
+	go func() {
+		err := h.TopicResponseMessage(topicResponse("conversation-slow", "renewal"))
+		for i := 0; i < 8 && err == nil; i++ {
+			err = h.TopicResponseMessage(topicResponse(fmt.Sprintf("conversation-%d", i), "renewal"))
+		}
+		delivered <- err
+	}()
+
+	select {
+	case err := <-delivered:
+		if err != nil {
+			t.Fatalf("TopicResponseMessage failed. Err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TopicResponseMessage waited for the slow conversation")
+	}
+
+	// other conversations are processed while the slow one is still running
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case conversationId := <-started:
+			if conversationId != "conversation-slow" {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no other conversation was processed while the slow one was running")
+		}
+	}
+}
+
+func TestConcurrentConversations(t *testing.T) {
+	_, driver := newFakeDriver(0, windowRows(1))
+	h, publisher := newNotificationHandler(driver, 4, 2)
+
+	const conversations = 20
+	const responses = 5
+
+	var wg sync.WaitGroup
+	for i := 0; i < conversations; i++ {
+		wg.Add(1)
+		go func(conversationId string) {
+			defer wg.Done()
+
+			for j := 0; j < responses; j++ {
+				id := fmt.Sprintf("%s-%d", conversationId, j)
+				callbacks := []error{
+					h.MessageResponseMessage(&shared.MessageResponse{
+						ConversationID: conversationId,
+						MessageResponse: &sdkinterfaces.MessageResponse{
+							Messages: []sdkinterfaces.Message{{ID: id}},
+						},
+					}),
+					h.InsightResponseMessage(&shared.InsightResponse{
+						ConversationID: conversationId,
+						InsightResponse: &sdkinterfaces.InsightResponse{
+							Insights: []sdkinterfaces.Insight{{ID: id, Type: "question", Payload: sdkinterfaces.Payload{Content: "what is the renewal date?"}}},
+						},
+					}),
+					h.TopicResponseMessage(topicResponse(conversationId, "renewal policy")),
+				}
+				for _, err := range callbacks {
+					if err != nil {
+						t.Errorf("callback failed. Err: %v", err)
+					}
+				}
+			}
+		}(fmt.Sprintf("conversation-%d", i))
+	}
+	wg.Wait()
+	h.Stop()
+
+	// one statistical message per insight and per topic
+	for i := 0; i < conversations; i++ {
+		conversationId := fmt.Sprintf("conversation-%d", i)
+		if got := publisher.published[conversationId]; got != 2*responses {
+			t.Errorf("%s published %d messages, want %d", conversationId, got, 2*responses)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	klog "k8s.io/klog/v2"
+
+	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
+)
+
+const (
+	// lookupPrefix every stats query is batched over $lookups and evaluated at the same instant
+	lookupPrefix string = `
+		WITH datetime() AS now
+		UNWIND $lookups AS lookup`
+
+	// the match clauses per category bind lookup and the matched relationship x. The lookups are
+	// lower cased, so the stored values are lower cased before comparing like the counter sync.
+	topicMatch string = `
+		OPTIONAL MATCH (t:Topic)-[x:TOPIC_MESSAGE_REF]-(m:Message)
+		WHERE x.#conversation_index# <> $conversation_id AND toLower(x.value) = lookup.key`
+
+	// the tracker name is stored on the Tracker node, not on the relationship
+	trackerMatch string = `
+		OPTIONAL MATCH (t:Tracker)-[x:TRACKER_MESSAGE_REF]-(m:Message)
+		WHERE x.#conversation_index# <> $conversation_id AND toLower(t.name) = lookup.key`
+
+	entityMatch string = `
+		OPTIONAL MATCH (e:Entity)-[x:ENTITY_MESSAGE_REF]-(m:Message)
+		WHERE x.#conversation_index# <> $conversation_id AND toLower(e.category) = lookup.category AND toLower(e.type) = lookup.type AND toLower(e.subType) = lookup.subType AND toLower(x.value) = lookup.value`
+
+	// insights are matched on the type and the normalized text, m binds the insight so the
+	// speaker is found the same way as for messages
+	insightMatch string = `
+		OPTIONAL MATCH (m:Insight)-[x:SPOKE]-(:User)
+		WHERE x.#conversation_index# <> $conversation_id AND m.normalizedContent = lookup.text AND toLower(m.type) = lookup.type`
+
+	// businessHoursFilter when enabled only counts mentions during business hours in the
+	// configured time zone
+	businessHoursFilter string = `
+			AND ($business_hours = false OR (
+				datetime({datetime: x.created, timezone: $time_zone}).hour >= $business_start AND
+				datetime({datetime: x.created, timezone: $time_zone}).hour < $business_end AND
+				datetime({datetime: x.created, timezone: $time_zone}).dayOfWeek IN $business_days))`
+
+	// speakerKeyExpr identifies the speaker u the same way as speakerKey
+	speakerKeyExpr string = `CASE WHEN coalesce(u.email, '') <> '' THEN toLower(u.email) ELSE u.userId END`
+
+	// windowCounts counts the matched relationships x, the distinct conversations and the
+	// distinct speakers for every window using conditional aggregation, x and m may be null
+	// when nothing matched
+	windowCounts string = `
+			AND ANY(w IN $windows WHERE x.created > w.since)` + businessHoursFilter + `
+		WITH now, lookup, x, m
+		OPTIONAL MATCH (m)-[:SPOKE]-(u:User)
+		WITH now, lookup, x, ` + speakerKeyExpr + ` AS speaker
+		UNWIND $windows AS w
+		WITH lookup, w, speaker, CASE WHEN x.created > w.since THEN x ELSE null END AS hit
+		WITH lookup, w, count(DISTINCT hit) AS total,
+			count(DISTINCT CASE WHEN hit IS NULL THEN null ELSE hit.#conversation_index# END) AS conversations,
+			count(DISTINCT CASE WHEN hit IS NULL THEN null ELSE speaker END) AS speakers
+		RETURN lookup.key, collect({window: w.name, count: total, conversations: conversations, speakers: speakers})`
+
+	// histogramCounts counts the matched relationships x per bucket for every histogram where
+	// bucket 0 is the most recent one
+	histogramCounts string = `
+			AND ANY(hg IN $histograms WHERE x.created > now - duration({seconds: hg.window}))` + businessHoursFilter + `
+		WITH now, lookup, x
+		UNWIND $histograms AS hg
+		WITH lookup, hg, CASE WHEN x.created > now - duration({seconds: hg.window}) THEN duration.inSeconds(x.created, now).seconds / hg.bucket ELSE null END AS bucket
+		WITH lookup, hg, bucket, count(bucket) AS total
+		WITH lookup, hg, collect({bucket: bucket, count: total}) AS buckets
+		RETURN lookup.key, collect({name: hg.name, buckets: buckets})`
+
+	// speakerCounts counts the matched relationships x per speaker for every window and keeps
+	// the speakers with the most mentions in any window
+	speakerCounts string = `
+			AND ANY(w IN $windows WHERE x.created > w.since)` + businessHoursFilter + `
+		WITH now, lookup, x, m
+		MATCH (m)-[:SPOKE]-(u:User)
+		WITH now, lookup, x, u, ` + speakerKeyExpr + ` AS speaker
+		UNWIND $windows AS w
+		WITH lookup, speaker, w, head(collect(u)) AS u, sum(CASE WHEN x.created > w.since THEN 1 ELSE 0 END) AS total
+		WITH lookup, speaker, head(collect(u)) AS u, collect({window: w.name, count: total}) AS counts, max(total) AS most
+		ORDER BY most DESC, speaker
+		WITH lookup, collect({userId: u.userId, name: u.name, email: u.email, counts: counts})[..$top_speakers] AS speakers
+		RETURN lookup.key, speakers`
+)
+
+// countsQuery the query counting every window for the category match clause
+func countsQuery(match string) string {
+	return lookupPrefix + match + windowCounts
+}
+
+// histogramQuery the query bucketing every histogram for the category match clause
+func histogramQuery(match string) string {
+	return lookupPrefix + match + histogramCounts
+}
+
+// speakerQuery the query counting every window per speaker for the category match clause
+func speakerQuery(match string) string {
+	return lookupPrefix + match + speakerCounts
+}
+
+// runLookup runs a batched stats query returning rows of [key, list of maps] and calls rowFn
+// for each map in the list
+func (h *Handler) runLookup(ctx context.Context, query string, params map[string]any, rowFn func(key string, props map[string]any)) error {
+	session := h.newSession(ctx, neo4j.AccessModeRead)
+	defer session.Close(ctx)
+
+	_, err := session.ExecuteRead(ctx, func(tx neo4j.ManagedTransaction) (any, error) {
+		myQuery := utils.ReplaceIndexes(query)
+		result, err := tx.Run(ctx, myQuery, params)
+		if err != nil {
+			return nil, err
+		}
+
+		for result.Next(ctx) {
+			key := recordString(result.Record().Values[0])
+			rows, ok := result.Record().Values[1].([]any)
+			if !ok {
+				continue
+			}
+
+			for _, row := range rows {
+				props, ok := row.(map[string]any)
+				if !ok {
+					continue
+				}
+				rowFn(key, props)
+			}
+		}
+
+		return nil, result.Err()
+	})
+
+	return err
+}
+
+// lookupStats runs the queries for the counts and the optional histograms and top speakers.
+// Everything is answered from the in memory counters when they are enabled and loaded. A query
+// which fails is logged and its part of the stats is left empty, so zeros are published the
+// same way the original per window queries did.
+func (h *Handler) lookupStats(ctx context.Context, category, match, conversationId string, lookups []map[string]any) *lookupStats {
+	if stats := h.counterLookup(category, conversationId, lookups); stats != nil {
+		return stats
+	}
+
+	var err error
+	stats := &lookupStats{}
+
+	stats.counts, err = h.windowStats(ctx, match, conversationId, lookups)
+	if err != nil {
+		klog.V(1).Infof("[%s] windowStats failed. Err: %v\n", category, err)
+	}
+	stats.histograms, err = h.histogramStats(ctx, match, conversationId, lookups)
+	if err != nil {
+		klog.V(1).Infof("[%s] histogramStats failed. Err: %v\n", category, err)
+	}
+	stats.speakers, err = h.speakerStats(ctx, match, conversationId, lookups)
+	if err != nil {
+		klog.V(1).Infof("[%s] speakerStats failed. Err: %v\n", category, err)
+	}
+
+	// free form insights are not stored as correlations other conversations can be related by
+	if category != interfaces.StatisticalCategoryInsight {
+		stats.related, err = h.cooccurrenceStats(ctx, category, match, conversationId, lookups)
+		if err != nil {
+			klog.V(1).Infof("[%s] cooccurrenceStats failed. Err: %v\n", category, err)
+		}
+	}
+
+	return stats
+}
+
+// windowStats runs a single query returning the counts for every lookup and every window.
+// The result is grouped by the lookup key and then by the window name.
+func (h *Handler) windowStats(ctx context.Context, match, conversationId string, lookups []map[string]any) (map[string]map[string]windowCount, error) {
+	stats := make(map[string]map[string]windowCount)
+
+	err := h.runLookup(ctx, countsQuery(match), h.config.queryParams(map[string]any{
+		"conversation_id": conversationId,
+		"lookups":         lookups,
+		"windows":         h.config.windowParams(),
+	}), func(key string, props map[string]any) {
+		if stats[key] == nil {
+			stats[key] = make(map[string]windowCount)
+		}
+		stats[key][recordString(props["window"])] = windowCount{
+			count:         recordInt64(props["count"]),
+			conversations: recordInt64(props["conversations"]),
+			speakers:      recordInt64(props["speakers"]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// histogramStats runs a single query returning the bucketed counts for every lookup and every
+// configured histogram grouped by the lookup key
+func (h *Handler) histogramStats(ctx context.Context, match, conversationId string, lookups []map[string]any) (map[string][]interfaces.Histogram, error) {
+	histograms := make(map[string][]interfaces.Histogram)
+	if len(h.config.Histograms) == 0 {
+		return histograms, nil
+	}
+
+	buckets := make(map[string]map[string][]int64)
+	err := h.runLookup(ctx, histogramQuery(match), h.config.queryParams(map[string]any{
+		"conversation_id": conversationId,
+		"lookups":         lookups,
+		"histograms":      h.config.histogramParams(),
+	}), func(key string, props map[string]any) {
+		if buckets[key] == nil {
+			buckets[key] = make(map[string][]int64)
+		}
+
+		hc := h.config.histogram(recordString(props["name"]))
+		if hc == nil {
+			return
+		}
+
+		// oldest bucket first which is the order charts are drawn in
+		counts := make([]int64, hc.buckets())
+		rows, _ := props["buckets"].([]any)
+		for _, row := range rows {
+			bucketProps, ok := row.(map[string]any)
+			if !ok || bucketProps["bucket"] == nil {
+				continue
+			}
+
+			bucket := int(recordInt64(bucketProps["bucket"]))
+			if bucket < 0 || bucket >= len(counts) {
+				continue
+			}
+			counts[len(counts)-1-bucket] = recordInt64(bucketProps["count"])
+		}
+
+		buckets[key][hc.name()] = counts
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// report the histograms in the configured order
+	for key, byName := range buckets {
+		for _, hc := range h.config.Histograms {
+			counts, ok := byName[hc.name()]
+			if !ok {
+				continue
+			}
+			histograms[key] = append(histograms[key], interfaces.Histogram{
+				Window: hc.window.name,
+				Bucket: hc.bucket.name,
+				Counts: counts,
+			})
+		}
+	}
+
+	return histograms, nil
+}
+
+// windowParams the windows which are counted passed as a query parameter, the start of each
+// window is computed here so calendar windows line up with the configured time zone
+func (c *Config) windowParams() []map[string]any {
+	now := c.now()
+	params := make([]map[string]any, 0, len(c.queryWindows))
+	for _, window := range c.queryWindows {
+		params = append(params, map[string]any{
+			"name":  window.name,
+			"since": window.since(now),
+		})
+	}
+	return params
+}
+
+// queryParams adds the time zone and business hours parameters shared by the stats queries
+func (c *Config) queryParams(params map[string]any) map[string]any {
+	params["time_zone"] = c.location.String()
+	params["business_hours"] = c.BusinessHours.Enabled
+	params["business_start"] = c.BusinessHours.Start
+	params["business_end"] = c.BusinessHours.End
+	params["business_days"] = c.BusinessHours.days
+	return params
+}
+
+// speakerStats runs a single query returning the top speakers for every lookup grouped by the
+// lookup key. The counts are reported for the configured windows.
+func (h *Handler) speakerStats(ctx context.Context, match, conversationId string, lookups []map[string]any) (map[string][]interfaces.Speaker, error) {
+	speakers := make(map[string][]interfaces.Speaker)
+	if h.config.TopSpeakers == 0 {
+		return speakers, nil
+	}
+
+	err := h.runLookup(ctx, speakerQuery(match), h.config.queryParams(map[string]any{
+		"conversation_id": conversationId,
+		"lookups":         lookups,
+		"windows":         h.config.windowParams(),
+		"top_speakers":    h.config.TopSpeakers,
+	}), func(key string, props map[string]any) {
+		byWindow := make(map[string]int64)
+		rows, _ := props["counts"].([]any)
+		for _, row := range rows {
+			countProps, ok := row.(map[string]any)
+			if !ok {
+				continue
+			}
+			byWindow[recordString(countProps["window"])] = recordInt64(countProps["count"])
+		}
+
+		speaker := interfaces.Speaker{
+			ID:     recordString(props["userId"]),
+			Name:   recordString(props["name"]),
+			Email:  recordString(props["email"]),
+			Counts: make([]interfaces.WindowCount, 0, len(h.config.windows)),
+		}
+		for _, window := range h.config.windows {
+			speaker.Counts = append(speaker.Counts, interfaces.WindowCount{
+				Window: window.name,
+				Count:  byWindow[window.name],
+			})
+		}
+
+		speakers[key] = append(speakers[key], speaker)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return speakers, nil
+}
+
+// histogramParams the histograms which are bucketed passed as a query parameter
+func (c *Config) histogramParams() []map[string]any {
+	params := make([]map[string]any, 0, len(c.Histograms))
+	for _, hc := range c.Histograms {
+		params = append(params, map[string]any{
+			"name":   hc.name(),
+			"window": hc.window.seconds,
+			"bucket": hc.bucket.seconds,
+		})
+	}
+	return params
+}
+
+// recordString converts a neo4j value into a string
+func recordString(value any) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// recordInt64 converts a neo4j value into an int64
+func recordInt64(value any) int64 {
+	if i, ok := value.(int64); ok {
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
+)
+
+// benchmarkLatency simulated round trip to Neo4j
+const benchmarkLatency = 200 * time.Microsecond
+
+func newStatsHandler(driver *neo4j.DriverWithContext, config *Config) *Handler {
+	return &Handler{
+		driver: driver,
+		config: config,
+	}
+}
+
+// windowRows answers a batched counts query with the same count for every window
+func windowRows(count int64) func(cypher string, params map[string]any) []*neo4j.Record {
+	return func(cypher string, params map[string]any) []*neo4j.Record {
+		windows, _ := params["windows"].([]map[string]any)
+		return lookupRows(params, func(lookup map[string]any) []any {
+			rows := make([]any, 0, len(windows))
+			for _, window := range windows {
+				rows = append(rows, map[string]any{
+					"window":        window["name"],
+					"count":         count,
+					"conversations": int64(1),
+					"speakers":      int64(1),
+				})
+			}
+			return rows
+		})
+	}
+}
+
+func TestLookupStatsCountsEveryWindow(t *testing.T) {
+	fake, driver := newFakeDriver(0, windowRows(4))
+	config := DefaultConfig()
+	config.LegacyStats = true
+	h := newStatsHandler(driver, config)
+
+	lookups := []map[string]any{{"key": "pricing"}, {"key": "renewal"}}
+	stats := h.lookupStats(context.Background(), interfaces.StatisticalCategoryTopic, topicMatch, "conversation-1", lookups)
+
+	if got := len(fake.queriesMatching("")); got != 1 {
+		t.Fatalf("queries = %d, want a single batched query", got)
+	}
+
+	msg := h.newStatisticalMessage(interfaces.UserStatisticalTypeTopic, interfaces.StatisticalCategoryTopic, "renewal", stats)
+	if len(msg.Statistical.Windows) != len(legacyWindows) {
+		t.Fatalf("windows = %v, want %d", msg.Statistical.Windows, len(legacyWindows))
+	}
+	for _, window := range msg.Statistical.Windows {
+		if window.Count != 4 {
+			t.Errorf("window %s count = %d, want 4", window.Window, window.Count)
+		}
+	}
+	if msg.Statistical.Stats == nil || msg.Statistical.Stats.Last30Mins != 4 || msg.Statistical.Stats.LastMonth != 4 {
+		t.Errorf("legacy stats = %+v, want 4 in every field", msg.Statistical.Stats)
+	}
+}
+
+func TestLookupStatsPublishesZerosOnError(t *testing.T) {
+	fake, driver := newFakeDriver(0, nil)
+	fake.err = errors.New("connection refused")
+	config := DefaultConfig()
+	config.LegacyStats = true
+	h := newStatsHandler(driver, config)
+
+	lookups := []map[string]any{{"key": "pricing"}}
+	stats := h.lookupStats(context.Background(), interfaces.StatisticalCategoryTopic, topicMatch, "conversation-1", lookups)
+	if stats == nil {
+		t.Fatalf("lookupStats returned nil stats")
+	}
+
+	msg := h.newStatisticalMessage(interfaces.UserStatisticalTypeTopic, interfaces.StatisticalCategoryTopic, "pricing", stats)
+	if len(msg.Statistical.Windows) != len(legacyWindows) {
+		t.Fatalf("windows = %v, want %d", msg.Statistical.Windows, len(legacyWindows))
+	}
+	for _, window := range msg.Statistical.Windows {
+		if window.Count != 0 {
+			t.Errorf("window %s count = %d, want 0", window.Window, window.Count)
+		}
+	}
+	if msg.Statistical.Stats == nil || *msg.Statistical.Stats != (interfaces.Stats{}) {
+		t.Errorf("legacy stats = %+v, want zeros", msg.Statistical.Stats)
+	}
+}
+
+func TestLookupStatsMatchesStoredProperties(t *testing.T) {
+	// the dataminer stores the tracker name on the Tracker node and timestamps every
+	// relationship with created, TRACKER_MESSAGE_REF and ENTITY_MESSAGE_REF have no name or
+	// createdAt property so a query filtering on them never counts anything
+	stored := windowRows(2)
+	responder := func(cypher string, params map[string]any) []*neo4j.Record {
+		if strings.Contains(cypher, "x.name") || strings.Contains(cypher, "createdAt") {
+			return lookupRows(params, func(lookup map[string]any) []any {
+				return []any{}
+			})
+		}
+		return stored(cypher, params)
+	}
+
+	tests := []struct {
+		category string
+		match    string
+		lookup   map[string]any
+	}{
+		{interfaces.StatisticalCategoryTracker, trackerMatch, map[string]any{"key": "pricing"}},
+		{interfaces.StatisticalCategoryEntity, entityMatch, map[string]any{"key": "person/name/first/jane", "category": "person", "type": "name", "subType": "first", "value": "jane"}},
+	}
+
+	for _, test := range tests {
+		fake, driver := newFakeDriver(0, responder)
+		h := newStatsHandler(driver, DefaultConfig())
+
+		key := recordString(test.lookup["key"])
+		stats := h.lookupStats(context.Background(), test.category, test.match, "conversation-1", []map[string]any{test.lookup})
+		for window, count := range stats.counts[key] {
+			if count.count != 2 {
+				t.Errorf("[%s] window %s count = %d, want 2", test.category, window, count.count)
+			}
+		}
+		if len(stats.counts[key]) == 0 {
+			t.Errorf("[%s] no counts returned", test.category)
+		}
+
+		queries := fake.queriesMatching("x.created > w.since")
+		if len(queries) != 1 {
+			t.Errorf("[%s] counts queries = %d, want 1", test.category, len(queries))
+		}
+	}
+
+	if !strings.Contains(trackerMatch, "toLower(t.name) = lookup.key") {
+		t.Errorf("trackerMatch does not match on the Tracker name:%s", trackerMatch)
+	}
+}
+
+// BenchmarkStatsRoundTrips compares the original one query per item and window to the single
+// batched query per response
+func BenchmarkStatsRoundTrips(b *testing.B) {
+	for _, items := range []int{1, 5, 20} {
+		lookups := make([]map[string]any, 0, items)
+		for i := 0; i < items; i++ {
+			lookups = append(lookups, map[string]any{"key": fmt.Sprintf("topic %d", i)})
+		}
+
+		b.Run(fmt.Sprintf("per_window/%d", items), func(b *testing.B) {
+			fake, driver := newFakeDriver(benchmarkLatency, windowRows(4))
+			h := newStatsHandler(driver, DefaultConfig())
+			windows := h.config.windowParams()
+
+			for n := 0; n < b.N; n++ {
+				for _, lookup := range lookups {
+					for _, window := range windows {
+						err := h.runLookup(context.Background(), countsQuery(topicMatch), h.config.queryParams(map[string]any{
+							"conversation_id": "conversation-1",
+							"lookups":         []map[string]any{lookup},
+							"windows":         []map[string]any{window},
+						}), func(key string, props map[string]any) {})
+						if err != nil {
+							b.Fatalf("runLookup failed. Err: %v", err)
+						}
+					}
+				}
+			}
+			b.ReportMetric(float64(len(fake.queriesMatching("")))/float64(b.N), "queries/op")
+		})
+
+		b.Run(fmt.Sprintf("batched/%d", items), func(b *testing.B) {
+			fake, driver := newFakeDriver(benchmarkLatency, windowRows(4))
+			h := newStatsHandler(driver, DefaultConfig())
+
+			for n := 0; n < b.N; n++ {
+				h.lookupStats(context.Background(), interfaces.StatisticalCategoryTopic, topicMatch, "conversation-1", lookups)
+			}
+			b.ReportMetric(float64(len(fake.queriesMatching("")))/float64(b.N), "queries/op")
+		})
+	}
+}
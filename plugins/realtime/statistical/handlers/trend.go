@@ -0,0 +1,79 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"math"
+	"time"
+
+	sdkinterfaces "github.com/dvonthenen/symbl-go-sdk/pkg/api/streaming/v1/interfaces"
+	klog "k8s.io/klog/v2"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
+)
+
+// detectTrend compares the count in the trend window to the count expected from the rate
+// over the rest of the baseline. The rate is per business second when only business hours
+// are counted. Returns nil unless the correlation is spiking.
+func (tc *TrendConfig) detectTrend(counts map[string]windowCount, now time.Time, bh *BusinessHoursConfig) *interfaces.Trend {
+	count := counts[tc.window.name].count
+	if count < tc.MinCount {
+		return nil
+	}
+
+	// the baseline rate excludes the window itself so a spike doesn't inflate its own baseline
+	windowSeconds := bh.length(&tc.window, now)
+	baselineCount := counts[tc.baseline.name].count - count
+	if baselineCount < 0 {
+		baselineCount = 0
+	}
+	expected := float64(baselineCount) / math.Max(bh.length(&tc.baseline, now)-windowSeconds, 1) * windowSeconds
+
+	// treat a correlation never seen before as one expected occurrence
+	ratio := float64(count) / math.Max(expected, 1)
+	if ratio < tc.Threshold {
+		return nil
+	}
+
+	// mentions are modeled as a Poisson process, so the variance equals the expected count
+	zScore := (float64(count) - expected) / math.Sqrt(math.Max(expected, 1))
+
+	return &interfaces.Trend{
+		Window:   tc.window.name,
+		Baseline: tc.baseline.name,
+		Count:    count,
+		Expected: expected,
+		Ratio:    ratio,
+		ZScore:   zScore,
+	}
+}
+
+// publishTrend sends a statistical_trend message when the correlations in msg are spiking
+func (h *Handler) publishTrend(conversationId, label string, msg *interfaces.AppSpecificStatistical, counts map[string]windowCount) {
+	if !h.config.Trend.Enabled {
+		return
+	}
+
+	trend := h.config.Trend.detectTrend(counts, h.config.now(), &h.config.BusinessHours)
+	if trend == nil {
+		return
+	}
+
+	klog.V(2).Infof("[%s] Trending: %d in %s, expected %f (ratio: %f, z-score: %f)\n", label, trend.Count, trend.Window, trend.Expected, trend.Ratio, trend.ZScore)
+
+	trendMsg := &interfaces.AppSpecificStatistical{
+		Type: sdkinterfaces.MessageTypeUserDefined,
+		Metadata: interfaces.Metadata{
+			Type: interfaces.AppSpecificMessageTypeStatistical,
+		},
+		Statistical: interfaces.Data{
+			Type:     interfaces.UserStatisticalTypeTrend,
+			Category: msg.Statistical.Category,
+			Insights: msg.Statistical.Insights,
+			Trend:    trend,
+		},
+	}
+
+	h.publishStatistical(conversationId, label, trendMsg)
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Enterprise Conversation Plugins contributors. All Rights Reserved.
+// SPDX-License-Identifier: Apache License 2.0
+
+package handlers
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
+)
+
+func newBusinessHours(t *testing.T) *BusinessHoursConfig {
+	bh := &BusinessHoursConfig{
+		Enabled: true,
+		Start:   DefaultBusinessStart,
+		End:     DefaultBusinessEnd,
+		Days:    defaultBusinessDays,
+	}
+	if err := bh.parse(); err != nil {
+		t.Fatalf("parse failed. Err: %v", err)
+	}
+	return bh
+}
+
+func TestBusinessHoursSeconds(t *testing.T) {
+	bh := newBusinessHours(t)
+	hour := time.Hour.Seconds()
+
+	// Wednesday 2023-03-15
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+		want float64
+	}{
+		{"within a day", time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC), time.Date(2023, 3, 15, 12, 30, 0, 0, time.UTC), 2.5 * hour},
+		{"before opening", time.Date(2023, 3, 15, 6, 0, 0, 0, time.UTC), time.Date(2023, 3, 15, 10, 0, 0, 0, time.UTC), hour},
+		{"overnight", time.Date(2023, 3, 15, 16, 0, 0, 0, time.UTC), time.Date(2023, 3, 16, 10, 0, 0, 0, time.UTC), 2 * hour},
+		{"weekend", time.Date(2023, 3, 18, 0, 0, 0, 0, time.UTC), time.Date(2023, 3, 20, 0, 0, 0, 0, time.UTC), 0},
+		{"full week", time.Date(2023, 3, 13, 0, 0, 0, 0, time.UTC), time.Date(2023, 3, 20, 0, 0, 0, 0, time.UTC), 40 * hour},
+	}
+
+	for _, test := range tests {
+		if got := bh.seconds(test.from, test.to); got != test.want {
+			t.Errorf("%s: seconds = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDetectTrendUsesBusinessSeconds(t *testing.T) {
+	tc := &TrendConfig{
+		Threshold: DefaultTrendThreshold,
+		MinCount:  DefaultTrendMinCount,
+		window:    statWindow{name: "1h", seconds: 3600},
+		baseline:  statWindow{name: "1w", seconds: 7 * 24 * 3600},
+	}
+	counts := map[string]windowCount{
+		"1h": {count: 3},
+		"1w": {count: 3 + 39},
+	}
+
+	// Monday 2023-03-20 10:00, the week before holds 39 business hours besides the window
+	now := time.Date(2023, 3, 20, 10, 0, 0, 0, time.UTC)
+
+	// one mention per business hour is expected, so 3 is a spike
+	trend := tc.detectTrend(counts, now, newBusinessHours(t))
+	if trend == nil {
+		t.Fatalf("detectTrend = nil, want a trend")
+	}
+	if math.Abs(trend.Expected-1) > 1e-9 {
+		t.Errorf("expected = %v, want 1 per business hour", trend.Expected)
+	}
+
+	// without business hours the baseline is spread over the 167 other hours of the week
+	trend = tc.detectTrend(counts, now, &BusinessHoursConfig{})
+	if trend == nil || math.Abs(trend.Expected-39.0/167.0) > 1e-9 {
+		t.Errorf("detectTrend without business hours = %+v, want 39/167 expected", trend)
+	}
+}
+
+func TestCooccurrenceBusinessHours(t *testing.T) {
+	fake, driver := newFakeDriver(0, nil)
+	config := DefaultConfig()
+	config.Cooccurrence.Enabled = true
+	config.BusinessHours.Enabled = true
+	if err := config.parse(); err != nil {
+		t.Fatalf("parse failed. Err: %v", err)
+	}
+	h := newStatsHandler(driver, config)
+
+	_, err := h.cooccurrenceStats(context.Background(), interfaces.StatisticalCategoryTopic, topicMatch, "conversation-1", []map[string]any{{"key": "pricing"}})
+	if err != nil {
+		t.Fatalf("cooccurrenceStats failed. Err: %v", err)
+	}
+
+	queries := fake.queriesMatching("CALL {")
+	if len(queries) != 1 {
+		t.Fatalf("co-occurrence queries = %d, want 1", len(queries))
+	}
+	query := queries[0]
+	if strings.Contains(query.cypher, "#related_business_hours#") || strings.Count(query.cypher, "r.created, timezone") != 9 {
+		t.Errorf("related mentions are not filtered to business hours:\n%s", query.cypher)
+	}
+	if query.params["business_hours"] != true || query.params["time_zone"] != DefaultTimeZone {
+		t.Errorf("params = %v, want the business hours parameters", query.params)
+	}
+}
@@ -4,26 +4,201 @@
 package handlers
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
 	utils "github.com/dvonthenen/enterprise-conversation-application/pkg/utils"
 	symbl "github.com/dvonthenen/symbl-go-sdk/pkg/client"
 	neo4j "github.com/neo4j/neo4j-go-driver/v5/neo4j"
+
+	insight "github.com/dvonthenen/enterprise-conversation-plugins/pkg/insight"
+	workerpool "github.com/dvonthenen/enterprise-conversation-plugins/pkg/workerpool"
+	interfaces "github.com/dvonthenen/enterprise-conversation-plugins/plugins/realtime/statistical/interfaces"
 )
 
+/*
+	Statistical configuration
+*/
+type TrendConfig struct {
+	Enabled   bool    `json:"enabled,omitempty"`
+	Window    string  `json:"window,omitempty"`
+	Baseline  string  `json:"baseline,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+	MinCount  int64   `json:"minCount,omitempty"`
+
+	// parsed values
+	window   statWindow
+	baseline statWindow
+}
+
+type HistogramConfig struct {
+	Window string `json:"window,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+
+	// parsed values
+	window statWindow
+	bucket statWindow
+}
+
+type CooccurrenceConfig struct {
+	Enabled    bool   `json:"enabled,omitempty"`
+	Window     string `json:"window,omitempty"`
+	MaxResults int    `json:"maxResults,omitempty"`
+
+	// parsed values
+	window statWindow
+}
+
+type CountersConfig struct {
+	Enabled   bool   `json:"enabled,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Reconcile string `json:"reconcile,omitempty"`
+
+	// parsed values
+	bucket    time.Duration
+	reconcile time.Duration
+}
+
+type BusinessHoursConfig struct {
+	Enabled bool     `json:"enabled,omitempty"`
+	Start   int      `json:"start,omitempty"`
+	End     int      `json:"end,omitempty"`
+	Days    []string `json:"days,omitempty"`
+
+	// parsed values
+	days []int64
+}
+
+type Config struct {
+	Windows       []string            `json:"windows,omitempty"`
+	LegacyStats   bool                `json:"legacyStats,omitempty"`
+	Trend         TrendConfig         `json:"trend,omitempty"`
+	Histograms    []HistogramConfig   `json:"histograms,omitempty"`
+	TopSpeakers   int                 `json:"topSpeakers,omitempty"`
+	Counters      CountersConfig      `json:"counters,omitempty"`
+	Cooccurrence  CooccurrenceConfig  `json:"cooccurrence,omitempty"`
+	TimeZone      string              `json:"timeZone,omitempty"`
+	BusinessHours BusinessHoursConfig `json:"businessHours,omitempty"`
+
+	// parsed values
+	windows      []statWindow
+	queryWindows []statWindow
+	location     *time.Location
+}
+
+/*
+	Window statistics are counted over, calendar based units are kept in months and calendar
+	aligned windows like "this week" start at a boundary in the configured time zone
+*/
+type statWindow struct {
+	name     string
+	months   int64
+	seconds  int64
+	calendar string
+}
+
+/*
+	Counts for a single window
+*/
+type windowCount struct {
+	count         int64
+	conversations int64
+	speakers      int64
+}
+
+/*
+	Results of the stats queries grouped by the lookup key
+*/
+type lookupStats struct {
+	counts     map[string]map[string]windowCount
+	histograms map[string][]interfaces.Histogram
+	speakers   map[string][]interfaces.Speaker
+	related    map[string][]interfaces.Related
+}
+
+/*
+	In memory counters keyed by correlation, then time bucket and then conversation. Speakers
+	are keyed by speakerKey so mentions counted live and loaded from the database agree.
+*/
+type conversationCount struct {
+	count    int64
+	speakers map[string]int64
+}
+
+type speakerInfo struct {
+	id    string
+	name  string
+	email string
+}
+
+type counterStore struct {
+	mu     sync.RWMutex
+	bucket time.Duration
+	keys   map[string]map[int64]map[string]*conversationCount
+
+	// correlation keys mentioned per conversation with the last bucket they were mentioned in,
+	// used to answer co-occurrence
+	conversations map[string]map[string]int64
+	speakers      map[string]speakerInfo
+
+	// conversations handled by this instance are counted as they happen, so the sync skips
+	// their stored mentions. The value is when the conversation was last seen.
+	live map[string]time.Time
+
+	// message and insight IDs counted per live conversation, Symbl repeats the references of a
+	// topic or tracker every time it updates it
+	recorded map[string]map[string]bool
+
+	// mentions created up to synced have been loaded, the counters are only used once ready
+	synced time.Time
+	ready  bool
+}
+
+/*
+	Mention read from the database by the counter sync
+*/
+type storedMention struct {
+	key            string
+	conversationId string
+	speaker        speakerInfo
+	created        time.Time
+}
+
 /*
 	Handler for messages
 */
 type HandlerOptions struct {
-	Session     *neo4j.SessionWithContext // retrieve insights
+	Driver      *neo4j.DriverWithContext // retrieve insights
 	SymblClient *symbl.RestClient
+	Config      *Config
+	Workers     int
+	QueueDepth  int
 }
 
 type Handler struct {
 	// properties
+	mu    sync.Mutex
 	cache map[string]*utils.MessageCache
 
+	// counters
+	counters     *counterStore
+	countersWg   sync.WaitGroup
+	stopCounters chan struct{}
+
+	// insights waiting for the normalized text to be stored
+	pendingInsights *insight.Pending
+
+	// background work
+	cancel     context.CancelFunc
+	background sync.WaitGroup
+
 	// housekeeping
-	session      *neo4j.SessionWithContext
+	config       *Config
+	pool         *workerpool.Pool
+	driver       *neo4j.DriverWithContext
 	symblClient  *symbl.RestClient
+	publishMu    sync.Mutex
 	msgPublisher *interfacessdk.MessagePublisher
 }
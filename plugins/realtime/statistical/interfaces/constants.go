@@ -8,9 +8,18 @@ const (
 	AppSpecificMessageTypeStatistical string = "statistical"
 
 	// user/app level statistical type
-	UserStatisticalTypeTopic   string = "statistical_topic"
-	UserStatisticalTypeTracker string = "statistical_tracker"
-	UserStatisticalTypeEntity  string = "statistical_entity"
+	UserStatisticalTypeTopic        string = "statistical_topic"
+	UserStatisticalTypeTracker      string = "statistical_tracker"
+	UserStatisticalTypeEntity       string = "statistical_entity"
+	UserStatisticalTypeInsight      string = "statistical_insight"
+	UserStatisticalTypeTrend        string = "statistical_trend"
+	UserStatisticalTypeCooccurrence string = "statistical_cooccurrence"
+
+	// what a statistical message was computed for
+	StatisticalCategoryTopic   string = "topic"
+	StatisticalCategoryTracker string = "tracker"
+	StatisticalCategoryEntity  string = "entity"
+	StatisticalCategoryInsight string = "insight"
 
 	// app specific message type
 	MessageNotFound string = "**MESSAGE NOT FOUND**"
@@ -25,10 +25,56 @@ type Stats struct {
 	LastMonth  int64 `json:"lastMonth"`
 }
 
+type Window struct {
+	Window        string `json:"window"`
+	Count         int64  `json:"count"`
+	Conversations int64  `json:"conversations"`
+	Speakers      int64  `json:"speakers"`
+}
+
+type WindowCount struct {
+	Window string `json:"window"`
+	Count  int64  `json:"count"`
+}
+
+type Speaker struct {
+	ID     string        `json:"id,omitempty"`
+	Name   string        `json:"name,omitempty"`
+	Email  string        `json:"email,omitempty"`
+	Counts []WindowCount `json:"counts,omitempty"`
+}
+
+type Histogram struct {
+	Window string  `json:"window"`
+	Bucket string  `json:"bucket"`
+	Counts []int64 `json:"counts"`
+}
+
+type Related struct {
+	Category      string `json:"category"`
+	Correlation   string `json:"correlation"`
+	Conversations int64  `json:"conversations"`
+}
+
+type Trend struct {
+	Window   string  `json:"window"`
+	Baseline string  `json:"baseline"`
+	Count    int64   `json:"count"`
+	Expected float64 `json:"expected"`
+	Ratio    float64 `json:"ratio"`
+	ZScore   float64 `json:"zScore"`
+}
+
 type Data struct {
-	Type     string    `json:"type,omitempty"`
-	Insights []Insight `json:"insights,omitempty"`
-	Stats    Stats     `json:"stats"`
+	Type       string      `json:"type,omitempty"`
+	Category   string      `json:"category,omitempty"`
+	Insights   []Insight   `json:"insights,omitempty"`
+	Windows    []Window    `json:"windows,omitempty"`
+	Stats      *Stats      `json:"stats,omitempty"`
+	Histograms []Histogram `json:"histograms,omitempty"`
+	Speakers   []Speaker   `json:"speakers,omitempty"`
+	Trend      *Trend      `json:"trend,omitempty"`
+	Related    []Related   `json:"related,omitempty"`
 }
 
 /*
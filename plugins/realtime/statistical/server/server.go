@@ -6,6 +6,7 @@ package server
 import (
 	"context"
 	"os"
+	"strconv"
 
 	middlewaresdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk"
 	interfacessdk "github.com/dvonthenen/enterprise-conversation-application/pkg/middleware-plugin-sdk/interfaces"
@@ -52,10 +53,46 @@ func New(options ServerOptions) (*Server, error) {
 		Password:      password,
 	}
 
+	// statistical config
+	config := handlers.DefaultConfig()
+	if v := os.Getenv("STATISTICAL_CONFIG_FILE"); v != "" {
+		klog.V(4).Info("STATISTICAL_CONFIG_FILE found")
+		options.ConfigFile = v
+	}
+	if options.ConfigFile != "" {
+		var err error
+		config, err = handlers.ParseConfig(options.ConfigFile)
+		if err != nil {
+			klog.Errorf("ParseConfig failed. Err: %v\n", err)
+			return nil, err
+		}
+	}
+
+	// worker pool
+	if v := os.Getenv("STATISTICAL_WORKERS"); v != "" {
+		klog.V(4).Info("STATISTICAL_WORKERS found")
+		workers, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("STATISTICAL_WORKERS is invalid. Err: %v\n", err)
+			return nil, ErrInvalidInput
+		}
+		options.Workers = workers
+	}
+	if v := os.Getenv("STATISTICAL_QUEUE_DEPTH"); v != "" {
+		klog.V(4).Info("STATISTICAL_QUEUE_DEPTH found")
+		queueDepth, err := strconv.Atoi(v)
+		if err != nil {
+			klog.Errorf("STATISTICAL_QUEUE_DEPTH is invalid. Err: %v\n", err)
+			return nil, ErrInvalidInput
+		}
+		options.QueueDepth = queueDepth
+	}
+
 	// server
 	server := &Server{
 		options: options,
 		creds:   creds,
+		config:  config,
 	}
 	return server, nil
 }
@@ -210,14 +247,18 @@ func (s *Server) RebuildMiddlewareAnalyzer() error {
 		s.middlewareAnalyzer = nil
 	}
 
-	// create database session
-	ctx := context.Background()
-	session := (*s.driver).NewSession(ctx, neo4j.SessionConfig{DatabaseName: "neo4j"})
+	if s.messageHandler != nil {
+		s.messageHandler.Stop()
+		s.messageHandler = nil
+	}
 
 	// create handler
 	messageHandler := handlers.NewHandler(handlers.HandlerOptions{
-		Session:     &session,
+		Driver:      s.driver,
 		SymblClient: s.symblClient,
+		Config:      s.config,
+		Workers:     s.options.Workers,
+		QueueDepth:  s.options.QueueDepth,
 	})
 
 	// create middleware
@@ -236,6 +277,7 @@ func (s *Server) RebuildMiddlewareAnalyzer() error {
 
 	// housekeeping
 	s.middlewareAnalyzer = middlewareAnalyzer
+	s.messageHandler = messageHandler
 
 	klog.V(4).Infof("Server.RebuildMiddlewareAnalyzer Succeeded\n")
 	klog.V(6).Infof("Server.RebuildMiddlewareAnalyzer LEAVE\n")
@@ -257,6 +299,12 @@ func (s *Server) Stop() error {
 	}
 	s.middlewareAnalyzer = nil
 
+	// drain queued callbacks
+	if s.messageHandler != nil {
+		s.messageHandler.Stop()
+	}
+	s.messageHandler = nil
+
 	// clean up symbl client
 	s.symblClient = nil
 